@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/xml"
+
+	"github.com/pkg/errors"
+	bw2 "gopkg.in/immesys/bw2bind.v5"
+)
+
+// How many commands can wait for an Eagle to POST. Commands beyond this are
+// rejected, since an Eagle that stopped reporting would never drain them.
+const MAX_QUEUED_COMMANDS = 32
+
+// Events whose reporting rate set_schedule changes
+var SCHEDULE_EVENTS = map[string]bool{
+	"time":             true,
+	"message":          true,
+	"price":            true,
+	"summation":        true,
+	"demand":           true,
+	"scheduled_prices": true,
+	"profile_data":     true,
+	"billing_period":   true,
+	"block_period":     true,
+}
+
+// A command sent to the Eagle in the reply to one of its POSTs, e.g.
+//
+//	<LocalCommand>
+//	<Name>set_schedule</Name>
+//	<MacId>0x00178d0000000004</MacId>
+//	<Event>demand</Event>
+//	<Frequency>0x0000000a</Frequency>
+//	<Enabled>Y</Enabled>
+//	</LocalCommand>
+type Command struct {
+	XMLName xml.Name `xml:"LocalCommand"`
+	Name    string   `xml:"Name"`
+	// MAC address of the meter, left out until the Eagle has reported one
+	MacId string `xml:"MacId,omitempty"`
+	// set_schedule
+	Event     string    `xml:"Event,omitempty"`
+	Frequency *HexInt64 `xml:"Frequency,omitempty"`
+	Enabled   string    `xml:"Enabled,omitempty"`
+	// set_fast_poll, in minutes
+	Duration *HexInt64 `xml:"Duration,omitempty"`
+	// get_history_data, in seconds since the Eagle epoch
+	StartTime *HexInt64 `xml:"StartTime,omitempty"`
+	EndTime   *HexInt64 `xml:"EndTime,omitempty"`
+}
+
+// A command as published on the command slot of i.eagle:
+//
+//	{"name": "set_schedule", "event": "demand", "frequency": 10, "enabled": true}
+//	{"name": "set_fast_poll", "frequency": 5, "duration": 15}
+//	{"name": "get_history_data", "start_time": <ns>, "end_time": <ns>, "frequency": 900}
+type CommandRequest struct {
+	Name  string `msgpack:"name"`
+	Event string `msgpack:"event"`
+	// in seconds
+	Frequency int64 `msgpack:"frequency"`
+	Enabled   *bool `msgpack:"enabled"`
+	// in minutes
+	Duration int64 `msgpack:"duration"`
+	// in nanoseconds since the Unix epoch
+	StartTime int64 `msgpack:"start_time"`
+	EndTime   int64 `msgpack:"end_time"`
+}
+
+// Checks the request against the bounds of the Uploader API and builds the
+// command to send to the eagle
+func (eagle *Eagle) newCommand(req CommandRequest) (*Command, error) {
+	cmd := &Command{Name: req.Name, MacId: eagle.meterMAC()}
+	switch req.Name {
+	case "set_schedule":
+		if !SCHEDULE_EVENTS[req.Event] {
+			return nil, errors.Errorf("Unknown set_schedule event %q", req.Event)
+		}
+		if req.Frequency < 1 || req.Frequency > 0xfffe {
+			return nil, errors.Errorf("set_schedule frequency %d outside of [1, 65534] seconds", req.Frequency)
+		}
+		cmd.Event = req.Event
+		cmd.Frequency = hexInt64(req.Frequency)
+		cmd.Enabled = "Y"
+		if req.Enabled != nil && !*req.Enabled {
+			cmd.Enabled = "N"
+		}
+	case "set_fast_poll":
+		if req.Frequency < 1 || req.Frequency > 0xff {
+			return nil, errors.Errorf("set_fast_poll frequency %d outside of [1, 255] seconds", req.Frequency)
+		}
+		if req.Duration < 0 || req.Duration > 0x0f {
+			return nil, errors.Errorf("set_fast_poll duration %d outside of [0, 15] minutes", req.Duration)
+		}
+		cmd.Frequency = hexInt64(req.Frequency)
+		cmd.Duration = hexInt64(req.Duration)
+	case "get_history_data":
+		start := req.StartTime/1e9 - EAGLE_EPOCH
+		end := req.EndTime/1e9 - EAGLE_EPOCH
+		if start < 0 {
+			return nil, errors.New("get_history_data start_time is before the Eagle epoch")
+		}
+		if req.EndTime != 0 && end <= start {
+			return nil, errors.New("get_history_data end_time is not after start_time")
+		}
+		if req.Frequency < 0 || req.Frequency > 0xfffe {
+			return nil, errors.Errorf("get_history_data frequency %d outside of [0, 65534] seconds", req.Frequency)
+		}
+		cmd.StartTime = hexInt64(start)
+		// the Eagle sends everything since start_time if there is no end
+		if req.EndTime != 0 {
+			cmd.EndTime = hexInt64(end)
+		}
+		if req.Frequency != 0 {
+			cmd.Frequency = hexInt64(req.Frequency)
+		}
+	default:
+		return nil, errors.Errorf("Unknown command %q", req.Name)
+	}
+	return cmd, nil
+}
+
+// Queues a command to send in the reply to the Eagle's next POST
+func (eagle *Eagle) enqueue(cmd *Command) error {
+	eagle.commandLock.Lock()
+	defer eagle.commandLock.Unlock()
+	if len(eagle.commands) >= MAX_QUEUED_COMMANDS {
+		return errors.Errorf("Eagle %s already has %d queued commands", eagle.DeviceMAC, len(eagle.commands))
+	}
+	eagle.commands = append(eagle.commands, cmd)
+	return nil
+}
+
+// Removes and returns the oldest queued command, or nil if there is none
+func (eagle *Eagle) nextCommand() *Command {
+	eagle.commandLock.Lock()
+	defer eagle.commandLock.Unlock()
+	if len(eagle.commands) == 0 {
+		return nil
+	}
+	cmd := eagle.commands[0]
+	eagle.commands = eagle.commands[1:]
+	eagle.setReportFrequency(cmd)
+	return cmd
+}
+
+// Handles messages on the command slot of i.eagle
+func (eagle *Eagle) handleCommand(msg *bw2.SimpleMessage) {
+	for _, po := range msg.POs {
+		if !po.IsType(bw2.PONumMsgPack, bw2.POMaskMsgPack) {
+			continue
+		}
+		pom, ok := po.(bw2.MsgPackPayloadObject)
+		if !ok {
+			log.Warning("Skipping invalid command")
+			continue
+		}
+		var req CommandRequest
+		if err := pom.ValueInto(&req); err != nil {
+			log.Error(errors.Wrap(err, "Could not decode command"))
+			continue
+		}
+		cmd, err := eagle.newCommand(req)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		if err := eagle.enqueue(cmd); err != nil {
+			log.Error(err)
+			continue
+		}
+		log.Noticef("Queued %s for Eagle %s", cmd.Name, eagle.DeviceMAC)
+	}
+}
+
+func hexInt64(v int64) *HexInt64 {
+	h := HexInt64(v)
+	return &h
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/xml"
+	"testing"
+)
+
+// Nanoseconds since the Unix epoch of seconds since the Eagle epoch
+func eagleTime(seconds int64) int64 {
+	return (EAGLE_EPOCH + seconds) * 1e9
+}
+
+func TestNewCommand(t *testing.T) {
+	disabled := false
+	for _, test := range []struct {
+		req CommandRequest
+		// the encoded command, or "" if the request must be rejected
+		want string
+	}{
+		{CommandRequest{Name: "set_schedule", Event: "demand", Frequency: 10},
+			"<LocalCommand><Name>set_schedule</Name><MacId>0x00178d0000000004</MacId><Event>demand</Event><Frequency>0x0000000a</Frequency><Enabled>Y</Enabled></LocalCommand>"},
+		{CommandRequest{Name: "set_schedule", Event: "summation", Frequency: 0xfffe, Enabled: &disabled},
+			"<LocalCommand><Name>set_schedule</Name><MacId>0x00178d0000000004</MacId><Event>summation</Event><Frequency>0x0000fffe</Frequency><Enabled>N</Enabled></LocalCommand>"},
+		{CommandRequest{Name: "set_schedule", Event: "weather", Frequency: 10}, ""},
+		{CommandRequest{Name: "set_schedule", Event: "demand", Frequency: 0}, ""},
+		{CommandRequest{Name: "set_schedule", Event: "demand", Frequency: 0xffff}, ""},
+		{CommandRequest{Name: "set_fast_poll", Frequency: 5, Duration: 15},
+			"<LocalCommand><Name>set_fast_poll</Name><MacId>0x00178d0000000004</MacId><Frequency>0x00000005</Frequency><Duration>0x0000000f</Duration></LocalCommand>"},
+		{CommandRequest{Name: "set_fast_poll", Frequency: 0, Duration: 15}, ""},
+		{CommandRequest{Name: "set_fast_poll", Frequency: 0x100, Duration: 15}, ""},
+		{CommandRequest{Name: "set_fast_poll", Frequency: 5, Duration: 16}, ""},
+		{CommandRequest{Name: "set_fast_poll", Frequency: 5, Duration: -1}, ""},
+		{CommandRequest{Name: "get_history_data", StartTime: eagleTime(0x100), EndTime: eagleTime(0x200), Frequency: 900},
+			"<LocalCommand><Name>get_history_data</Name><MacId>0x00178d0000000004</MacId><Frequency>0x00000384</Frequency><StartTime>0x00000100</StartTime><EndTime>0x00000200</EndTime></LocalCommand>"},
+		{CommandRequest{Name: "get_history_data", StartTime: eagleTime(0x100)},
+			"<LocalCommand><Name>get_history_data</Name><MacId>0x00178d0000000004</MacId><StartTime>0x00000100</StartTime></LocalCommand>"},
+		{CommandRequest{Name: "get_history_data", StartTime: eagleTime(-1)}, ""},
+		{CommandRequest{Name: "get_history_data", StartTime: eagleTime(0x200), EndTime: eagleTime(0x200)}, ""},
+		{CommandRequest{Name: "get_history_data", StartTime: eagleTime(0x100), Frequency: 0xffff}, ""},
+		{CommandRequest{Name: "reboot"}, ""},
+	} {
+		eagle := &Eagle{MeterMAC: "0x00178d0000000004"}
+		cmd, err := eagle.newCommand(test.req)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("newCommand(%+v) = %+v, want an error", test.req, cmd)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("newCommand(%+v) failed: %v", test.req, err)
+			continue
+		}
+		encoded, err := xml.Marshal(cmd)
+		if err != nil {
+			t.Errorf("Failed to encode %+v: %v", cmd, err)
+			continue
+		}
+		if string(encoded) != test.want {
+			t.Errorf("newCommand(%+v) encoded to\n%s\nwant\n%s", test.req, encoded, test.want)
+		}
+	}
+}
+
+func TestCommandQueue(t *testing.T) {
+	eagle := &Eagle{}
+	for i := 0; i < MAX_QUEUED_COMMANDS; i++ {
+		if err := eagle.enqueue(&Command{Name: "set_fast_poll"}); err != nil {
+			t.Fatalf("Failed to queue command %d: %v", i, err)
+		}
+	}
+	if err := eagle.enqueue(&Command{Name: "set_fast_poll"}); err == nil {
+		t.Errorf("Queued more than %d commands", MAX_QUEUED_COMMANDS)
+	}
+	for i := 0; i < MAX_QUEUED_COMMANDS; i++ {
+		if cmd := eagle.nextCommand(); cmd == nil {
+			t.Fatalf("Queue ran out after %d commands", i)
+		}
+	}
+	if cmd := eagle.nextCommand(); cmd != nil {
+		t.Errorf("Empty queue returned %+v", cmd)
+	}
+}
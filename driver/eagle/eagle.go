@@ -30,16 +30,19 @@
 //	- Instantaneous Demand
 //  - Message (might require a reply?)
 //	- CurrentSummation
-//  - FastPollStatus
-//	- HistoryData
+//  - FastPollStatus (see history.go)
+//	- HistoryData (see history.go)
 //
-// Commands to send:
+// Commands to send (see command.go):
 //  - set_schedule (changes poll rate)
+//  - set_fast_poll (reports demand every few seconds for up to 15 minutes)
+//  - get_history_data (replays the summations over a window of time)
 package main
 
 import (
 	"encoding/xml"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
@@ -61,6 +64,8 @@ type Eagle struct {
 	DeviceMAC string
 	// MAC address of meter
 	MeterMAC string
+	// URI the Eagle's service is registered under
+	BaseURI string
 	// multiplier for demand readings
 	Multiplier int64
 	// type of meter (Electric/Gas/Water/Other)
@@ -68,7 +73,24 @@ type Eagle struct {
 	// bosswave publishing interface
 	iface     *bw2.Interface
 	xbosiface *bw2.Interface
+	cmdiface  *bw2.Interface
 	svc       *bw2.Service
+	// commands waiting to be sent to the Eagle, one per reply
+	commands []*Command
+	// timestamp (ns) of the latest live reading, to detect gaps, and of the
+	// one last saved to the registry
+	last_report  int64
+	saved_report int64
+	// how often the meter reports while fast polling, and until when (ns)
+	fast_poll_frequency time.Duration
+	fast_poll_end       int64
+	// reporting rates sent with set_schedule, by event; 0 if disabled
+	report_frequencies map[string]time.Duration
+	// guards commands, the report timestamps, the fast poll status and
+	// report_frequencies
+	commandLock sync.Mutex
+	// guards MeterMAC and the NetworkInfo, which the registry reads
+	infoLock sync.Mutex
 	// current status of Eagle
 	current_demand              float64
 	current_price               float64
@@ -79,6 +101,24 @@ type Eagle struct {
 	NetworkInfo
 }
 
+// Returns the MAC address of the Eagle's meter, empty until it reports one
+func (eagle *Eagle) meterMAC() string {
+	eagle.infoLock.Lock()
+	defer eagle.infoLock.Unlock()
+	return eagle.MeterMAC
+}
+
+// Records the MAC address of the Eagle's meter, returning whether it changed
+func (eagle *Eagle) setMeterMAC(mac string) bool {
+	eagle.infoLock.Lock()
+	defer eagle.infoLock.Unlock()
+	if eagle.MeterMAC == mac {
+		return false
+	}
+	eagle.MeterMAC = mac
+	return true
+}
+
 type Response struct {
 	XMLName                   xml.Name
 	MacID                     string `xml:"macId,attr"`
@@ -88,6 +128,8 @@ type Response struct {
 	PriceCluster              *PriceCluster
 	MessageCluster            *MessageCluster
 	CurrentSummationDelivered *CurrentSummation
+	HistoryData               *HistoryData
+	FastPollStatus            *FastPollStatus
 }
 
 type InstantaneousDemand struct {
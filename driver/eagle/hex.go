@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/xml"
+	"fmt"
 	"strconv"
 
 	"github.com/pkg/errors"
@@ -24,6 +25,10 @@ func (v *HexInt64) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
 	return err
 }
 
+func (v *HexInt64) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	return e.EncodeElement(fmt.Sprintf("0x%08x", int64(*v)), start)
+}
+
 func (v *HexInt64) Int64() int64 {
 	return int64(*v)
 }
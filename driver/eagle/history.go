@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/xml"
+	"time"
+
+	"github.com/pkg/errors"
+	bw2 "gopkg.in/immesys/bw2bind.v5"
+)
+
+// How long an Eagle may go without reporting before the missing readings are
+// requested with get_history_data, unless set_schedule slowed it down
+const MAX_REPORT_GAP = 5 * time.Minute
+
+// How many reports an Eagle may miss, at the rate it was scheduled to report
+// or fast poll at, before the missing readings are requested
+const MAX_MISSED_REPORTS = 10
+
+// How far the latest live reading may run ahead of the one saved in the
+// registry. A restart within this long of an outage may miss backfilling it.
+const SAVE_REPORT_INTERVAL = time.Minute
+
+// Events whose reports are checked for gaps
+var GAP_EVENTS = []string{"demand", "summation"}
+
+// Sent in reply to get_history_data: the summations, and on some meters the
+// demand, over the requested window, each with its own timestamp
+type HistoryData struct {
+	XMLName                   xml.Name
+	CurrentSummation          []*CurrentSummation    `xml:"CurrentSummation"`
+	CurrentSummationDelivered []*CurrentSummation    `xml:"CurrentSummationDelivered"`
+	InstantaneousDemand       []*InstantaneousDemand `xml:"InstantaneousDemand"`
+}
+
+// Reports whether the meter is fast polling, and until when
+type FastPollStatus struct {
+	XMLName     xml.Name
+	DeviceMacId string
+	MeterMacId  string
+	// in seconds, 0 if the meter is not fast polling
+	Frequency *HexInt64
+	// in seconds since the Eagle epoch
+	EndTime *HexInt64
+}
+
+// Converts the timestamp to nanoseconds since the Unix epoch and the demand to
+// kW, filling in ActualTimestamp and ActualDemand
+func (demand *InstantaneousDemand) convert() error {
+	if demand.TimeStamp == nil || demand.Demand == nil || demand.Multiplier == nil || demand.Divisor == nil || demand.Divisor.Int64() == 0 {
+		return errors.Errorf("Incomplete InstantaneousDemand from %s", demand.DeviceMacId)
+	}
+	if demand.Demand.Int64() > 0xf0000000 {
+		negative_demand := HexInt64(demand.Demand.Int64() - 0xffffffff)
+		demand.Demand = &negative_demand
+	}
+	demand.ActualTimestamp = int64(*demand.TimeStamp+HexInt64(EAGLE_EPOCH)) * 1e9
+	demand.ActualDemand = float64(*demand.Demand) * float64(*demand.Multiplier) / float64(*demand.Divisor)
+	return nil
+}
+
+// Converts the timestamp to nanoseconds since the Unix epoch and the
+// summations to kWh, filling in the Actual fields
+func (summ *CurrentSummation) convert() error {
+	if summ.TimeStamp == nil || summ.SummationDelivered == nil || summ.SummationReceived == nil || summ.Multiplier == nil || summ.Divisor == nil || summ.Divisor.Int64() == 0 {
+		return errors.Errorf("Incomplete CurrentSummation from %s", summ.DeviceMacId)
+	}
+	summ.ActualTimestamp = int64(*summ.TimeStamp+HexInt64(EAGLE_EPOCH)) * 1e9
+	summ.ActualSummationDelivered = float64(*summ.SummationDelivered) * float64(*summ.Multiplier) / float64(*summ.Divisor)
+	summ.ActualSummationReceived = float64(*summ.SummationReceived) * float64(*summ.Multiplier) / float64(*summ.Divisor)
+	return nil
+}
+
+// Returns the summations, whichever tag the Eagle used for them
+func (history *HistoryData) summations() []*CurrentSummation {
+	var summations []*CurrentSummation
+	summations = append(summations, history.CurrentSummation...)
+	return append(summations, history.CurrentSummationDelivered...)
+}
+
+// Returns the MAC of the Eagle that sent the history, or "" if it is empty
+func (history *HistoryData) DeviceMacId() string {
+	if summations := history.summations(); len(summations) > 0 {
+		return summations[0].DeviceMacId
+	}
+	if len(history.InstantaneousDemand) > 0 {
+		return history.InstantaneousDemand[0].DeviceMacId
+	}
+	return ""
+}
+
+// Republishes the readings in a HistoryData with their original timestamps:
+// summations on the history signal of i.meter and demand on the info signal
+// of i.xbos.meter. The Eagle's current readings are left alone.
+func (srv *EagleServer) forwardHistory(eagle *Eagle, history *HistoryData) {
+	for _, summ := range history.summations() {
+		if err := summ.convert(); err != nil {
+			log.Warning(err)
+			continue
+		}
+		msg := map[string]interface{}{
+			"current_summation_delivered": summ.ActualSummationDelivered,
+			"current_summation_received":  summ.ActualSummationReceived,
+			"time":                        summ.ActualTimestamp,
+		}
+		po, _ := bw2.CreateMsgPackPayloadObject(bw2.FromDotForm("2.0.9.1"), msg)
+		if err := eagle.iface.PublishSignal("history", po); err != nil {
+			log.Error(errors.Wrap(err, "Could not publish i.meter history"))
+		}
+	}
+	for _, demand := range history.InstantaneousDemand {
+		if err := demand.convert(); err != nil {
+			log.Warning(err)
+			continue
+		}
+		xbos_msg := map[string]interface{}{
+			"power": demand.ActualDemand * srv.multiplier * 1000,
+			"time":  demand.ActualTimestamp,
+		}
+		po, _ := bw2.CreateMsgPackPayloadObject(bw2.FromDotForm("2.1.1.4"), xbos_msg)
+		if err := eagle.xbosiface.PublishSignal("info", po); err != nil {
+			log.Error(errors.Wrap(err, "Could not publish i.xbos.meter history"))
+		}
+	}
+}
+
+// Records the meter's fast poll status, which tells how often it should be
+// reporting
+func (eagle *Eagle) setFastPoll(status *FastPollStatus) {
+	eagle.commandLock.Lock()
+	defer eagle.commandLock.Unlock()
+	eagle.fast_poll_frequency = 0
+	eagle.fast_poll_end = 0
+	if status.Frequency != nil && status.EndTime != nil {
+		eagle.fast_poll_frequency = time.Duration(status.Frequency.Int64()) * time.Second
+		eagle.fast_poll_end = int64(*status.EndTime+HexInt64(EAGLE_EPOCH)) * 1e9
+	}
+}
+
+// Records a live reading taken at timestamp (ns), and queues get_history_data
+// for the readings missed since the previous one if the Eagle was silent for
+// longer than it should have been, e.g. during a network outage. Returns
+// whether the Eagle should be saved to the registry to keep the time of its
+// latest reading across restarts.
+func (eagle *Eagle) checkGap(timestamp int64) (save bool) {
+	eagle.commandLock.Lock()
+	last := eagle.last_report
+	if timestamp <= last {
+		eagle.commandLock.Unlock()
+		return false
+	}
+	eagle.last_report = timestamp
+	if time.Duration(timestamp-eagle.saved_report) >= SAVE_REPORT_INTERVAL {
+		eagle.saved_report = timestamp
+		save = true
+	}
+	gap := eagle.reportGap()
+	if eagle.fast_poll_frequency > 0 && last < eagle.fast_poll_end {
+		gap = MAX_MISSED_REPORTS * eagle.fast_poll_frequency
+	}
+	eagle.commandLock.Unlock()
+
+	if last == 0 || time.Duration(timestamp-last) <= gap {
+		return save
+	}
+	cmd, err := eagle.newCommand(CommandRequest{Name: "get_history_data", StartTime: last, EndTime: timestamp})
+	if err == nil {
+		err = eagle.enqueue(cmd)
+	}
+	if err != nil {
+		log.Error(errors.Wrap(err, "Could not request missing readings"))
+		return save
+	}
+	log.Noticef("Eagle %s was silent for %s, requesting the missing readings", eagle.DeviceMAC, time.Duration(timestamp-last))
+	return save
+}
+
+// Records the reporting rate a set_schedule command sets. Called with
+// commandLock held.
+func (eagle *Eagle) setReportFrequency(cmd *Command) {
+	if cmd.Name != "set_schedule" || cmd.Frequency == nil {
+		return
+	}
+	if eagle.report_frequencies == nil {
+		eagle.report_frequencies = make(map[string]time.Duration)
+	}
+	frequency := time.Duration(cmd.Frequency.Int64()) * time.Second
+	if cmd.Enabled == "N" {
+		frequency = 0
+	}
+	eagle.report_frequencies[cmd.Event] = frequency
+}
+
+// How long the Eagle may go without reporting given the rates set with
+// set_schedule: MAX_MISSED_REPORTS at the fastest rate of the GAP_EVENTS, but
+// at least MAX_REPORT_GAP. Events that were never scheduled report at their
+// default rate, which MAX_REPORT_GAP covers. Called with commandLock held.
+func (eagle *Eagle) reportGap() time.Duration {
+	var fastest time.Duration
+	for _, event := range GAP_EVENTS {
+		frequency, scheduled := eagle.report_frequencies[event]
+		if !scheduled {
+			return MAX_REPORT_GAP
+		}
+		if frequency > 0 && (fastest == 0 || frequency < fastest) {
+			fastest = frequency
+		}
+	}
+	if gap := MAX_MISSED_REPORTS * fastest; gap > MAX_REPORT_GAP {
+		return gap
+	}
+	return MAX_REPORT_GAP
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+	"time"
+)
+
+const historyPost = `<rainforest macId="0xd8d5b9000000103f" timestamp="1490000000s">
+<HistoryData>
+<CurrentSummation>
+<DeviceMacId>0xd8d5b9000000103f</DeviceMacId>
+<MeterMacId>0x00178d0000000004</MeterMacId>
+<TimeStamp>0x1c0bd3a0</TimeStamp>
+<SummationDelivered>0x00000000000c350</SummationDelivered>
+<SummationReceived>0x0000000000000000</SummationReceived>
+<Multiplier>0x00000001</Multiplier>
+<Divisor>0x000003e8</Divisor>
+<DigitsRight>0x01</DigitsRight>
+<DigitsLeft>0x06</DigitsLeft>
+<SuppressLeadingZero>Y</SuppressLeadingZero>
+</CurrentSummation>
+<CurrentSummationDelivered>
+<DeviceMacId>0xd8d5b9000000103f</DeviceMacId>
+<MeterMacId>0x00178d0000000004</MeterMacId>
+<TimeStamp>0x1c0bd4cc</TimeStamp>
+<SummationDelivered>0x00000000000c418</SummationDelivered>
+<SummationReceived>0x0000000000000000</SummationReceived>
+<Multiplier>0x00000001</Multiplier>
+<Divisor>0x000003e8</Divisor>
+</CurrentSummationDelivered>
+<InstantaneousDemand>
+<DeviceMacId>0xd8d5b9000000103f</DeviceMacId>
+<MeterMacId>0x00178d0000000004</MeterMacId>
+<TimeStamp>0x1c0bd3a0</TimeStamp>
+<Demand>0x000005dc</Demand>
+<Multiplier>0x00000001</Multiplier>
+<Divisor>0x000003e8</Divisor>
+</InstantaneousDemand>
+</HistoryData>
+</rainforest>`
+
+const fastPollPost = `<rainforest macId="0xd8d5b9000000103f" timestamp="1490000000s">
+<FastPollStatus>
+<DeviceMacId>0xd8d5b9000000103f</DeviceMacId>
+<MeterMacId>0x00178d0000000004</MeterMacId>
+<Frequency>0x05</Frequency>
+<EndTime>0x1c0bd72c</EndTime>
+</FastPollStatus>
+</rainforest>`
+
+func decodePost(t *testing.T, post string) Response {
+	t.Helper()
+	var resp Response
+	if err := xml.NewDecoder(strings.NewReader(post)).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode post: %v", err)
+	}
+	return resp
+}
+
+func TestDecodeHistoryData(t *testing.T) {
+	history := decodePost(t, historyPost).HistoryData
+	if history == nil {
+		t.Fatal("No HistoryData decoded")
+	}
+	if mac := history.DeviceMacId(); mac != "0xd8d5b9000000103f" {
+		t.Errorf("HistoryData from %q, want 0xd8d5b9000000103f", mac)
+	}
+
+	summations := history.summations()
+	if len(summations) != 2 {
+		t.Fatalf("Decoded %d summations, want 2", len(summations))
+	}
+	for i, want := range []struct {
+		timestamp int64
+		delivered float64
+	}{{0x1c0bd3a0, 50}, {0x1c0bd4cc, 50.2}} {
+		summ := summations[i]
+		if err := summ.convert(); err != nil {
+			t.Fatal(err)
+		}
+		if summ.ActualTimestamp != (EAGLE_EPOCH+want.timestamp)*1e9 || summ.ActualSummationDelivered != want.delivered {
+			t.Errorf("Summation %d at %d of %v kWh, want %d and %v", i, summ.ActualTimestamp, summ.ActualSummationDelivered,
+				(EAGLE_EPOCH+want.timestamp)*1e9, want.delivered)
+		}
+	}
+
+	if len(history.InstantaneousDemand) != 1 {
+		t.Fatalf("Decoded %d demand readings, want 1", len(history.InstantaneousDemand))
+	}
+	demand := history.InstantaneousDemand[0]
+	if err := demand.convert(); err != nil {
+		t.Fatal(err)
+	}
+	if demand.ActualDemand != 1.5 {
+		t.Errorf("Demand is %v kW, want 1.5", demand.ActualDemand)
+	}
+
+	// Readings the meter left incomplete are skipped, not divided by zero
+	if err := (&CurrentSummation{DeviceMacId: "0xd8d5b9000000103f"}).convert(); err == nil {
+		t.Error("Converted an empty summation")
+	}
+}
+
+func TestDecodeFastPollStatus(t *testing.T) {
+	status := decodePost(t, fastPollPost).FastPollStatus
+	if status == nil {
+		t.Fatal("No FastPollStatus decoded")
+	}
+	eagle := &Eagle{}
+	eagle.setFastPoll(status)
+	if eagle.fast_poll_frequency != 5*time.Second || eagle.fast_poll_end != (EAGLE_EPOCH+0x1c0bd72c)*1e9 {
+		t.Errorf("Fast polling every %v until %d, want every 5s until %d", eagle.fast_poll_frequency,
+			eagle.fast_poll_end, (EAGLE_EPOCH+0x1c0bd72c)*1e9)
+	}
+
+	eagle.setFastPoll(&FastPollStatus{})
+	if eagle.fast_poll_frequency != 0 || eagle.fast_poll_end != 0 {
+		t.Errorf("Still fast polling every %v after it ended", eagle.fast_poll_frequency)
+	}
+}
+
+func TestCheckGap(t *testing.T) {
+	start := eagleTime(0x1c0bd3a0)
+	for _, test := range []struct {
+		name string
+		// commands sent to the Eagle before the readings
+		sent []CommandRequest
+		// fast poll frequency in seconds, 0 if not fast polling
+		fastPoll int64
+		gap      time.Duration
+		request  bool
+	}{
+		{name: "default rate", gap: MAX_REPORT_GAP},
+		{name: "default rate", gap: MAX_REPORT_GAP + time.Second, request: true},
+		{name: "fast polling", fastPoll: 5, gap: MAX_MISSED_REPORTS * 5 * time.Second},
+		{name: "fast polling", fastPoll: 5, gap: MAX_MISSED_REPORTS*5*time.Second + time.Second, request: true},
+		{
+			name: "demand only scheduled",
+			sent: []CommandRequest{{Name: "set_schedule", Event: "demand", Frequency: 3600}},
+			gap:  MAX_REPORT_GAP + time.Second, request: true,
+		},
+		{
+			name: "hourly",
+			sent: []CommandRequest{
+				{Name: "set_schedule", Event: "demand", Frequency: 3600},
+				{Name: "set_schedule", Event: "summation", Frequency: 7200},
+			},
+			gap: MAX_MISSED_REPORTS * time.Hour,
+		},
+		{
+			name: "hourly",
+			sent: []CommandRequest{
+				{Name: "set_schedule", Event: "demand", Frequency: 3600},
+				{Name: "set_schedule", Event: "summation", Frequency: 7200},
+			},
+			gap: MAX_MISSED_REPORTS*time.Hour + time.Second, request: true,
+		},
+		{
+			name: "summation disabled",
+			sent: []CommandRequest{
+				{Name: "set_schedule", Event: "demand", Frequency: 3600},
+				{Name: "set_schedule", Event: "summation", Frequency: 10, Enabled: boolean(false)},
+			},
+			gap: MAX_MISSED_REPORTS * time.Hour,
+		},
+		{
+			name: "faster than default",
+			sent: []CommandRequest{
+				{Name: "set_schedule", Event: "demand", Frequency: 1},
+				{Name: "set_schedule", Event: "summation", Frequency: 1},
+			},
+			gap: MAX_REPORT_GAP,
+		},
+	} {
+		eagle := &Eagle{DeviceMAC: "0xd8d5b9000000103f", MeterMAC: "0x00178d0000000004"}
+		for _, req := range test.sent {
+			cmd, err := eagle.newCommand(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := eagle.enqueue(cmd); err != nil {
+				t.Fatal(err)
+			}
+			eagle.nextCommand()
+		}
+		if test.fastPoll > 0 {
+			eagle.setFastPoll(&FastPollStatus{Frequency: hexInt64(test.fastPoll), EndTime: hexInt64(0x1c0bd3a0 + 900)})
+		}
+
+		eagle.checkGap(start)
+		// an older reading arriving late is not a gap
+		eagle.checkGap(start - 1e9)
+		end := start + int64(test.gap)
+		eagle.checkGap(end)
+		cmd := eagle.nextCommand()
+		if !test.request {
+			if cmd != nil {
+				t.Errorf("%s: silence of %v requested %+v", test.name, test.gap, cmd)
+			}
+			continue
+		}
+		if cmd == nil || cmd.Name != "get_history_data" {
+			t.Errorf("%s: silence of %v requested %+v, want get_history_data", test.name, test.gap, cmd)
+			continue
+		}
+		if cmd.StartTime.Int64() != start/1e9-EAGLE_EPOCH || cmd.EndTime.Int64() != end/1e9-EAGLE_EPOCH {
+			t.Errorf("%s: requested history from %d to %d, want %d to %d", test.name, cmd.StartTime.Int64(),
+				cmd.EndTime.Int64(), start/1e9-EAGLE_EPOCH, end/1e9-EAGLE_EPOCH)
+		}
+	}
+}
+
+// The registry keeps the latest reading's time, so an outage spanning a
+// restart is still backfilled
+func TestCheckGapSave(t *testing.T) {
+	start := eagleTime(0x1c0bd3a0)
+	eagle := &Eagle{DeviceMAC: "0xd8d5b9000000103f"}
+	if !eagle.checkGap(start) {
+		t.Error("First reading was not saved")
+	}
+	if eagle.checkGap(start + int64(SAVE_REPORT_INTERVAL) - 1e9) {
+		t.Errorf("Reading less than %v after the saved one was saved", SAVE_REPORT_INTERVAL)
+	}
+	if !eagle.checkGap(start + int64(SAVE_REPORT_INTERVAL)) {
+		t.Errorf("Reading %v after the saved one was not saved", SAVE_REPORT_INTERVAL)
+	}
+	if rec := eagle.record(); rec.LastReport != start+int64(SAVE_REPORT_INTERVAL) {
+		t.Errorf("Record has last report %d, want %d", rec.LastReport, start+int64(SAVE_REPORT_INTERVAL))
+	}
+
+	// As registered again from the registry after a restart
+	restarted := &Eagle{DeviceMAC: "0xd8d5b9000000103f", last_report: start, saved_report: start}
+	end := start + int64(time.Hour)
+	restarted.checkGap(end)
+	if cmd := restarted.nextCommand(); cmd == nil || cmd.Name != "get_history_data" ||
+		cmd.StartTime.Int64() != start/1e9-EAGLE_EPOCH || cmd.EndTime.Int64() != end/1e9-EAGLE_EPOCH {
+		t.Errorf("Reading an hour after the saved one requested %+v, want get_history_data for the hour", cmd)
+	}
+}
+
+func boolean(v bool) *bool { return &v }
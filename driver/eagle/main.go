@@ -28,6 +28,7 @@ import (
 
 	"github.com/immesys/spawnpoint/spawnable"
 	"github.com/op/go-logging"
+	"github.com/pkg/errors"
 	"github.com/xyproto/permissionbolt"
 	"github.com/xyproto/pinterface"
 	"golang.org/x/crypto/acme/autocert"
@@ -70,6 +71,10 @@ type EagleServer struct {
 	eagles     map[string]*Eagle
 	eagleLock  sync.RWMutex
 	multiplier float64
+	// Eagles persisted in the BoltDB, including ones that haven't reported
+	// since the server started
+	registry *Registry
+	known    map[string]EagleRecord
 
 	// HTTPS server
 	address   string
@@ -104,6 +109,16 @@ func StartEagleServer() {
 	server.userstate = perm.UserState().(*permissionbolt.UserState)
 	server.userstate.SetCookieTimeout(120) // 2 min
 
+	// reload the Eagles registered before the server restarted
+	server.registry, err = NewRegistry(server.userstate.Database())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if server.known, err = server.registry.Load(); err != nil {
+		log.Fatal(err)
+	}
+	log.Noticef("Loaded %d Eagles from the registry", len(server.known))
+
 	params, err := spawnable.GetParams()
 	if err != nil {
 		params, err = spawnable.GetParamsFile("/etc/eagle/params.yml")
@@ -307,12 +322,20 @@ func (srv *EagleServer) handleData(rw http.ResponseWriter, req *http.Request) {
 			rw.WriteHeader(500)
 			return
 		}
-		// TODO: have this method return any configuration struct
 		log.Debugf("%+v", resp)
-		srv.HandleMessage(resp, baseuri)
+		cmd := srv.HandleMessage(resp, baseuri)
 
 		// this is the reply the eagle expects
 		rw.Header().Set("Connection", "close")
+		if cmd != nil {
+			reply, err := xml.Marshal(cmd)
+			if err == nil {
+				log.Infof("Sending %s", reply)
+				rw.Write(append(reply, '\n'))
+				return
+			}
+			log.Error(errors.Wrap(err, "Could not encode command"))
+		}
 		rw.Write([]byte{'\n', '\n'})
 	} else if req.Method == http.MethodGet {
 		rw.Header().Set("Content-Type", "text/html")
@@ -320,29 +343,27 @@ func (srv *EagleServer) handleData(rw http.ResponseWriter, req *http.Request) {
 	}
 }
 
-func (srv *EagleServer) HandleMessage(resp Response, baseuri string) {
+// Mirrors the message onto BOSSWAVE, and returns the next command queued for
+// the Eagle it came from, if any
+func (srv *EagleServer) HandleMessage(resp Response, baseuri string) *Command {
 	// if we haven't seen this eagle before, ignore the message.
-	// We only want to register off of the NetworkInfo messages
+	// We only want to register off of the NetworkInfo messages, or of the
+	// registry for Eagles seen before the server restarted
 
 	// handle registration of a new eagle
 	if resp.NetworkInfo != nil {
 		log.Info("NETWORK INFO")
 		info := resp.NetworkInfo
 		srv.eagleLock.Lock()
-		defer srv.eagleLock.Unlock()
 
 		var eagle *Eagle
 		var found bool
 
 		// create new eeeaaagleeeee
 		if eagle, found = srv.eagles[info.DeviceMacId]; !found {
-			eagle = &Eagle{}
-			// TODO: set metadata on these uris
-			eagle.svc = srv.bwclient.RegisterService(baseuri, "s.eagle")
-			eagle.iface = eagle.svc.RegisterInterface(info.DeviceMacId, "i.meter")
-			eagle.xbosiface = eagle.svc.RegisterInterface(info.DeviceMacId, "i.xbos.meter")
+			eagle = srv.newEagle(info.DeviceMacId, baseuri)
 		}
-		eagle.DeviceMAC = info.DeviceMacId
+		eagle.infoLock.Lock()
 		eagle.InstallCode = info.InstallCode
 		eagle.LinkKey = info.LinkKey
 		eagle.FWVersion = info.FWVersion
@@ -351,15 +372,15 @@ func (srv *EagleServer) HandleMessage(resp Response, baseuri string) {
 		eagle.Manufacturer = info.Manufacturer
 		eagle.ModelID = info.ModelID
 		eagle.DateCode = info.DateCode
-		srv.eagles[info.DeviceMacId] = eagle
+		eagle.infoLock.Unlock()
+		srv.eagleLock.Unlock()
 
 		if !found {
 			log.Noticef("Registering new Eagle with MAC %s", eagle.DeviceMAC)
 		}
+		srv.persist(eagle)
 
-		// TODO: send configuration struct in reply
-
-		return
+		return eagle.nextCommand()
 	}
 
 	// handle meter data
@@ -367,36 +388,37 @@ func (srv *EagleServer) HandleMessage(resp Response, baseuri string) {
 		info := resp.InstantaneousDemand
 		// update the object with the Meter MAC address
 		// but only if we've seen the Eagle before; else, drop this
-		srv.eagleLock.Lock()
-		eagle, found := srv.eagles[info.DeviceMacId]
-		srv.eagleLock.Unlock()
+		eagle, found := srv.getEagle(info.DeviceMacId, baseuri)
 		if !found {
 			log.Warning("Got Instantaneous demand for unregistered Eagle")
-			return
+			return nil
 		}
 
 		log.Infof("INST DEMAND %s", resp)
-		info.Dump()
-
-		if info.Demand.Int64() > 0xf0000000 {
-			negative_demand := HexInt64(info.Demand.Int64() - 0xffffffff)
-			info.Demand = &negative_demand
-			log.Warningf("NEGATIVE")
-		}
 
 		// adjust the timestamp with the EAGLE Epoch and get the actual kW demand as a float
-		eagle.current_time = int64(*info.TimeStamp+HexInt64(EAGLE_EPOCH)) * 1e9
-		eagle.current_demand = float64(*info.Demand) * float64(*info.Multiplier) / float64(*info.Divisor)
+		if err := info.convert(); err != nil {
+			log.Error(err)
+			return nil
+		}
+		info.Dump()
+		save := eagle.checkGap(info.ActualTimestamp)
+		eagle.current_time = info.ActualTimestamp
+		eagle.current_demand = info.ActualDemand
 		log.Warningf("Got Demand %f (%f)", eagle.current_demand, eagle.current_demand*srv.multiplier)
 		eagle.current_demand *= srv.multiplier // extra multiplier
 		eagle.current_demand *= 1000           // convert to Watts
 
-		eagle.MeterMAC = info.MeterMacId
-		srv.eagles[info.DeviceMacId] = eagle
+		if eagle.setMeterMAC(info.MeterMacId) {
+			save = true
+		}
+		if save {
+			srv.persist(eagle)
+		}
 
 		srv.forwardData(eagle)
 
-		return
+		return eagle.nextCommand()
 	}
 
 	if resp.PriceCluster != nil {
@@ -404,54 +426,83 @@ func (srv *EagleServer) HandleMessage(resp Response, baseuri string) {
 		log.Infof("PRICE CLUSTER %+v", info)
 		// if this is MAX, then we don't get price
 		if info.Price.Int64() == 0xffffffff {
-			return
+			return nil
 		}
-		srv.eagleLock.Lock()
-		eagle, found := srv.eagles[info.DeviceMacId]
-		srv.eagleLock.Unlock()
+		eagle, found := srv.getEagle(info.DeviceMacId, baseuri)
 		if !found {
 			log.Warning("Got price cluster for unregistered Eagle")
-			return
+			return nil
 		}
 		eagle.current_time = int64(*info.TimeStamp+HexInt64(EAGLE_EPOCH)) * 1e9
 		eagle.current_price = float64(*info.Price) / math.Pow(10, float64(*info.TrailingDigits))
 		eagle.current_tier = int64(*info.Tier)
-		srv.eagles[info.DeviceMacId] = eagle
 
 		srv.forwardData(eagle)
-		return
+		return eagle.nextCommand()
 	}
 
 	if resp.MessageCluster != nil {
 		log.Debugf("MessageCluster %+v", resp.MessageCluster)
-		return
+		return nil
 	}
 
 	if resp.CurrentSummationDelivered != nil {
 		// update the object with the Meter MAC address
 		// but only if we've seen the Eagle before; else, drop this
 		info := resp.CurrentSummationDelivered
-		srv.eagleLock.Lock()
-		eagle, found := srv.eagles[info.DeviceMacId]
-		srv.eagleLock.Unlock()
+		eagle, found := srv.getEagle(info.DeviceMacId, baseuri)
 		if !found {
 			log.Warning("Got price cluster for unregistered Eagle")
-			return
+			return nil
 		}
 
-		eagle.current_time = int64(*info.TimeStamp+HexInt64(EAGLE_EPOCH)) * 1e9
-		eagle.current_summation_delivered = float64(*info.SummationDelivered) * float64(*info.Multiplier) / float64(*info.Divisor)
-		eagle.current_summation_received = float64(*info.SummationReceived) * float64(*info.Multiplier) / float64(*info.Divisor)
+		if err := info.convert(); err != nil {
+			log.Error(err)
+			return nil
+		}
+		save := eagle.checkGap(info.ActualTimestamp)
+		eagle.current_time = info.ActualTimestamp
+		eagle.current_summation_delivered = info.ActualSummationDelivered
+		eagle.current_summation_received = info.ActualSummationReceived
 
-		eagle.MeterMAC = info.MeterMacId
-		srv.eagles[info.DeviceMacId] = eagle
+		if eagle.setMeterMAC(info.MeterMacId) {
+			save = true
+		}
+		if save {
+			srv.persist(eagle)
+		}
 
 		srv.forwardData(eagle)
 
-		return
+		return eagle.nextCommand()
+	}
+
+	if resp.HistoryData != nil {
+		info := resp.HistoryData
+		eagle, found := srv.getEagle(info.DeviceMacId(), baseuri)
+		if !found {
+			log.Warning("Got history data for unregistered Eagle")
+			return nil
+		}
+		log.Infof("HISTORY DATA %d summations, %d demands", len(info.summations()), len(info.InstantaneousDemand))
+		srv.forwardHistory(eagle, info)
+		return eagle.nextCommand()
+	}
+
+	if resp.FastPollStatus != nil {
+		info := resp.FastPollStatus
+		eagle, found := srv.getEagle(info.DeviceMacId, baseuri)
+		if !found {
+			log.Warning("Got fast poll status for unregistered Eagle")
+			return nil
+		}
+		log.Infof("FAST POLL STATUS %+v", info)
+		eagle.setFastPoll(info)
+		return eagle.nextCommand()
 	}
 
 	log.Warning("Got unrecognized message")
+	return nil
 }
 
 func main() {
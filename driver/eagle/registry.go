@@ -0,0 +1,187 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/xyproto/simplebolt"
+)
+
+// Name of the hash map the registry is kept in, in the BoltDB permissionbolt
+// already uses for the admin account
+const REGISTRY_BUCKET = "eagles"
+
+// What is persisted of each Eagle, so that its readings are not dropped after
+// a restart while waiting for it to resend NetworkInfo, and readings it missed
+// while the server was down are backfilled. The install code and link key are
+// left out on purpose.
+type EagleRecord struct {
+	DeviceMAC    string
+	MeterMAC     string
+	BaseURI      string
+	FWVersion    string
+	HWVersion    string
+	ImageType    string
+	Manufacturer string
+	ModelID      string
+	DateCode     string
+	// timestamp (ns) of the Eagle's latest live reading
+	LastReport int64
+}
+
+// Key the LastReport is stored under. Registries saved before it was added
+// don't have it.
+const LAST_REPORT_KEY = "last_report"
+
+// Returns the record's fields by the key they are stored under
+func (rec *EagleRecord) fields() map[string]*string {
+	return map[string]*string{
+		"meter_mac":    &rec.MeterMAC,
+		"baseuri":      &rec.BaseURI,
+		"fw_version":   &rec.FWVersion,
+		"hw_version":   &rec.HWVersion,
+		"image_type":   &rec.ImageType,
+		"manufacturer": &rec.Manufacturer,
+		"model_id":     &rec.ModelID,
+		"date_code":    &rec.DateCode,
+	}
+}
+
+// Persistent registry of Eagles, keyed by their DeviceMacId
+type Registry struct {
+	eagles *simplebolt.HashMap
+}
+
+func NewRegistry(db *simplebolt.Database) (*Registry, error) {
+	eagles, err := simplebolt.NewHashMap(db, REGISTRY_BUCKET)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not open Eagle registry")
+	}
+	return &Registry{eagles: eagles}, nil
+}
+
+// Reads every Eagle in the registry, by DeviceMacId
+func (reg *Registry) Load() (map[string]EagleRecord, error) {
+	macs, err := reg.eagles.All()
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not list registered Eagles")
+	}
+	records := make(map[string]EagleRecord)
+	for _, mac := range macs {
+		rec := EagleRecord{DeviceMAC: mac}
+		for key, value := range rec.fields() {
+			if *value, err = reg.eagles.Get(mac, key); err != nil {
+				return nil, errors.Wrapf(err, "Could not read %s of Eagle %s", key, mac)
+			}
+		}
+		if has, err := reg.eagles.Has(mac, LAST_REPORT_KEY); err != nil {
+			return nil, errors.Wrapf(err, "Could not read %s of Eagle %s", LAST_REPORT_KEY, mac)
+		} else if has {
+			value, err := reg.eagles.Get(mac, LAST_REPORT_KEY)
+			if err == nil {
+				rec.LastReport, err = strconv.ParseInt(value, 10, 64)
+			}
+			if err != nil {
+				return nil, errors.Wrapf(err, "Could not read %s of Eagle %s", LAST_REPORT_KEY, mac)
+			}
+		}
+		if rec.BaseURI == "" {
+			log.Warningf("Skipping registered Eagle %s without a base URI", mac)
+			continue
+		}
+		records[mac] = rec
+	}
+	return records, nil
+}
+
+// Adds or updates an Eagle in the registry
+func (reg *Registry) Save(rec EagleRecord) error {
+	for key, value := range rec.fields() {
+		if err := reg.eagles.Set(rec.DeviceMAC, key, *value); err != nil {
+			return errors.Wrapf(err, "Could not save %s of Eagle %s", key, rec.DeviceMAC)
+		}
+	}
+	if err := reg.eagles.Set(rec.DeviceMAC, LAST_REPORT_KEY, strconv.FormatInt(rec.LastReport, 10)); err != nil {
+		return errors.Wrapf(err, "Could not save %s of Eagle %s", LAST_REPORT_KEY, rec.DeviceMAC)
+	}
+	return nil
+}
+
+func (eagle *Eagle) record() EagleRecord {
+	eagle.commandLock.Lock()
+	last_report := eagle.last_report
+	eagle.commandLock.Unlock()
+	eagle.infoLock.Lock()
+	defer eagle.infoLock.Unlock()
+	return EagleRecord{
+		DeviceMAC:    eagle.DeviceMAC,
+		MeterMAC:     eagle.MeterMAC,
+		BaseURI:      eagle.BaseURI,
+		FWVersion:    eagle.FWVersion,
+		HWVersion:    eagle.HWVersion,
+		ImageType:    eagle.ImageType,
+		Manufacturer: eagle.Manufacturer,
+		ModelID:      eagle.ModelID,
+		DateCode:     eagle.DateCode,
+		LastReport:   last_report,
+	}
+}
+
+// Creates an Eagle reporting under baseuri and registers its interfaces. An
+// Eagle in the persistent registry picks up from its last saved reading, so
+// that the readings missed while the server was down are backfilled.
+// Called with eagleLock held.
+func (srv *EagleServer) newEagle(mac, baseuri string) *Eagle {
+	eagle := &Eagle{DeviceMAC: mac, BaseURI: baseuri}
+	if rec, known := srv.known[mac]; known {
+		eagle.last_report = rec.LastReport
+		eagle.saved_report = rec.LastReport
+	}
+	// TODO: set metadata on these uris
+	eagle.svc = srv.bwclient.RegisterService(baseuri, "s.eagle")
+	eagle.iface = eagle.svc.RegisterInterface(mac, "i.meter")
+	eagle.xbosiface = eagle.svc.RegisterInterface(mac, "i.xbos.meter")
+	eagle.cmdiface = eagle.svc.RegisterInterface(mac, "i.eagle")
+	eagle.cmdiface.SubscribeSlot("command", eagle.handleCommand)
+	srv.eagles[mac] = eagle
+	return eagle
+}
+
+// Returns the Eagle with the given DeviceMacId. An Eagle that is not
+// registered yet but is in the persistent registry under the same base URI is
+// registered from there, so that it doesn't have to resend NetworkInfo first.
+func (srv *EagleServer) getEagle(mac, baseuri string) (*Eagle, bool) {
+	srv.eagleLock.Lock()
+	defer srv.eagleLock.Unlock()
+	if eagle, found := srv.eagles[mac]; found {
+		return eagle, true
+	}
+	rec, known := srv.known[mac]
+	if !known || rec.BaseURI != baseuri {
+		return nil, false
+	}
+	eagle := srv.newEagle(mac, baseuri)
+	eagle.infoLock.Lock()
+	eagle.MeterMAC = rec.MeterMAC
+	eagle.FWVersion = rec.FWVersion
+	eagle.HWVersion = rec.HWVersion
+	eagle.ImageType = rec.ImageType
+	eagle.Manufacturer = rec.Manufacturer
+	eagle.ModelID = rec.ModelID
+	eagle.DateCode = rec.DateCode
+	eagle.infoLock.Unlock()
+	log.Noticef("Registering known Eagle with MAC %s from the registry", mac)
+	return eagle, true
+}
+
+// Saves the Eagle to the persistent registry
+func (srv *EagleServer) persist(eagle *Eagle) {
+	rec := eagle.record()
+	if err := srv.registry.Save(rec); err != nil {
+		log.Error(err)
+		return
+	}
+	srv.eagleLock.Lock()
+	srv.known[rec.DeviceMAC] = rec
+	srv.eagleLock.Unlock()
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/xyproto/simplebolt"
+)
+
+func TestRegistry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eagle-registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "bolt.db")
+
+	saved := []EagleRecord{
+		{
+			DeviceMAC:    "0xd8d5b9000000103f",
+			MeterMAC:     "0x00178d0000000004",
+			BaseURI:      "scratch.ns/eagle/home",
+			FWVersion:    "1.4.47 (6798)",
+			HWVersion:    "1.2.3",
+			ImageType:    "0x1301",
+			Manufacturer: "Rainforest Automation, Inc.",
+			ModelID:      "Z109-EAGLE",
+			DateCode:     "2013103023220630",
+			LastReport:   eagleTime(0x1c0bd3a0),
+		},
+		// Reported readings before NetworkInfo, so only its base URI is known
+		{DeviceMAC: "0xd8d5b90000001040", BaseURI: "scratch.ns/eagle/office"},
+		// Without a base URI it can't be registered, so it is skipped
+		{DeviceMAC: "0xd8d5b90000001041", MeterMAC: "0x00178d0000000005"},
+	}
+
+	db, err := simplebolt.New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry, err := NewRegistry(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range saved {
+		if err := registry.Save(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Saving again updates the record
+	saved[1].MeterMAC = "0x00178d0000000006"
+	if err := registry.Save(saved[1]); err != nil {
+		t.Fatal(err)
+	}
+	// Saved before the last report was, so it has none
+	legacy := EagleRecord{DeviceMAC: "0xd8d5b90000001042", BaseURI: "scratch.ns/eagle/garage"}
+	for key, value := range legacy.fields() {
+		if err := registry.eagles.Set(legacy.DeviceMAC, key, *value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	saved = append(saved, legacy)
+	db.Close()
+
+	db, err = simplebolt.New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	registry, err = NewRegistry(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := registry.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded) != 3 {
+		t.Errorf("Loaded %d Eagles, want 3", len(loaded))
+	}
+	for _, rec := range saved {
+		if rec.BaseURI == "" {
+			continue
+		}
+		if loaded[rec.DeviceMAC] != rec {
+			t.Errorf("Loaded %+v, want %+v", loaded[rec.DeviceMAC], rec)
+		}
+	}
+}
+
+// Saving an Eagle mustn't race with its readings updating it
+func TestRecordWhileReporting(t *testing.T) {
+	eagle := &Eagle{DeviceMAC: "0xd8d5b9000000103f", BaseURI: "scratch.ns/eagle/home"}
+	done := make(chan bool)
+	go func() {
+		for i := int64(1); i <= 100; i++ {
+			eagle.setMeterMAC(fmt.Sprintf("0x00178d%010x", i))
+			eagle.checkGap(eagleTime(0x1c0bd3a0 + i))
+		}
+		close(done)
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		eagle.record()
+	}
+	if rec := eagle.record(); rec.MeterMAC != "0x00178d0000000064" || rec.LastReport != eagleTime(0x1c0bd3a0+100) {
+		t.Errorf("Recorded %+v, want the last meter MAC and report", rec)
+	}
+}
@@ -0,0 +1,153 @@
+package fakecloud
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AJAX Resource Listing Structs
+type resourcesResponse struct {
+	Resources []resourceGroup `json:"resources"`
+}
+
+type resourceGroup struct {
+	Children    []resourceChild `json:"children"`
+	GroupId     string          `json:"groupId"`
+	Permissions string          `json:"permissions"`
+}
+
+type resourceChild struct {
+	Id          string `json:"id"`
+	Name        string `json:"name"`
+	Permissions string `json:"permissions"`
+}
+
+// AJAX Thermostat Settings Structs
+type settingsResponse struct {
+	Epnum    float64      `json:"epnum"`
+	Id       string       `json:"id"`
+	Nodename string       `json:"nodename"`
+	Userdata settingsData `json:"userdata"`
+}
+
+type settingsData struct {
+	Epnum    float64 `json:"epnum"`
+	Fan      string  `json:"fan"`
+	Nodename string  `json:"nodename"`
+	Repeat   string  `json:"repeat"`
+}
+
+// thermDayEdit.cgi Structs
+type dayScheduleResponse struct {
+	ClientData dayScheduleSetTimes `json:"clientdata"`
+}
+
+type dayScheduleSetTimes struct {
+	SetTimes []daySetTime `json:"setTimes"`
+}
+
+type daySetTime struct {
+	HeatSetting float64 `json:"heatSetting"`
+	CoolSetting float64 `json:"coolSetting"`
+	StartValue  string  `json:"startValue"`
+	System      string  `json:"systemDisplay"`
+}
+
+const scheduleEpnum = 1
+
+func writeJSON(rw http.ResponseWriter, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(v); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (srv *Server) handleResources(rw http.ResponseWriter, req *http.Request) {
+	if !srv.authorized(req) {
+		http.Error(rw, "Session expired", http.StatusUnauthorized)
+		return
+	}
+	if req.URL.Query().Get("request") != "getResourcesExtended" {
+		http.Error(rw, "Unsupported request", http.StatusBadRequest)
+		return
+	}
+
+	srv.mu.Lock()
+	group := resourceGroup{GroupId: "1", Permissions: "rw"}
+	for _, tstat := range srv.thermostats {
+		group.Children = append(group.Children, resourceChild{Id: tstat.ID, Name: tstat.Name, Permissions: "rw"})
+	}
+	srv.mu.Unlock()
+	writeJSON(rw, resourcesResponse{Resources: []resourceGroup{group}})
+}
+
+func (srv *Server) handleThermostatSettings(rw http.ResponseWriter, req *http.Request) {
+	if !srv.authorized(req) {
+		http.Error(rw, "Session expired", http.StatusUnauthorized)
+		return
+	}
+	query := req.URL.Query()
+	if query.Get("request") != "GetSchedule" {
+		http.Error(rw, "Unsupported request", http.StatusBadRequest)
+		return
+	}
+
+	id := strings.TrimSuffix(query.Get("id"), ":Thermostat")
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	tstat := srv.findByID(id)
+	if tstat == nil {
+		http.Error(rw, "Unknown thermostat", http.StatusNotFound)
+		return
+	}
+	writeJSON(rw, settingsResponse{
+		Epnum:    scheduleEpnum,
+		Id:       tstat.ID,
+		Nodename: tstat.ID,
+		Userdata: settingsData{
+			Epnum:    scheduleEpnum,
+			Fan:      tstat.Fan,
+			Nodename: tstat.ID,
+			Repeat:   tstat.Repeat,
+		},
+	})
+}
+
+func (srv *Server) handleDaySchedule(rw http.ResponseWriter, req *http.Request) {
+	if !srv.authorized(req) {
+		http.Error(rw, "Session expired", http.StatusUnauthorized)
+		return
+	}
+	query := req.URL.Query()
+	day, err := strconv.Atoi(query.Get("dayofweek"))
+	if err != nil || day < 0 || day >= len(week) {
+		http.Error(rw, "Invalid dayofweek", http.StatusBadRequest)
+		return
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	tstat := srv.findByID(query.Get("nodename"))
+	if tstat == nil {
+		http.Error(rw, "Unknown thermostat", http.StatusNotFound)
+		return
+	}
+	var resp dayScheduleResponse
+	for _, block := range tstat.Schedules[day] {
+		start, err := time.Parse("15:04", block.Start)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		resp.ClientData.SetTimes = append(resp.ClientData.SetTimes, daySetTime{
+			HeatSetting: float64(block.HeatSetting),
+			CoolSetting: float64(block.CoolSetting),
+			StartValue:  start.Format("03:04:PM"),
+			System:      block.System,
+		})
+	}
+	writeJSON(rw, resp)
+}
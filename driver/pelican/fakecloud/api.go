@@ -0,0 +1,437 @@
+package fakecloud
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// api.cgi Result Structs
+type apiResult struct {
+	XMLName     xml.Name        `xml:"result"`
+	Success     int             `xml:"success"`
+	Message     string          `xml:"message,omitempty"`
+	Attribute   *apiSite        `xml:"attribute"`
+	Thermostats []apiThermostat `xml:"Thermostat"`
+	History     []apiHistory    `xml:"ThermostatHistory"`
+}
+
+type apiSite struct {
+	Timezone  string `xml:"timeZone"`
+	Units     string `xml:"temperatureUnits"`
+	ADREnd    string `xml:"OpenADREventEnd"`
+	ADRStart  string `xml:"OpenADREventStart"`
+	ADRStatus string `xml:"OpenADRStatus"`
+	ADRType   string `xml:"OpenADREventType"`
+	ADRID     string `xml:"OpenADREventId"`
+	ADRLevel  int    `xml:"OpenADRSignalLevel"`
+	ADROptOut string `xml:"OpenADROptOut"`
+}
+
+type apiThermostat struct {
+	Name          string  `xml:"name"`
+	Temperature   float64 `xml:"temperature"`
+	Humidity      int     `xml:"humidity"`
+	HeatSetting   float64 `xml:"heatSetting"`
+	CoolSetting   float64 `xml:"coolSetting"`
+	SetBy         string  `xml:"setBy"`
+	Schedule      string  `xml:"schedule"`
+	HeatNeedsFan  string  `xml:"HeatNeedsFan"`
+	System        string  `xml:"system"`
+	Fan           string  `xml:"fan"`
+	RunStatus     string  `xml:"runStatus"`
+	StatusDisplay string  `xml:"statusDisplay"`
+	HeatStages    int     `xml:"heatStages"`
+	CoolStages    int     `xml:"coolStages"`
+	Slaves        []Slave `xml:"slaves"`
+}
+
+type apiHistory struct {
+	Name    string             `xml:"name"`
+	History []apiHistoryRecord `xml:"History"`
+}
+
+type apiHistoryRecord struct {
+	Timestamp   string   `xml:"timestamp"`
+	Temperature *float64 `xml:"temperature,omitempty"`
+	Humidity    *int     `xml:"humidity,omitempty"`
+	HeatSetting *float64 `xml:"heatSetting,omitempty"`
+	CoolSetting *float64 `xml:"coolSetting,omitempty"`
+	System      string   `xml:"system,omitempty"`
+	RunStatus   string   `xml:"runStatus,omitempty"`
+}
+
+const apiTimeFormat = "2006-01-02T15:04"
+
+func (srv *Server) handleAPI(rw http.ResponseWriter, req *http.Request) {
+	// The driver posts its requests as a form, but the API also accepts a query string
+	if err := req.ParseForm(); err != nil {
+		writeResult(rw, &apiResult{Message: err.Error()})
+		return
+	}
+	query := req.Form
+	if query.Get("username") != srv.username || query.Get("password") != srv.password {
+		writeResult(rw, &apiResult{Message: "Invalid username or password"})
+		return
+	}
+
+	selection := parseAttributes(query.Get("selection"))
+	value := query.Get("value")
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	var result *apiResult
+	var err error
+	request := query.Get("request")
+	switch object := strings.ToLower(query.Get("object")); {
+	case request == "get" && object == "site":
+		result = srv.getSite()
+	case request == "set" && object == "site":
+		result, err = srv.setSite(parseAttributes(value))
+	case request == "get" && object == "thermostat":
+		result, err = srv.getThermostats(selection)
+	case request == "set" && object == "thermostat":
+		result, err = srv.setThermostats(selection, parseAttributes(value))
+	case request == "get" && object == "thermostathistory":
+		result, err = srv.getHistory(selection, value)
+	case request == "set" && object == "thermostatschedule" && selection["dayOfWeek"] == "":
+		result, err = srv.setScheduleRepeat(selection, parseAttributes(value))
+	case request == "set" && object == "thermostatschedule":
+		result, err = srv.setScheduleBlock(selection, value)
+	default:
+		err = fmt.Errorf("Unsupported request %s on object %s", request, query.Get("object"))
+	}
+	if err != nil {
+		writeResult(rw, &apiResult{Message: err.Error()})
+		return
+	}
+	result.Success = 1
+	writeResult(rw, result)
+}
+
+func writeResult(rw http.ResponseWriter, result *apiResult) {
+	rw.Header().Set("Content-Type", "text/xml")
+	out, err := xml.Marshal(result)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rw.Write([]byte(xml.Header))
+	rw.Write(out)
+}
+
+// Parses the "key:value;key:value;" encoding used by selection and value
+func parseAttributes(encoded string) map[string]string {
+	attributes := make(map[string]string)
+	for _, pair := range strings.Split(encoded, ";") {
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, ":", 2)
+		if len(kv) == 1 {
+			attributes[kv[0]] = ""
+		} else {
+			attributes[kv[0]] = kv[1]
+		}
+	}
+	return attributes
+}
+
+func (srv *Server) setSite(values map[string]string) (*apiResult, error) {
+	for key, val := range values {
+		if key != "OpenADROptOut" {
+			return nil, fmt.Errorf("Unknown site attribute %s", key)
+		}
+		if val != "Yes" && val != "No" {
+			return nil, fmt.Errorf("Invalid value %q for %s", val, key)
+		}
+		srv.drEvent.OptOut = val == "Yes"
+	}
+	return &apiResult{}, nil
+}
+
+// Callers must hold srv.mu
+func (srv *Server) selectThermostats(selection map[string]string) []*Thermostat {
+	name, ok := selection["name"]
+	if !ok {
+		return srv.thermostats
+	}
+	if tstat := srv.findByName(name); tstat != nil {
+		return []*Thermostat{tstat}
+	}
+	return nil
+}
+
+func (srv *Server) getSite() *apiResult {
+	site := &apiSite{
+		Timezone:  srv.timezone.String(),
+		Units:     srv.units,
+		ADRStatus: srv.drEvent.Status,
+		ADRType:   srv.drEvent.Type,
+		ADRID:     srv.drEvent.ID,
+		ADRLevel:  srv.drEvent.SignalLevel,
+		ADROptOut: "No",
+	}
+	if srv.drEvent.OptOut {
+		site.ADROptOut = "Yes"
+	}
+	if !srv.drEvent.Start.IsZero() {
+		site.ADRStart = srv.drEvent.Start.In(srv.timezone).Format(apiTimeFormat)
+	}
+	if !srv.drEvent.End.IsZero() {
+		site.ADREnd = srv.drEvent.End.In(srv.timezone).Format(apiTimeFormat)
+	}
+	return &apiResult{Attribute: site}
+}
+
+func (srv *Server) getThermostats(selection map[string]string) (*apiResult, error) {
+	selected := srv.selectThermostats(selection)
+	if _, named := selection["name"]; named && len(selected) == 0 {
+		return nil, fmt.Errorf("No thermostat matches selection")
+	}
+	result := &apiResult{}
+	for _, tstat := range selected {
+		result.Thermostats = append(result.Thermostats, apiThermostat{
+			Name:          tstat.Name,
+			Temperature:   tstat.Temperature,
+			Humidity:      tstat.Humidity,
+			HeatSetting:   tstat.HeatSetting,
+			CoolSetting:   tstat.CoolSetting,
+			SetBy:         tstat.SetBy,
+			Schedule:      tstat.Schedule,
+			HeatNeedsFan:  tstat.HeatNeedsFan,
+			System:        tstat.System,
+			Fan:           tstat.Fan,
+			RunStatus:     tstat.RunStatus,
+			StatusDisplay: tstat.StatusDisplay,
+			HeatStages:    tstat.HeatStages,
+			CoolStages:    tstat.CoolStages,
+			Slaves:        tstat.Slaves,
+		})
+	}
+	return result, nil
+}
+
+func (srv *Server) setThermostats(selection, values map[string]string) (*apiResult, error) {
+	selected := srv.selectThermostats(selection)
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("No thermostat matches selection")
+	}
+	// Validate against copies first so a bad attribute leaves no partial write
+	updated := make([]Thermostat, len(selected))
+	for i, tstat := range selected {
+		updated[i] = *tstat
+		for key, val := range values {
+			if err := applyThermostatSetting(&updated[i], key, val); err != nil {
+				return nil, err
+			}
+		}
+		updated[i].SetBy = "API"
+	}
+	for i, tstat := range selected {
+		*tstat = updated[i]
+	}
+	return &apiResult{}, nil
+}
+
+func applyThermostatSetting(tstat *Thermostat, key, val string) error {
+	switch key {
+	case "heatSetting", "coolSetting":
+		temp, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			return fmt.Errorf("Invalid value %q for %s", val, key)
+		}
+		if key == "heatSetting" {
+			tstat.HeatSetting = temp
+		} else {
+			tstat.CoolSetting = temp
+		}
+	case "heatStages", "coolStages":
+		num, err := strconv.Atoi(val)
+		if err != nil || num < 1 || num > 2 {
+			return fmt.Errorf("Invalid value %q for %s", val, key)
+		}
+		if key == "heatStages" {
+			tstat.HeatStages = num
+		} else {
+			tstat.CoolStages = num
+		}
+	case "system":
+		if val != "Off" && val != "Heat" && val != "Cool" && val != "Auto" {
+			return fmt.Errorf("Invalid value %q for %s", val, key)
+		}
+		tstat.System = val
+	case "schedule":
+		if val != "On" && val != "Off" {
+			return fmt.Errorf("Invalid value %q for %s", val, key)
+		}
+		tstat.Schedule = val
+	case "fan":
+		if val != "On" && val != "Auto" {
+			return fmt.Errorf("Invalid value %q for %s", val, key)
+		}
+		tstat.Fan = val
+	default:
+		return fmt.Errorf("Unknown thermostat attribute %s", key)
+	}
+	return nil
+}
+
+func (srv *Server) getHistory(selection map[string]string, value string) (*apiResult, error) {
+	requested := make(map[string]bool)
+	for _, attr := range strings.Split(value, ";") {
+		switch attr {
+		case "":
+		case "timestamp", "temperature", "humidity", "heatSetting", "coolSetting", "system", "runStatus":
+			requested[attr] = true
+		default:
+			return nil, fmt.Errorf("Unknown history attribute %s", attr)
+		}
+	}
+
+	start, err := time.Parse(time.RFC3339, selection["startDateTime"])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid startDateTime: %v", err)
+	}
+	end, err := time.Parse(time.RFC3339, selection["endDateTime"])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid endDateTime: %v", err)
+	}
+
+	result := &apiResult{}
+	for _, tstat := range srv.selectThermostats(selection) {
+		history := apiHistory{Name: tstat.Name}
+		for _, record := range tstat.History {
+			if record.Timestamp.Before(start) || record.Timestamp.After(end) {
+				continue
+			}
+			record := record
+			apiRecord := apiHistoryRecord{
+				Timestamp: record.Timestamp.In(srv.timezone).Format(apiTimeFormat),
+			}
+			if requested["temperature"] {
+				apiRecord.Temperature = &record.Temperature
+			}
+			if requested["humidity"] {
+				apiRecord.Humidity = &record.Humidity
+			}
+			if requested["heatSetting"] {
+				apiRecord.HeatSetting = &record.HeatSetting
+			}
+			if requested["coolSetting"] {
+				apiRecord.CoolSetting = &record.CoolSetting
+			}
+			if requested["system"] {
+				apiRecord.System = record.System
+			}
+			if requested["runStatus"] {
+				apiRecord.RunStatus = record.RunStatus
+			}
+			history.History = append(history.History, apiRecord)
+		}
+		result.History = append(result.History, history)
+	}
+	return result, nil
+}
+
+func (srv *Server) setScheduleRepeat(selection, values map[string]string) (*apiResult, error) {
+	tstat := srv.findByName(selection["name"])
+	if tstat == nil {
+		return nil, fmt.Errorf("No thermostat matches selection")
+	}
+	for key, val := range values {
+		if key != "repeat" {
+			return nil, fmt.Errorf("Unknown schedule attribute %s", key)
+		}
+		if val != "Daily" && val != "Weekly" && val != "Weekday/Weekend" {
+			return nil, fmt.Errorf("Invalid value %q for %s", val, key)
+		}
+		tstat.Repeat = val
+	}
+	return &apiResult{}, nil
+}
+
+func (srv *Server) setScheduleBlock(selection map[string]string, value string) (*apiResult, error) {
+	tstat := srv.findByName(selection["name"])
+	if tstat == nil {
+		return nil, fmt.Errorf("No thermostat matches selection")
+	}
+	day := -1
+	for i, name := range week {
+		if name == selection["dayOfWeek"] {
+			day = i
+		}
+	}
+	if day < 0 {
+		return nil, fmt.Errorf("Invalid dayOfWeek %q", selection["dayOfWeek"])
+	}
+	setTime, err := strconv.Atoi(selection["setTime"])
+	blocks := tstat.Schedules[day]
+	if err != nil || setTime < 1 || setTime > len(blocks)+1 {
+		return nil, fmt.Errorf("Invalid setTime %q", selection["setTime"])
+	}
+
+	if value == "delete" {
+		if setTime > len(blocks) {
+			return nil, fmt.Errorf("No set time %d on %s", setTime, week[day])
+		}
+		tstat.Schedules[day] = append(blocks[:setTime-1:setTime-1], blocks[setTime:]...)
+		return &apiResult{}, nil
+	}
+
+	var block ScheduleBlock
+	if setTime <= len(blocks) {
+		block = blocks[setTime-1]
+	}
+	for key, val := range parseAttributes(value) {
+		switch key {
+		case "heatSetting", "coolSetting":
+			num, err := strconv.ParseFloat(val, 64)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid value %q for %s", val, key)
+			}
+			if key == "heatSetting" {
+				block.HeatSetting = num
+			} else {
+				block.CoolSetting = num
+			}
+		case "system":
+			if val != "Off" && val != "Heat" && val != "Cool" && val != "Auto" {
+				return nil, fmt.Errorf("Invalid value %q for %s", val, key)
+			}
+			block.System = val
+		case "startTime":
+			start, err := parseStartTime(val)
+			if err != nil {
+				return nil, err
+			}
+			block.Start = start
+		default:
+			return nil, fmt.Errorf("Unknown schedule attribute %s", key)
+		}
+	}
+	if block.Start == "" {
+		return nil, fmt.Errorf("Set time %d on %s has no startTime", setTime, week[day])
+	}
+
+	if setTime > len(blocks) {
+		tstat.Schedules[day] = append(blocks, block)
+	} else {
+		blocks[setTime-1] = block
+	}
+	return &apiResult{}, nil
+}
+
+// Normalizes the start times the API accepts to 24-hour "15:04"
+func parseStartTime(val string) (string, error) {
+	for _, layout := range []string{"15:04", "3:04PM", "03:04PM", "03:04:PM", "3:04 PM"} {
+		if t, err := time.Parse(layout, val); err == nil {
+			return t.Format("15:04"), nil
+		}
+	}
+	return "", fmt.Errorf("Invalid startTime %q", val)
+}
@@ -0,0 +1,321 @@
+// Package fakecloud implements an in-memory stand-in for a Pelican site's web
+// API (<site>.officeclimatecontrol.net). It serves the XML api.cgi object API
+// as well as the cookie-authenticated AJAX endpoints used for schedules, so the
+// types package can be exercised end to end without touching real thermostats:
+//
+//	cloud := fakecloud.New("user", "pass", "site", "America/Los_Angeles")
+//	defer cloud.Close()
+//	cloud.AddThermostat(fakecloud.Thermostat{Name: "Office"})
+//	pelicans, err := types.DiscoverPelicans("user", "pass", "site", cloud.URL())
+package fakecloud
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+)
+
+const sessionCookieName = "PelicanSession"
+
+var week = [...]string{"Sunday", "Monday", "Tuesday", "Wednesday", "Thursday", "Friday", "Saturday"}
+
+// Thermostat is the simulated state of a single Pelican thermostat. String
+// fields use the same vocabulary as the Pelican API (e.g. System "Heat",
+// Schedule "On", RunStatus "Cool-Stage1"). Temperatures are in the site's
+// configured units.
+type Thermostat struct {
+	ID            string
+	Name          string
+	Temperature   float64
+	Humidity      int
+	HeatSetting   float64
+	CoolSetting   float64
+	SetBy         string
+	Schedule      string
+	System        string
+	Fan           string
+	HeatNeedsFan  string
+	RunStatus     string
+	StatusDisplay string
+	HeatStages    int
+	CoolStages    int
+	Slaves        []Slave
+	// Schedule repeat type: "Weekly", "Daily" or "Weekday/Weekend"
+	Repeat string
+	// Schedule blocks indexed by day of week, Sunday = 0
+	Schedules [7][]ScheduleBlock
+	History   []HistoryRecord
+}
+
+// Slave is a sensor attached to a thermostat.
+type Slave struct {
+	Name  string `xml:"name"`
+	Type  string `xml:"type"`
+	Value string `xml:"value"`
+}
+
+// ScheduleBlock is one set time within a day's schedule. Start is a 24-hour
+// "15:04" time of day.
+type ScheduleBlock struct {
+	Start       string
+	HeatSetting float64
+	CoolSetting float64
+	System      string
+}
+
+// HistoryRecord is a single ThermostatHistory sample. Temperatures are in the
+// site's temperature units.
+type HistoryRecord struct {
+	Timestamp   time.Time
+	Temperature float64
+	Humidity    int
+	HeatSetting float64
+	CoolSetting float64
+	System      string
+	RunStatus   string
+}
+
+// DREvent is the site-wide OpenADR state reported by the Site object.
+type DREvent struct {
+	ID          string
+	Start       time.Time
+	End         time.Time
+	Status      string
+	Type        string
+	SignalLevel int
+	// Set by the site's opt-out command as well
+	OptOut bool
+}
+
+// Server is a running fake Pelican site.
+type Server struct {
+	username string
+	password string
+	sitename string
+	timezone *time.Location
+	http     *httptest.Server
+
+	mu          sync.Mutex
+	thermostats []*Thermostat
+	drEvent     DREvent
+	units       string
+	sessions    map[string]bool
+	nextID      int
+	requests    int
+}
+
+// New starts a fake Pelican site on a loopback port. It accepts only the given
+// credentials and reports timezone (an IANA name) as the site's time zone.
+func New(username, password, sitename, timezone string) *Server {
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		panic(fmt.Sprintf("Invalid timezone %s: %v", timezone, err))
+	}
+	srv := &Server{
+		username: username,
+		password: password,
+		sitename: sitename,
+		timezone: loc,
+		drEvent:  DREvent{Status: "Inactive", Type: "None"},
+		sessions: make(map[string]bool),
+		nextID:   1000,
+		units:    "Fahrenheit",
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", srv.handleLogin)
+	mux.HandleFunc("/api.cgi", srv.handleAPI)
+	mux.HandleFunc("/ajaxSchedule.cgi", srv.handleResources)
+	mux.HandleFunc("/ajaxThermostat.cgi", srv.handleThermostatSettings)
+	mux.HandleFunc("/thermDayEdit.cgi", srv.handleDaySchedule)
+	srv.http = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		srv.mu.Lock()
+		srv.requests++
+		srv.mu.Unlock()
+		mux.ServeHTTP(rw, req)
+	}))
+	return srv
+}
+
+// URL is the base URL to hand to types.NewPelicanParams.BaseURL and
+// types.DiscoverPelicans.
+func (srv *Server) URL() string {
+	return srv.http.URL
+}
+
+func (srv *Server) Close() {
+	srv.http.Close()
+}
+
+// AddThermostat registers a new thermostat with the site. Unset fields are
+// given the defaults of an idle, scheduled, single-stage thermostat.
+func (srv *Server) AddThermostat(tstat Thermostat) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if tstat.ID == "" {
+		tstat.ID = fmt.Sprintf("%d", srv.nextID)
+		srv.nextID++
+	}
+	if tstat.Schedule == "" {
+		tstat.Schedule = "On"
+	}
+	if tstat.System == "" {
+		tstat.System = "Auto"
+	}
+	if tstat.Fan == "" {
+		tstat.Fan = "Auto"
+	}
+	if tstat.HeatNeedsFan == "" {
+		tstat.HeatNeedsFan = "No"
+	}
+	if tstat.RunStatus == "" {
+		tstat.RunStatus = "Off"
+	}
+	if tstat.StatusDisplay == "" {
+		tstat.StatusDisplay = "Normal"
+	}
+	if tstat.HeatStages == 0 {
+		tstat.HeatStages = 1
+	}
+	if tstat.CoolStages == 0 {
+		tstat.CoolStages = 1
+	}
+	if tstat.Repeat == "" {
+		tstat.Repeat = "Weekly"
+	}
+	srv.thermostats = append(srv.thermostats, &tstat)
+}
+
+// RemoveThermostat deletes a thermostat from the site, reporting whether it
+// existed.
+func (srv *Server) RemoveThermostat(name string) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for i, tstat := range srv.thermostats {
+		if tstat.Name == name {
+			srv.thermostats = append(srv.thermostats[:i], srv.thermostats[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Thermostat returns a snapshot of the named thermostat's state.
+func (srv *Server) Thermostat(name string) (Thermostat, bool) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	tstat := srv.findByName(name)
+	if tstat == nil {
+		return Thermostat{}, false
+	}
+	return *tstat, true
+}
+
+// UpdateThermostat applies fn to the named thermostat's state under the
+// server's lock, e.g. to simulate a temperature change or a call for heat.
+func (srv *Server) UpdateThermostat(name string, fn func(*Thermostat)) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	tstat := srv.findByName(name)
+	if tstat == nil {
+		return false
+	}
+	fn(tstat)
+	return true
+}
+
+// SetDREvent replaces the site's OpenADR event state.
+func (srv *Server) SetDREvent(event DREvent) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.drEvent = event
+}
+
+// DREvent returns the site's current OpenADR event state.
+func (srv *Server) DREvent() DREvent {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.drEvent
+}
+
+// SetTemperatureUnits changes the unit the site reports, "Fahrenheit" or
+// "Celsius". Thermostat temperatures are not converted.
+func (srv *Server) SetTemperatureUnits(units string) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.units = units
+}
+
+// ExpireSessions invalidates every login cookie handed out so far.
+func (srv *Server) ExpireSessions() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.sessions = make(map[string]bool)
+}
+
+// RequestCount is the number of HTTP requests the site has served, for
+// checking how much API load a driver operation generates.
+func (srv *Server) RequestCount() int {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.requests
+}
+
+// Callers must hold srv.mu
+func (srv *Server) findByName(name string) *Thermostat {
+	for _, tstat := range srv.thermostats {
+		if tstat.Name == name {
+			return tstat
+		}
+	}
+	return nil
+}
+
+// Callers must hold srv.mu
+func (srv *Server) findByID(id string) *Thermostat {
+	for _, tstat := range srv.thermostats {
+		if tstat.ID == id {
+			return tstat
+		}
+	}
+	return nil
+}
+
+// The site's login form. The driver posts to /#_loginPage, which arrives here
+// as a POST to / once the fragment is dropped.
+func (srv *Server) handleLogin(rw http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/" || req.Method != http.MethodPost {
+		http.NotFound(rw, req)
+		return
+	}
+	if err := req.ParseForm(); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Form.Get("username") != srv.username || req.Form.Get("password") != srv.password ||
+		req.Form.Get("sitename") != srv.sitename {
+		http.Error(rw, "Invalid login", http.StatusUnauthorized)
+		return
+	}
+
+	session := fmt.Sprintf("%016x", rand.Int63())
+	srv.mu.Lock()
+	srv.sessions[session] = true
+	srv.mu.Unlock()
+	http.SetCookie(rw, &http.Cookie{Name: sessionCookieName, Value: session, Path: "/"})
+	rw.Write([]byte("OK"))
+}
+
+func (srv *Server) authorized(req *http.Request) bool {
+	cookie, err := req.Cookie(sessionCookieName)
+	if err != nil {
+		return false
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.sessions[cookie.Value]
+}
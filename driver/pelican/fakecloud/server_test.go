@@ -0,0 +1,108 @@
+package fakecloud
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+// Logs in and returns the session cookie
+func login(t *testing.T, srv *Server, password string) *http.Cookie {
+	t.Helper()
+	resp, err := http.PostForm(srv.URL()+"/", url.Values{
+		"username": {"user"},
+		"password": {password},
+		"sitename": {"site"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil
+	}
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == sessionCookieName {
+			return cookie
+		}
+	}
+	t.Fatal("Login returned no session cookie")
+	return nil
+}
+
+// Requests the thermostat list with the cookie and returns the status code
+func resources(t *testing.T, srv *Server, cookie *http.Cookie) int {
+	t.Helper()
+	req, err := http.NewRequest("GET", srv.URL()+"/ajaxSchedule.cgi?request=getResourcesExtended&resourceType=Thermostats", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestSessions(t *testing.T) {
+	srv := New("user", "pass", "site", "UTC")
+	defer srv.Close()
+
+	if cookie := login(t, srv, "wrong"); cookie != nil {
+		t.Errorf("Logged in with the wrong password as %v", cookie)
+	}
+	if code := resources(t, srv, nil); code != http.StatusUnauthorized {
+		t.Errorf("Request without a session returned %d, want %d", code, http.StatusUnauthorized)
+	}
+
+	cookie := login(t, srv, "pass")
+	if code := resources(t, srv, cookie); code != http.StatusOK {
+		t.Errorf("Request with a session returned %d, want %d", code, http.StatusOK)
+	}
+	srv.ExpireSessions()
+	if code := resources(t, srv, cookie); code != http.StatusUnauthorized {
+		t.Errorf("Request with an expired session returned %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code := resources(t, srv, login(t, srv, "pass")); code != http.StatusOK {
+		t.Errorf("Request after logging in again returned %d, want %d", code, http.StatusOK)
+	}
+}
+
+func TestRequestCount(t *testing.T) {
+	srv := New("user", "pass", "site", "UTC")
+	defer srv.Close()
+	srv.AddThermostat(Thermostat{Name: "Office"})
+
+	before := srv.RequestCount()
+	cookie := login(t, srv, "pass")
+	resources(t, srv, cookie)
+	resources(t, srv, nil)
+	if n := srv.RequestCount() - before; n != 3 {
+		t.Errorf("Counted %d requests, want 3", n)
+	}
+}
+
+func TestThermostatDefaults(t *testing.T) {
+	srv := New("user", "pass", "site", "UTC")
+	defer srv.Close()
+	srv.AddThermostat(Thermostat{Name: "Office"})
+	srv.AddThermostat(Thermostat{Name: "Lobby"})
+
+	office, ok := srv.Thermostat("Office")
+	if !ok || office.ID == "" || office.System != "Auto" || office.Schedule != "On" || office.HeatStages != 1 || office.Repeat != "Weekly" {
+		t.Errorf("Office is %+v, want an idle, scheduled, single-stage thermostat", office)
+	}
+	if lobby, _ := srv.Thermostat("Lobby"); lobby.ID == office.ID {
+		t.Errorf("Office and Lobby share ID %s", office.ID)
+	}
+	if !srv.RemoveThermostat("Office") || srv.RemoveThermostat("Office") {
+		t.Error("Office was not removed exactly once")
+	}
+	if _, ok := srv.Thermostat("Office"); ok {
+		t.Error("Office is still there after being removed")
+	}
+}
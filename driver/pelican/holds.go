@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// How long to wait before retrying a failed return to schedule
+const holdRetryInterval = time.Minute
+
+// Remembers when each thermostat's timed hold ends, keyed by thermostat ID,
+// so that holds still end on time if the driver restarts in the meantime.
+// Holds are only kept in memory when no path is given.
+type holdStore struct {
+	path string
+
+	lock  sync.Mutex
+	holds map[string]time.Time
+}
+
+func loadHolds(path string) (*holdStore, error) {
+	store := &holdStore{path: path, holds: make(map[string]time.Time)}
+	if path == "" {
+		return store, nil
+	}
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Failed to read %s: %v", path, err)
+	}
+	if err := json.Unmarshal(contents, &store.holds); err != nil {
+		return nil, fmt.Errorf("Failed to deserialize holds from %s: %v", path, err)
+	}
+	return store, nil
+}
+
+// When the thermostat's hold ends, if it has one
+func (store *holdStore) get(id string) (time.Time, bool) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	expires, ok := store.holds[id]
+	return expires, ok
+}
+
+func (store *holdStore) set(id string, expires time.Time) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.holds[id] = expires
+	return store.save()
+}
+
+func (store *holdStore) clear(id string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if _, ok := store.holds[id]; !ok {
+		return nil
+	}
+	delete(store.holds, id)
+	return store.save()
+}
+
+// Callers must hold store.lock
+func (store *holdStore) save() error {
+	if store.path == "" {
+		return nil
+	}
+	contents, err := json.MarshalIndent(store.holds, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Failed to serialize holds: %v", err)
+	}
+	// Write to a temporary file first so a crash never leaves a truncated file
+	tmpPath := store.path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, contents, 0644); err != nil {
+		return fmt.Errorf("Failed to write %s: %v", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, store.path); err != nil {
+		return fmt.Errorf("Failed to replace %s: %v", store.path, err)
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/SoftwareDefinedBuildings/bw2-contrib/driver/pelican/fakecloud"
+	"github.com/SoftwareDefinedBuildings/bw2-contrib/driver/pelican/types"
+)
+
+func TestHoldStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "holds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "holds.json")
+
+	// A missing file has no holds yet
+	store, err := loadHolds(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expires := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	if err := store.set("office", expires); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.set("lobby", expires.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.clear("lobby"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.clear("closet"); err != nil {
+		t.Errorf("Clearing a thermostat without a hold failed: %v", err)
+	}
+
+	// As after a restart
+	if store, err = loadHolds(path); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := store.get("office"); !ok || !got.Equal(expires) {
+		t.Errorf("Reloaded office hold ends %v (%v), want %v", got, ok, expires)
+	}
+	if _, ok := store.get("lobby"); ok {
+		t.Error("Reloaded the cleared lobby hold")
+	}
+
+	if err := ioutil.WriteFile(path, []byte("{not json"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadHolds(path); err == nil {
+		t.Error("Loaded holds from a corrupt file")
+	}
+
+	// Without a path holds are kept in memory only
+	if store, err = loadHolds(""); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.set("office", expires); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.get("office"); !ok {
+		t.Error("In-memory hold was not kept")
+	}
+}
+
+func TestHoldExpiry(t *testing.T) {
+	cloud := fakecloud.New("user", "pass", "site", "UTC")
+	defer cloud.Close()
+	cloud.AddThermostat(fakecloud.Thermostat{Name: "Office", Schedule: "Off"})
+	pelicans, err := types.DiscoverPelicans("user", "pass", "site", cloud.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	office := pelicans[0]
+	holds, err := loadHolds("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tstat := &thermostat{holds: holds, pel: office}
+
+	// Cancelled holds leave the thermostat alone
+	tstat.startHold(office, 50*time.Millisecond)
+	tstat.endHold(office)
+	// A longer hold supersedes a shorter one
+	tstat.startHold(office, 50*time.Millisecond)
+	if err := holds.set(office.ID(), time.Now().Add(200*time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if tstat, _ := cloud.Thermostat("Office"); tstat.Schedule != "Off" {
+		t.Errorf("Thermostat schedule is %q before its hold ended, want Off", tstat.Schedule)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		tstat, _ := cloud.Thermostat("Office")
+		if tstat.Schedule == "On" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Thermostat did not return to its schedule after its hold ended")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// The hold is forgotten once it ends
+	for _, ok := holds.get(office.ID()); ok; _, ok = holds.get(office.ID()) {
+		if time.Now().After(deadline) {
+			t.Fatal("Ended hold was not cleared")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -16,10 +16,13 @@ const TSTAT_PO_DF = "2.1.1.0"
 const DR_PO_DF = "2.1.1.9"
 const OCCUPANCY_PO_DF = "2.1.2.1"
 const SCHED_PO_DF = "2.1.2.2"
+const SENSOR_PO_DF = "2.1.2.0"
 
 type setpointsMsg struct {
 	HeatingSetpoint *float64 `msgpack:"heating_setpoint"`
 	CoolingSetpoint *float64 `msgpack:"cooling_setpoint"`
+	// Seconds to hold the setpoints before returning to the schedule
+	HoldDuration *int64 `msgpack:"hold_duration"`
 }
 
 type stateMsg struct {
@@ -28,6 +31,8 @@ type stateMsg struct {
 	Override        *bool    `msgpack:"override"`
 	Mode            *int     `msgpack:"mode"`
 	Fan             *bool    `msgpack:"fan"`
+	// Seconds to hold the state before returning to the schedule
+	HoldDuration *int64 `msgpack:"hold_duration"`
 }
 
 type stageMsg struct {
@@ -35,11 +40,30 @@ type stageMsg struct {
 	CoolingStages *int32 `msgpack:"enabled_cool_stages"`
 }
 
+type optOutMsg struct {
+	OptOut *bool `msgpack:"opt_out"`
+}
+
 type occupancyMsg struct {
 	Occupancy bool  `msgpack:"occupancy"`
 	Time      int64 `msgpack:"time"`
 }
 
+type temperatureSensorMsg struct {
+	Temperature float64 `msgpack:"temperature"`
+	Time        int64   `msgpack:"time"`
+}
+
+type humiditySensorMsg struct {
+	RelHumidity float64 `msgpack:"relative_humidity"`
+	Time        int64   `msgpack:"time"`
+}
+
+type co2SensorMsg struct {
+	CO2  float64 `msgpack:"co2"`
+	Time int64   `msgpack:"time"`
+}
+
 func main() {
 	bwClient := bw2.ConnectOrExit("")
 	bwClient.OverrideAutoChainTo(true)
@@ -54,11 +78,24 @@ func main() {
 	password := params.MustString("password")
 	sitename := params.MustString("sitename")
 
-	pelicans, err := storage.ReadPelicans(username, password, sitename)
+	store, err := storage.NewStore(params.MustString("storage"))
+	if err != nil {
+		fmt.Printf("Failed to open thermostat storage: %v\n", err)
+		os.Exit(1)
+	}
+	pelicans, err := storage.ReadPelicans(store, username, password, sitename)
 	if err != nil {
 		fmt.Printf("Failed to read thermostat info: %v\n", err)
 		os.Exit(1)
 	}
+	if len(pelicans) == 0 {
+		fmt.Println("No stored thermostats could be found at this site, discovering them instead")
+		pelicans, err = types.DiscoverPelicans(username, password, sitename, "")
+		if err != nil {
+			fmt.Printf("Failed to discover Pelican thermostats: %v\n", err)
+			os.Exit(1)
+		}
+	}
 
 	pollIntStr := params.MustString("poll_interval")
 	pollInt, err := time.ParseDuration(pollIntStr)
@@ -74,6 +111,13 @@ func main() {
 		os.Exit(1)
 	}
 
+	drHeartbeatStr := params.MustString("dr_heartbeat_interval")
+	drHeartbeat, heartbeatErr := time.ParseDuration(drHeartbeatStr)
+	if heartbeatErr != nil {
+		fmt.Printf("Invalid demand response heartbeat interval specified: %v\n", heartbeatErr)
+		os.Exit(1)
+	}
+
 	pollSchedStr := params.MustString("poll_interval_sched")
 	pollSched, schedErr := time.ParseDuration(pollSchedStr)
 	if schedErr != nil {
@@ -81,248 +125,99 @@ func main() {
 		os.Exit(1)
 	}
 
-	service := bwClient.RegisterService(baseURI, "s.pelican")
-	tstatIfaces := make([]*bw2.Interface, len(pelicans))
-	drstatIfaces := make([]*bw2.Interface, len(pelicans))
-	schedstatIfaces := make([]*bw2.Interface, len(pelicans))
-	occupancyIfaces := make([]*bw2.Interface, len(pelicans))
-	for i, pelican := range pelicans {
-		pelican := pelican
-		name := strings.Replace(pelican.Name, " ", "_", -1)
-		name = strings.Replace(name, "&", "_and_", -1)
-		name = strings.Replace(name, "'", "", -1)
-		fmt.Println("Transforming", pelican.Name, "=>", name)
-		tstatIfaces[i] = service.RegisterInterface(name, "i.xbos.thermostat")
-		drstatIfaces[i] = service.RegisterInterface(name, "i.xbos.demand_response")
-		schedstatIfaces[i] = service.RegisterInterface(name, "i.xbos.thermostat_schedule")
-		occupancyIfaces[i] = service.RegisterInterface(name, "i.xbos.occupancy")
-
-		// Ensure thermostat is running with correct number of stages
-		if err := pelican.ModifyStages(&types.PelicanStageParams{
-			HeatingStages: &pelican.HeatingStages,
-			CoolingStages: &pelican.CoolingStages,
-		}); err != nil {
-			fmt.Printf("Failed to configure heating/cooling stages for pelican %s: %s\n",
-				pelican.Name, err)
-			//os.Exit(1)
-		}
-
-		tstatIfaces[i].SubscribeSlot("setpoints", func(msg *bw2.SimpleMessage) {
-			po := msg.GetOnePODF(TSTAT_PO_DF)
-			if po == nil {
-				fmt.Println("Received message on setpoints slot without required PO. Droping.")
-				return
-			}
-
-			var setpoints setpointsMsg
-			if err := po.(bw2.MsgPackPayloadObject).ValueInto(&setpoints); err != nil {
-				fmt.Println("Received malformed PO on setpoints slot. Dropping.", err)
-				return
-			}
-
-			params := types.PelicanSetpointParams{
-				HeatingSetpoint: setpoints.HeatingSetpoint,
-				CoolingSetpoint: setpoints.CoolingSetpoint,
-			}
-			if err := pelican.ModifySetpoints(&params); err != nil {
-				fmt.Println(err)
-			} else {
-				fmt.Printf("Set heating setpoint to %v and cooling setpoint to %v\n",
-					setpoints.HeatingSetpoint, setpoints.CoolingSetpoint)
-			}
-		})
-
-		tstatIfaces[i].SubscribeSlot("state", func(msg *bw2.SimpleMessage) {
-			po := msg.GetOnePODF(TSTAT_PO_DF)
-			if po == nil {
-				fmt.Println("Received message on state slot without required PO. Dropping.")
-				return
-			}
-
-			var state stateMsg
-			if err := po.(bw2.MsgPackPayloadObject).ValueInto(&state); err != nil {
-				fmt.Println("Received malformed PO on state slot. Dropping.", err)
-				return
-			}
-
-			params := types.PelicanStateParams{
-				HeatingSetpoint: state.HeatingSetpoint,
-				CoolingSetpoint: state.CoolingSetpoint,
-			}
-			fmt.Printf("%+v", state)
-			if state.Mode != nil {
-				m := float64(*state.Mode)
-				params.Mode = &m
-			}
-
-			if state.Override != nil && *state.Override {
-				f := float64(1)
-				params.Override = &f
-			} else {
-				f := float64(0)
-				params.Override = &f
-			}
-
-			if state.Fan != nil && *state.Fan {
-				f := float64(1)
-				params.Fan = &f
-			} else {
-				f := float64(0)
-				params.Fan = &f
-			}
+	pollDiscoveryStr := params.MustString("poll_interval_discovery")
+	pollDiscovery, discoveryErr := time.ParseDuration(pollDiscoveryStr)
+	if discoveryErr != nil {
+		fmt.Printf("Invalid discovery poll interval specified: %v\n", discoveryErr)
+		os.Exit(1)
+	}
 
-			if err := pelican.ModifyState(&params); err != nil {
-				fmt.Println(err)
-			} else {
-				fmt.Printf("Set Pelican state to: %+v\n", params)
-			}
-		})
+	backfillWindowStr := params.MustString("backfill_window")
+	backfillWindow, backfillErr := time.ParseDuration(backfillWindowStr)
+	if backfillErr != nil {
+		fmt.Printf("Invalid backfill window specified: %v\n", backfillErr)
+		os.Exit(1)
+	}
 
-		tstatIfaces[i].SubscribeSlot("stages", func(msg *bw2.SimpleMessage) {
-			po := msg.GetOnePODF(TSTAT_PO_DF)
-			if po == nil {
-				fmt.Println("Received message on stage slot without required PO. Dropping.")
-				return
-			}
+	minOffTimeStr := params.MustString("min_off_time")
+	minOffTime, minOffErr := time.ParseDuration(minOffTimeStr)
+	if minOffErr != nil {
+		fmt.Printf("Invalid minimum off time specified: %v\n", minOffErr)
+		os.Exit(1)
+	}
 
-			var stages stageMsg
-			if err := po.(bw2.MsgPackPayloadObject).ValueInto(&stages); err != nil {
-				fmt.Println("Received malformed PO on stage slot. Dropping.", err)
-				return
-			}
-			if stages.HeatingStages == nil && stages.CoolingStages == nil {
-				fmt.Println("Received message on stage slot with no content. Dropping.")
-				return
-			}
+	policies, err := loadPolicy(params.MustString("policy"))
+	if err != nil {
+		fmt.Printf("Failed to load setpoint policy: %v\n", err)
+		os.Exit(1)
+	}
 
-			params := types.PelicanStageParams{
-				HeatingStages: stages.HeatingStages,
-				CoolingStages: stages.CoolingStages,
-			}
-			if err := pelican.ModifyStages(&params); err != nil {
-				fmt.Println(err)
-			} else {
-				if stages.HeatingStages != nil {
-					fmt.Printf("Set pelican heating stages to: %d\n", *stages.HeatingStages)
-				}
-				if stages.CoolingStages != nil {
-					fmt.Printf("Set pelican cooling stages to: %d\n", *stages.CoolingStages)
-				}
-			}
-		})
+	holds, err := loadHolds(params.MustString("holds_file"))
+	if err != nil {
+		fmt.Printf("Failed to load thermostat holds: %v\n", err)
+		os.Exit(1)
+	}
 
-		schedstatIfaces[i].SubscribeSlot("schedule", func(msg *bw2.SimpleMessage) {
-			po := msg.GetOnePODF(SCHED_PO_DF)
-			if po == nil {
-				fmt.Println("Received message on stage slot without required PO. Dropping.")
-				return
-			}
+	site, err := types.NewPelicanSite(pelicans)
+	if err != nil {
+		fmt.Printf("Failed to group thermostats by site: %v\n", err)
+		os.Exit(1)
+	}
 
-			var schedule types.ThermostatSchedule
-			if err := po.(bw2.MsgPackPayloadObject).ValueInto(&schedule); err != nil {
-				fmt.Println("Received malformed PO on stage slot. Dropping.", err)
-				return
-			}
-			if schedule.DaySchedules == nil {
-				fmt.Println("Received message on stage slot with no content. Dropping.")
-				return
-			}
+	service := bwClient.RegisterService(baseURI, "s.pelican")
+	thermostats := newRegistry(service, site, pollIntervals{
+		dr:          pollDr,
+		sched:       pollSched,
+		drHeartbeat: drHeartbeat,
+	}, policies, holds, minOffTime)
+	for _, pelican := range pelicans {
+		if err := thermostats.add(pelican); err != nil {
+			fmt.Printf("Failed to add thermostat %s: %v\n", pelican.Name, err)
+			os.Exit(1)
+		}
+	}
 
-			if err := pelican.SetSchedule(&schedule); err != nil {
-				fmt.Println(err)
-			} else {
-				fmt.Printf("Set pelican schedule to: %v", schedule)
-			}
-		})
+	// Fill in what was missed while the driver was not running
+	if backfillWindow > 0 {
+		go thermostats.backfill(backfillWindow)
 	}
 
 	done := make(chan bool)
-	for i, pelican := range pelicans {
-		currentPelican := pelican
-		currentIface := tstatIfaces[i]
-		currentDRIface := drstatIfaces[i]
-		currentSchedIface := schedstatIfaces[i]
-		currentOccupancyIface := occupancyIfaces[i]
-
-		go func() {
-			for {
-				if status, err := currentPelican.GetStatus(); err != nil {
-					fmt.Printf("Failed to retrieve Pelican status: %v\n", err)
-					done <- true
-				} else if status != nil {
-					fmt.Printf("%s %+v\n", currentPelican.Name, status)
-
-					po, err := bw2.CreateMsgPackPayloadObject(bw2.FromDotForm(TSTAT_PO_DF), status)
-					if err != nil {
-						fmt.Printf("Failed to create msgpack PO: %v", err)
-						done <- true
-					}
-					currentIface.PublishSignal("info", po)
-				}
+	// A single site-wide poll feeds the info and occupancy signals of every thermostat
+	go func() {
+		for {
+			readings, err := site.Poll()
+			if err != nil {
+				// The Pelican API is often briefly unreachable, so try again on the next poll
+				fmt.Printf("Failed to retrieve Pelican status: %v\n", err)
 				time.Sleep(pollInt)
+				continue
 			}
-		}()
-
-		go func() {
-			for {
-				if drStatus, drErr := currentPelican.TrackDREvent(); drErr != nil {
-					fmt.Printf("Failed to retrieve Pelican's DR status: %v\n", drErr)
-				} else if drStatus != nil {
-					fmt.Printf("%s DR Status: %+v\n", currentPelican.Name, drStatus)
-					po, err := bw2.CreateMsgPackPayloadObject(bw2.FromDotForm(DR_PO_DF), drStatus)
-					if err != nil {
-						fmt.Printf("Failed to create DR msgpack PO: %v", err)
-					}
-					currentDRIface.PublishSignal("info", po)
-				}
-				time.Sleep(pollDr)
+			if err := thermostats.publish(readings); err != nil {
+				fmt.Println(err)
+				done <- true
+				return
 			}
-		}()
+			time.Sleep(pollInt)
+		}
+	}()
 
+	// Periodically pick up thermostats added to, removed from or renamed in the site
+	if pollDiscovery > 0 {
 		go func() {
 			for {
-				if schedStatus, schedErr := currentPelican.GetSchedule(); schedErr != nil {
-					fmt.Printf("Failed to retrieve Pelican's Schedule: %v\n", schedErr)
-				} else {
-					fmt.Printf("%s Schedule: %+v\n", currentPelican.Name, schedStatus)
-					po, err := bw2.CreateMsgPackPayloadObject(bw2.FromDotForm(SCHED_PO_DF), schedStatus)
-					if err != nil {
-						fmt.Printf("Failed to create Schedule msgpack PO: %v", err)
-					}
-					currentSchedIface.PublishSignal("info", po)
+				time.Sleep(pollDiscovery)
+				discovered, err := types.DiscoverPelicans(username, password, sitename, "")
+				if err != nil {
+					fmt.Printf("Failed to rediscover Pelican thermostats: %v\n", err)
+					continue
+				}
+				thermostats.reconcile(discovered)
+				if err := storage.WritePelicans(store, thermostats.pelicans(), sitename); err != nil {
+					fmt.Printf("Failed to save thermostat info: %v\n", err)
 				}
-				time.Sleep(pollSched)
 			}
 		}()
-
-		occupancy, err := currentPelican.GetOccupancy()
-		if err != nil {
-			fmt.Printf("Failed to retrieve initial occupancy reading: %s\n", err)
-			return
-		}
-		// Start occupancy tracking loop only if thermostat has the necessary sensor
-		if occupancy != types.OCCUPANCY_UNKNOWN {
-			go func() {
-				for {
-					occupancy, err := currentPelican.GetOccupancy()
-					if err != nil {
-						fmt.Printf("Failed to read thermostat occupancy: %s\n", err)
-					} else {
-						occupancyStatus := occupancyMsg{
-							Occupancy: (occupancy == types.OCCUPANCY_OCCUPIED),
-							Time:      time.Now().UnixNano(),
-						}
-						po, err := bw2.CreateMsgPackPayloadObject(bw2.FromDotForm(OCCUPANCY_PO_DF), occupancyStatus)
-						if err != nil {
-							fmt.Printf("Failed to create occupancy msgpack PO: %s\n", err)
-						} else {
-							currentOccupancyIface.PublishSignal("info", po)
-						}
-					}
-					time.Sleep(pollInt)
-				}
-			}()
-		}
 	}
 	<-done
 }
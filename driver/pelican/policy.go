@@ -0,0 +1,279 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"time"
+
+	"github.com/SoftwareDefinedBuildings/bw2-contrib/driver/pelican/types"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// What to do with a command that violates the policy. Mode violations can't
+// be clamped and are always rejected.
+const (
+	POLICY_ACTION_CLAMP  = "clamp"
+	POLICY_ACTION_REJECT = "reject"
+)
+
+// Outcomes reported on the actuation_result signal
+const (
+	ACTUATION_APPLIED  = "applied"
+	ACTUATION_CLAMPED  = "clamped"
+	ACTUATION_REJECTED = "rejected"
+	ACTUATION_FAILED   = "failed"
+)
+
+// Limits on the commands accepted for a thermostat. Temperatures are in
+// Fahrenheit, like everything else on i.xbos.thermostat.
+type policy struct {
+	MinHeatSetpoint float64
+	MaxHeatSetpoint float64
+	MinCoolSetpoint float64
+	MaxCoolSetpoint float64
+	// Smallest allowed gap between the heating and cooling setpoints
+	MinDeadband float64
+	// Modes as numbered on i.xbos.thermostat (0 Off, 1 Heat, 2 Cool, 3 Auto)
+	AllowedModes []int
+	// Shortest time between two mode changes made by the driver
+	MinModeInterval time.Duration
+	Action          string
+}
+
+// Applies when the policy file leaves a limit unset
+var defaultPolicy = policy{
+	MinHeatSetpoint: 50,
+	MaxHeatSetpoint: 80,
+	MinCoolSetpoint: 65,
+	MaxCoolSetpoint: 90,
+	MinDeadband:     2,
+	AllowedModes:    []int{0, 1, 2, 3},
+	MinModeInterval: 10 * time.Minute,
+	Action:          POLICY_ACTION_CLAMP,
+}
+
+// One level of the policy file. Unset fields are inherited from the level above.
+type policyConfig struct {
+	MinHeatSetpoint *float64 `yaml:"min_heat_setpoint"`
+	MaxHeatSetpoint *float64 `yaml:"max_heat_setpoint"`
+	MinCoolSetpoint *float64 `yaml:"min_cool_setpoint"`
+	MaxCoolSetpoint *float64 `yaml:"max_cool_setpoint"`
+	MinDeadband     *float64 `yaml:"min_deadband"`
+	AllowedModes    []int    `yaml:"allowed_modes"`
+	MinModeInterval *string  `yaml:"min_mode_interval"`
+	Action          *string  `yaml:"action"`
+}
+
+type policyFile struct {
+	Site policyConfig `yaml:"site"`
+	// Keyed by thermostat name
+	Thermostats map[string]policyConfig `yaml:"thermostats"`
+}
+
+// The site's policy and any per-thermostat refinements of it
+type sitePolicy struct {
+	site        policy
+	thermostats map[string]policy
+}
+
+// Reads a policy file. An empty path leaves every thermostat on the defaults.
+func loadPolicy(path string) (*sitePolicy, error) {
+	policies := &sitePolicy{site: defaultPolicy, thermostats: make(map[string]policy)}
+	if path == "" {
+		return policies, nil
+	}
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read policy file %s: %v", path, err)
+	}
+	var file policyFile
+	if err := yaml.Unmarshal(contents, &file); err != nil {
+		return nil, fmt.Errorf("Failed to parse policy file %s: %v", path, err)
+	}
+
+	if policies.site, err = file.Site.apply(defaultPolicy); err != nil {
+		return nil, fmt.Errorf("Invalid site policy: %v", err)
+	}
+	for name, config := range file.Thermostats {
+		if policies.thermostats[name], err = config.apply(policies.site); err != nil {
+			return nil, fmt.Errorf("Invalid policy for thermostat %s: %v", name, err)
+		}
+	}
+	return policies, nil
+}
+
+// The policy governing the named thermostat
+func (policies *sitePolicy) forThermostat(name string) policy {
+	if p, ok := policies.thermostats[name]; ok {
+		return p
+	}
+	return policies.site
+}
+
+// Overrides the fields of base that are set in the config
+func (config policyConfig) apply(base policy) (policy, error) {
+	p := base
+	if config.MinHeatSetpoint != nil {
+		p.MinHeatSetpoint = *config.MinHeatSetpoint
+	}
+	if config.MaxHeatSetpoint != nil {
+		p.MaxHeatSetpoint = *config.MaxHeatSetpoint
+	}
+	if config.MinCoolSetpoint != nil {
+		p.MinCoolSetpoint = *config.MinCoolSetpoint
+	}
+	if config.MaxCoolSetpoint != nil {
+		p.MaxCoolSetpoint = *config.MaxCoolSetpoint
+	}
+	if config.MinDeadband != nil {
+		p.MinDeadband = *config.MinDeadband
+	}
+	if config.AllowedModes != nil {
+		p.AllowedModes = config.AllowedModes
+	}
+	if config.MinModeInterval != nil {
+		interval, err := time.ParseDuration(*config.MinModeInterval)
+		if err != nil {
+			return p, fmt.Errorf("Invalid min_mode_interval: %v", err)
+		}
+		p.MinModeInterval = interval
+	}
+	if config.Action != nil {
+		p.Action = *config.Action
+	}
+
+	if p.MinHeatSetpoint > p.MaxHeatSetpoint || p.MinCoolSetpoint > p.MaxCoolSetpoint {
+		return p, fmt.Errorf("Setpoint minimum exceeds maximum")
+	}
+	if p.MinDeadband < 0 {
+		return p, fmt.Errorf("Negative min_deadband %v", p.MinDeadband)
+	}
+	if p.Action != POLICY_ACTION_CLAMP && p.Action != POLICY_ACTION_REJECT {
+		return p, fmt.Errorf("Unknown action %q", p.Action)
+	}
+	return p, nil
+}
+
+// A command for a thermostat, as it was requested and as it will be applied
+type actuation struct {
+	HeatingSetpoint *float64
+	CoolingSetpoint *float64
+	Mode            *int
+	// Seconds until the thermostat returns to its schedule, nil for no hold
+	HoldDuration *int64
+}
+
+// The outcome of a command, published on the actuation_result signal
+type actuationResultMsg struct {
+	Slot   string `msgpack:"slot"`
+	Result string `msgpack:"result"`
+	// Why the command was clamped, rejected or failed
+	Reasons []string `msgpack:"reasons"`
+	// The values written to the thermostat, or requested if it was rejected
+	HeatingSetpoint *float64 `msgpack:"heating_setpoint"`
+	CoolingSetpoint *float64 `msgpack:"cooling_setpoint"`
+	Mode            *int     `msgpack:"mode"`
+	HoldDuration    *int64   `msgpack:"hold_duration"`
+	Time            int64    `msgpack:"time"`
+}
+
+// Checks a command against the policy, given the thermostat's last known
+// status (nil if unknown) and when the driver last changed its mode. Returns
+// the command to apply and an actuationResultMsg for it; the command is nil
+// if it was rejected.
+func (p policy) check(cmd actuation, status *types.PelicanStatus, lastModeChange time.Time) (*actuation, *actuationResultMsg) {
+	result := &actuationResultMsg{
+		Result:          ACTUATION_APPLIED,
+		HeatingSetpoint: cmd.HeatingSetpoint,
+		CoolingSetpoint: cmd.CoolingSetpoint,
+		Mode:            cmd.Mode,
+		HoldDuration:    cmd.HoldDuration,
+		Time:            time.Now().UnixNano(),
+	}
+	reject := func(reason string) (*actuation, *actuationResultMsg) {
+		result.Result = ACTUATION_REJECTED
+		result.Reasons = append(result.Reasons, reason)
+		return nil, result
+	}
+
+	for _, setpoint := range []*float64{cmd.HeatingSetpoint, cmd.CoolingSetpoint} {
+		if setpoint != nil && (math.IsNaN(*setpoint) || math.IsInf(*setpoint, 0)) {
+			return reject(fmt.Sprintf("Setpoint %v is not a number", *setpoint))
+		}
+	}
+
+	if cmd.HoldDuration != nil && *cmd.HoldDuration <= 0 {
+		return reject(fmt.Sprintf("Hold duration %d is not positive", *cmd.HoldDuration))
+	}
+
+	if cmd.Mode != nil {
+		allowed := false
+		for _, mode := range p.AllowedModes {
+			allowed = allowed || mode == *cmd.Mode
+		}
+		if !allowed {
+			return reject(fmt.Sprintf("Mode %d is not allowed", *cmd.Mode))
+		}
+		changing := status == nil || int(status.Mode) != *cmd.Mode
+		if changing && time.Since(lastModeChange) < p.MinModeInterval {
+			return reject(fmt.Sprintf("Mode was changed less than %v ago", p.MinModeInterval))
+		}
+	}
+
+	clamp := func(name string, setpoint *float64, min, max float64) *float64 {
+		if setpoint == nil {
+			return nil
+		}
+		value := math.Max(min, math.Min(max, *setpoint))
+		if value != *setpoint {
+			result.Reasons = append(result.Reasons,
+				fmt.Sprintf("%s setpoint %v outside of [%v, %v]", name, *setpoint, min, max))
+		}
+		return &value
+	}
+	heat := clamp("Heating", cmd.HeatingSetpoint, p.MinHeatSetpoint, p.MaxHeatSetpoint)
+	cool := clamp("Cooling", cmd.CoolingSetpoint, p.MinCoolSetpoint, p.MaxCoolSetpoint)
+
+	// The deadband is checked against the current value of whichever
+	// setpoint the command leaves alone
+	effectiveHeat, effectiveCool := heat, cool
+	if status != nil {
+		if effectiveHeat == nil {
+			effectiveHeat = &status.HeatingSetpoint
+		}
+		if effectiveCool == nil {
+			effectiveCool = &status.CoolingSetpoint
+		}
+	}
+	if (heat != nil || cool != nil) && effectiveHeat != nil && effectiveCool != nil &&
+		*effectiveCool-*effectiveHeat < p.MinDeadband {
+		result.Reasons = append(result.Reasons, fmt.Sprintf("Heating setpoint %v and cooling setpoint %v are closer than %v",
+			*effectiveHeat, *effectiveCool, p.MinDeadband))
+		switch {
+		case heat != nil && cool != nil:
+			mid := (*heat + *cool) / 2
+			*heat = mid - p.MinDeadband/2
+			*cool = mid + p.MinDeadband/2
+		case heat != nil:
+			*heat = *effectiveCool - p.MinDeadband
+		default:
+			*cool = *effectiveHeat + p.MinDeadband
+		}
+		if (heat != nil && (*heat < p.MinHeatSetpoint || *heat > p.MaxHeatSetpoint)) ||
+			(cool != nil && (*cool < p.MinCoolSetpoint || *cool > p.MaxCoolSetpoint)) {
+			return reject("Deadband can't be kept within the allowed setpoint ranges")
+		}
+	}
+
+	if len(result.Reasons) > 0 {
+		if p.Action == POLICY_ACTION_REJECT {
+			result.Result = ACTUATION_REJECTED
+			return nil, result
+		}
+		result.Result = ACTUATION_CLAMPED
+		result.HeatingSetpoint = heat
+		result.CoolingSetpoint = cool
+	}
+	return &actuation{HeatingSetpoint: heat, CoolingSetpoint: cool, Mode: cmd.Mode, HoldDuration: cmd.HoldDuration}, result
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/SoftwareDefinedBuildings/bw2-contrib/driver/pelican/fakecloud"
+	"github.com/SoftwareDefinedBuildings/bw2-contrib/driver/pelican/types"
+)
+
+func float(v float64) *float64 { return &v }
+func mode(v int) *int          { return &v }
+
+func TestPolicyCheck(t *testing.T) {
+	status := &types.PelicanStatus{HeatingSetpoint: 68, CoolingSetpoint: 76, Mode: 3}
+	reject := defaultPolicy
+	reject.Action = POLICY_ACTION_REJECT
+	heatOnly := defaultPolicy
+	heatOnly.AllowedModes = []int{0, 1}
+
+	for _, test := range []struct {
+		name           string
+		policy         policy
+		cmd            actuation
+		status         *types.PelicanStatus
+		lastModeChange time.Time
+		result         string
+		heat, cool     float64
+	}{
+		{"within limits", defaultPolicy, actuation{HeatingSetpoint: float(66), CoolingSetpoint: float(78)}, status, time.Time{},
+			ACTUATION_APPLIED, 66, 78},
+		{"clamped", defaultPolicy, actuation{HeatingSetpoint: float(40), CoolingSetpoint: float(95)}, status, time.Time{},
+			ACTUATION_CLAMPED, 50, 90},
+		{"rejected", reject, actuation{HeatingSetpoint: float(40), CoolingSetpoint: float(78)}, status, time.Time{},
+			ACTUATION_REJECTED, 0, 0},
+		{"NaN", defaultPolicy, actuation{HeatingSetpoint: float(math.NaN())}, status, time.Time{},
+			ACTUATION_REJECTED, 0, 0},
+		{"deadband around both", defaultPolicy, actuation{HeatingSetpoint: float(72), CoolingSetpoint: float(72)}, status, time.Time{},
+			ACTUATION_CLAMPED, 71, 73},
+		{"deadband against current cooling", defaultPolicy, actuation{HeatingSetpoint: float(76)}, status, time.Time{},
+			ACTUATION_CLAMPED, 74, 0},
+		{"deadband against current heating", defaultPolicy, actuation{CoolingSetpoint: float(67)}, status, time.Time{},
+			ACTUATION_CLAMPED, 0, 70},
+		{"deadband out of range", defaultPolicy, actuation{HeatingSetpoint: float(60)}, &types.PelicanStatus{CoolingSetpoint: 51}, time.Time{},
+			ACTUATION_REJECTED, 0, 0},
+		{"mode not allowed", heatOnly, actuation{Mode: mode(2)}, status, time.Time{},
+			ACTUATION_REJECTED, 0, 0},
+		{"mode changed too recently", defaultPolicy, actuation{Mode: mode(1)}, status, time.Now(),
+			ACTUATION_REJECTED, 0, 0},
+		{"mode unchanged", defaultPolicy, actuation{Mode: mode(3)}, status, time.Now(),
+			ACTUATION_APPLIED, 0, 0},
+		{"mode changed long ago", defaultPolicy, actuation{Mode: mode(1)}, status, time.Now().Add(-time.Hour),
+			ACTUATION_APPLIED, 0, 0},
+	} {
+		cmd, result := test.policy.check(test.cmd, test.status, test.lastModeChange)
+		if result.Result != test.result {
+			t.Errorf("%s: result is %s (%v), want %s", test.name, result.Result, result.Reasons, test.result)
+			continue
+		}
+		if (cmd == nil) != (test.result == ACTUATION_REJECTED) {
+			t.Errorf("%s: %s command is %+v", test.name, test.result, cmd)
+			continue
+		}
+		if test.result != ACTUATION_APPLIED && len(result.Reasons) == 0 {
+			t.Errorf("%s: %s without a reason", test.name, test.result)
+		}
+		if cmd == nil {
+			continue
+		}
+		for _, setpoint := range []struct {
+			name  string
+			value *float64
+			want  float64
+		}{{"heating", cmd.HeatingSetpoint, test.heat}, {"cooling", cmd.CoolingSetpoint, test.cool}} {
+			if (setpoint.value == nil) != (setpoint.want == 0) || (setpoint.value != nil && *setpoint.value != setpoint.want) {
+				t.Errorf("%s: %s setpoint is %v, want %v", test.name, setpoint.name, setpoint.value, setpoint.want)
+			}
+		}
+	}
+}
+
+// Thermostats inherit whatever their own section of the file leaves unset
+func TestLoadPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "policy.yml")
+	contents := `
+site:
+  max_heat_setpoint: 72
+  action: reject
+thermostats:
+  Lobby:
+    allowed_modes: [0, 1]
+    min_mode_interval: 1h
+`
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	policies, err := loadPolicy(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	office, lobby := policies.forThermostat("Office"), policies.forThermostat("Lobby")
+	if office.MaxHeatSetpoint != 72 || office.Action != POLICY_ACTION_REJECT || office.MinCoolSetpoint != defaultPolicy.MinCoolSetpoint {
+		t.Errorf("Office policy is %+v, want the site's", office)
+	}
+	if lobby.MaxHeatSetpoint != 72 || len(lobby.AllowedModes) != 2 || lobby.MinModeInterval != time.Hour {
+		t.Errorf("Lobby policy is %+v, want the site's with its own modes and interval", lobby)
+	}
+
+	// Checked against a status read from the thermostat
+	cloud := fakecloud.New("user", "pass", "site", "UTC")
+	defer cloud.Close()
+	cloud.AddThermostat(fakecloud.Thermostat{Name: "Lobby", HeatSetting: 65, CoolSetting: 75, System: "Heat"})
+	pelicans, err := types.DiscoverPelicans("user", "pass", "site", cloud.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := pelicans[0].GetStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmd, result := lobby.check(actuation{Mode: mode(2)}, status, time.Time{}); cmd != nil {
+		t.Errorf("Lobby was switched to cooling: %+v", result)
+	}
+	if cmd, result := lobby.check(actuation{CoolingSetpoint: float(66)}, status, time.Time{}); cmd != nil {
+		t.Errorf("Lobby accepted a cooling setpoint within the deadband: %+v", result)
+	}
+
+	for _, invalid := range []string{
+		"site: {action: ignore}",
+		"site: {min_heat_setpoint: 80, max_heat_setpoint: 70}",
+		"thermostats: {Lobby: {min_mode_interval: soon}}",
+		"site: [",
+	} {
+		if err := ioutil.WriteFile(path, []byte(invalid), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadPolicy(path); err == nil {
+			t.Errorf("Loaded invalid policy %q", invalid)
+		}
+	}
+	if _, err := loadPolicy(filepath.Join(dir, "missing.yml")); err == nil {
+		t.Error("Loaded a missing policy file")
+	}
+	if policies, err := loadPolicy(""); err != nil || policies.forThermostat("Office").Action != defaultPolicy.Action {
+		t.Errorf("Policy without a file is %+v, %v; want the defaults", policies, err)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/SoftwareDefinedBuildings/bw2-contrib/driver/pelican/types"
+	bw2 "gopkg.in/immesys/bw2bind.v5"
+)
+
+// Tracks the site's thermostats by their stable Pelican ID, so that
+// thermostats can come, go and be renamed while the driver is running
+type registry struct {
+	service   *bw2.Service
+	site      *types.PelicanSite
+	intervals pollIntervals
+	policies  *sitePolicy
+	holds     *holdStore
+	// Least time a thermostat is kept off while its stages change
+	minOffTime time.Duration
+
+	lock        sync.Mutex
+	thermostats map[string]*thermostat
+}
+
+func newRegistry(service *bw2.Service, site *types.PelicanSite, intervals pollIntervals, policies *sitePolicy, holds *holdStore, minOffTime time.Duration) *registry {
+	return &registry{
+		service:     service,
+		site:        site,
+		intervals:   intervals,
+		policies:    policies,
+		holds:       holds,
+		minOffTime:  minOffTime,
+		thermostats: make(map[string]*thermostat),
+	}
+}
+
+// Starts serving a thermostat, reusing its interfaces if it was seen before
+func (reg *registry) add(pelican *types.Pelican) error {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	return reg.addLocked(pelican)
+}
+
+func (reg *registry) addLocked(pelican *types.Pelican) error {
+	if err := reg.site.Add(pelican); err != nil {
+		return err
+	}
+
+	tstat, ok := reg.thermostats[pelican.ID()]
+	if !ok {
+		tstat = newThermostat(reg.service, pelican, reg.policies, reg.holds, reg.minOffTime)
+		reg.thermostats[pelican.ID()] = tstat
+	}
+	// Its stages are checked, and its run time starts being counted, with
+	// the next site poll rather than with requests of its own
+	tstat.start(pelican, reg.intervals)
+	return nil
+}
+
+// Current Pelicans, in no particular order
+func (reg *registry) pelicans() []*types.Pelican {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	pelicans := make([]*types.Pelican, 0, len(reg.thermostats))
+	for _, tstat := range reg.thermostats {
+		if pelican := tstat.pelican(); pelican != nil {
+			pelicans = append(pelicans, pelican)
+		}
+	}
+	return pelicans
+}
+
+// Backfills the given window of history for every current thermostat
+func (reg *registry) backfill(window time.Duration) {
+	reg.lock.Lock()
+	thermostats := make([]*thermostat, 0, len(reg.thermostats))
+	for _, tstat := range reg.thermostats {
+		thermostats = append(thermostats, tstat)
+	}
+	reg.lock.Unlock()
+
+	for _, tstat := range thermostats {
+		if pelican := tstat.pelican(); pelican != nil {
+			tstat.backfill(pelican, window)
+		}
+	}
+}
+
+// Publishes each thermostat's share of a site poll
+func (reg *registry) publish(readings map[string]*types.PelicanReading) error {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	for _, tstat := range reg.thermostats {
+		pelican := tstat.pelican()
+		if pelican == nil {
+			continue
+		}
+		reading, ok := readings[pelican.Name]
+		if !ok {
+			fmt.Printf("No status reported for thermostat %s\n", pelican.Name)
+			continue
+		}
+		if reading.Status != nil {
+			fmt.Printf("%s %+v\n", pelican.Name, reading.Status)
+		}
+		if err := tstat.publishReading(reading); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Brings the served thermostats in line with a fresh discovery of the site.
+// New thermostats are added, missing ones stop being polled, and renamed ones
+// keep publishing on the interfaces registered under their original name.
+func (reg *registry) reconcile(discovered []*types.Pelican) {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+
+	seen := make(map[string]bool)
+	for _, pelican := range discovered {
+		seen[pelican.ID()] = true
+		tstat, ok := reg.thermostats[pelican.ID()]
+		current := (*types.Pelican)(nil)
+		if ok {
+			current = tstat.pelican()
+		}
+
+		switch {
+		case current == nil:
+			fmt.Printf("Adding thermostat %s (ID %s)\n", pelican.Name, pelican.ID())
+		case current.Name != pelican.Name:
+			fmt.Printf("Thermostat %s (ID %s) renamed to %s\n", current.Name, pelican.ID(), pelican.Name)
+			reg.site.Remove(current.Name)
+		default:
+			continue
+		}
+
+		// Keep the configured stages of known thermostats
+		if current != nil {
+			pelican.HeatingStages = current.HeatingStages
+			pelican.CoolingStages = current.CoolingStages
+		}
+		if err := reg.addLocked(pelican); err != nil {
+			fmt.Printf("Failed to add thermostat %s: %v\n", pelican.Name, err)
+		}
+	}
+
+	for id, tstat := range reg.thermostats {
+		current := tstat.pelican()
+		if seen[id] || current == nil {
+			continue
+		}
+		fmt.Printf("Removing thermostat %s (ID %s)\n", current.Name, id)
+		tstat.halt()
+		reg.site.Remove(current.Name)
+	}
+}
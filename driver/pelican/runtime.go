@@ -0,0 +1,192 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/SoftwareDefinedBuildings/bw2-contrib/driver/pelican/types"
+)
+
+// Periods run time is accumulated over
+const (
+	RUNTIME_PERIOD_HOURLY = "hourly"
+	RUNTIME_PERIOD_DAILY  = "daily"
+)
+
+// Samples further apart than this are assumed to have missed something, so
+// the earlier sample's state is only counted for this long
+const runtimeMaxGap = 15 * time.Minute
+
+// Equipment run time and cycles over an hour or a day, published on the
+// runtime signal once the period is over. Run times are in seconds. Stage 1
+// also runs while stage 2 does, so stage 1 run time includes stage 2's.
+// Only the observed part of the period is counted, which is less than the
+// whole period after the driver starts or across gaps between polls.
+type runtimeMsg struct {
+	Period string `msgpack:"period"`
+	// Bounds of the period, in nanoseconds since the epoch
+	Start      int64   `msgpack:"start"`
+	End        int64   `msgpack:"end"`
+	HeatStage1 float64 `msgpack:"heat_stage1_runtime"`
+	HeatStage2 float64 `msgpack:"heat_stage2_runtime"`
+	CoolStage1 float64 `msgpack:"cool_stage1_runtime"`
+	CoolStage2 float64 `msgpack:"cool_stage2_runtime"`
+	Fan        float64 `msgpack:"fan_runtime"`
+	HeatCycles int     `msgpack:"heat_cycles"`
+	CoolCycles int     `msgpack:"cool_cycles"`
+	// Cycles per observed hour
+	HeatCyclesPerHour float64 `msgpack:"heat_cycles_per_hour"`
+	CoolCyclesPerHour float64 `msgpack:"cool_cycles_per_hour"`
+	// Seconds of the period covered by polls, and whether that is less than
+	// the whole period
+	Observed float64 `msgpack:"observed"`
+	Partial  bool    `msgpack:"partial"`
+	Time     int64   `msgpack:"time"`
+
+	observed time.Duration
+}
+
+// A thermostat's state at one point in time
+type runtimeSample struct {
+	at    time.Time
+	state int32
+	fan   bool
+}
+
+// Accumulates a thermostat's run time from successive samples of its state
+type runtimeTracker struct {
+	location *time.Location
+
+	lock sync.Mutex
+	last *runtimeSample
+	hour *runtimeMsg
+	day  *runtimeMsg
+}
+
+func newRuntimeTracker(location *time.Location) *runtimeTracker {
+	return &runtimeTracker{location: location}
+}
+
+// Accumulates a polled status, returning the periods it completes
+func (tracker *runtimeTracker) add(status *types.PelicanStatus) []*runtimeMsg {
+	sample := runtimeSample{at: time.Unix(0, status.Time), state: status.State, fan: status.Fan}
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	return tracker.addLocked(sample)
+}
+
+func (tracker *runtimeTracker) addLocked(sample runtimeSample) []*runtimeMsg {
+	if tracker.last == nil {
+		tracker.hour = tracker.newPeriod(RUNTIME_PERIOD_HOURLY, sample.at)
+		tracker.day = tracker.newPeriod(RUNTIME_PERIOD_DAILY, sample.at)
+		tracker.last = &sample
+		return nil
+	}
+	last := tracker.last
+	if !sample.at.After(last.at) {
+		return nil
+	}
+
+	// The previous state lasted until this sample, or for at most runtimeMaxGap
+	runningUntil := sample.at
+	if runningUntil.Sub(last.at) > runtimeMaxGap {
+		runningUntil = last.at.Add(runtimeMaxGap)
+	}
+
+	var done []*runtimeMsg
+	for from := last.at; from.Before(sample.at); {
+		to := sample.at
+		for _, period := range []*runtimeMsg{tracker.hour, tracker.day} {
+			if end := time.Unix(0, period.End); end.Before(to) {
+				to = end
+			}
+		}
+		if running := minTime(to, runningUntil).Sub(from); running > 0 {
+			for _, period := range []*runtimeMsg{tracker.hour, tracker.day} {
+				accumulate(period, last, running)
+			}
+		}
+		from = to
+
+		if !from.Before(time.Unix(0, tracker.hour.End)) {
+			done = append(done, tracker.hour.finish())
+			tracker.hour = tracker.newPeriod(RUNTIME_PERIOD_HOURLY, from)
+		}
+		if !from.Before(time.Unix(0, tracker.day.End)) {
+			done = append(done, tracker.day.finish())
+			tracker.day = tracker.newPeriod(RUNTIME_PERIOD_DAILY, from)
+		}
+	}
+
+	// A cycle starts whenever the equipment turns on
+	for _, period := range []*runtimeMsg{tracker.hour, tracker.day} {
+		if isHeating(sample.state) && !isHeating(last.state) {
+			period.HeatCycles++
+		}
+		if isCooling(sample.state) && !isCooling(last.state) {
+			period.CoolCycles++
+		}
+	}
+	tracker.last = &sample
+	return done
+}
+
+// The hour or day containing at, in the thermostat's time zone
+func (tracker *runtimeTracker) newPeriod(period string, at time.Time) *runtimeMsg {
+	local := at.In(tracker.location)
+	var start, end time.Time
+	if period == RUNTIME_PERIOD_HOURLY {
+		start = time.Date(local.Year(), local.Month(), local.Day(), local.Hour(), 0, 0, 0, tracker.location)
+		end = start.Add(time.Hour)
+	} else {
+		start = time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, tracker.location)
+		end = start.AddDate(0, 0, 1)
+	}
+	return &runtimeMsg{Period: period, Start: start.UnixNano(), End: end.UnixNano()}
+}
+
+func (period *runtimeMsg) finish() *runtimeMsg {
+	if hours := period.observed.Hours(); hours > 0 {
+		period.HeatCyclesPerHour = float64(period.HeatCycles) / hours
+		period.CoolCyclesPerHour = float64(period.CoolCycles) / hours
+	}
+	period.Observed = period.observed.Seconds()
+	period.Partial = period.observed < time.Duration(period.End-period.Start)
+	period.Time = period.End
+	return period
+}
+
+func accumulate(period *runtimeMsg, sample *runtimeSample, running time.Duration) {
+	period.observed += running
+	seconds := running.Seconds()
+	switch sample.state {
+	case types.STATE_HEAT_STAGE2:
+		period.HeatStage2 += seconds
+		period.HeatStage1 += seconds
+	case types.STATE_HEAT_STAGE1:
+		period.HeatStage1 += seconds
+	case types.STATE_COOL_STAGE2:
+		period.CoolStage2 += seconds
+		period.CoolStage1 += seconds
+	case types.STATE_COOL_STAGE1:
+		period.CoolStage1 += seconds
+	}
+	if sample.fan {
+		period.Fan += seconds
+	}
+}
+
+func isHeating(state int32) bool {
+	return state == types.STATE_HEAT_STAGE1 || state == types.STATE_HEAT_STAGE2
+}
+
+func isCooling(state int32) bool {
+	return state == types.STATE_COOL_STAGE1 || state == types.STATE_COOL_STAGE2
+}
+
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
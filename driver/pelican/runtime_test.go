@@ -0,0 +1,105 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/SoftwareDefinedBuildings/bw2-contrib/driver/pelican/types"
+)
+
+func TestRuntimeTracker(t *testing.T) {
+	// A polled state at a time of day on 2020-01-01 ("23:50"), or the next
+	// day if marked with a leading "+"
+	type sample struct {
+		at    string
+		state int32
+		fan   bool
+	}
+	const (
+		off   = types.STATE_OFF
+		heat1 = types.STATE_HEAT_STAGE1
+		cool1 = types.STATE_COOL_STAGE1
+		cool2 = types.STATE_COOL_STAGE2
+	)
+
+	for _, test := range []struct {
+		name    string
+		samples []sample
+		want    []runtimeMsg
+	}{
+		{"partial first hour", []sample{{"10:30", off, false}, {"10:40", heat1, true}, {"10:50", off, false}, {"11:00", off, false}},
+			[]runtimeMsg{{Period: RUNTIME_PERIOD_HOURLY, HeatStage1: 600, Fan: 600, HeatCycles: 1, HeatCyclesPerHour: 2,
+				Observed: 1800, Partial: true}}},
+		{"full hour", []sample{{"09:55", off, false}, {"10:00", cool2, true}, {"10:10", cool2, true}, {"10:20", cool1, true},
+			{"10:30", cool1, true}, {"10:40", off, false}, {"10:50", off, false}, {"11:00", off, false}},
+			[]runtimeMsg{
+				{Period: RUNTIME_PERIOD_HOURLY, Observed: 300, Partial: true},
+				{Period: RUNTIME_PERIOD_HOURLY, CoolStage1: 2400, CoolStage2: 1200, Fan: 2400, CoolCycles: 1, CoolCyclesPerHour: 1,
+					Observed: 3600}}},
+		{"gap between polls", []sample{{"10:00", heat1, true}, {"10:40", heat1, false}, {"10:50", off, false}, {"11:00", off, false}},
+			[]runtimeMsg{{Period: RUNTIME_PERIOD_HOURLY, HeatStage1: 1500, Fan: 900, Observed: 2100, Partial: true}}},
+		{"midnight", []sample{{"23:50", heat1, false}, {"+00:10", off, false}},
+			[]runtimeMsg{
+				{Period: RUNTIME_PERIOD_HOURLY, HeatStage1: 600, Observed: 600, Partial: true},
+				{Period: RUNTIME_PERIOD_DAILY, HeatStage1: 600, Observed: 600, Partial: true}}},
+		{"late sample", []sample{{"10:00", heat1, false}, {"09:59", off, false}, {"10:15", heat1, false}, {"10:30", heat1, false},
+			{"10:45", heat1, false}, {"11:00", off, false}},
+			[]runtimeMsg{{Period: RUNTIME_PERIOD_HOURLY, HeatStage1: 3600, Observed: 3600}}},
+		{"idle minute", []sample{{"10:59", off, false}, {"11:00", off, false}},
+			[]runtimeMsg{{Period: RUNTIME_PERIOD_HOURLY, Observed: 60, Partial: true}}},
+	} {
+		tracker := newRuntimeTracker(time.UTC)
+		var done []*runtimeMsg
+		for _, s := range test.samples {
+			day := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+			at := s.at
+			if at[0] == '+' {
+				day, at = day.AddDate(0, 0, 1), at[1:]
+			}
+			clock, err := time.Parse("15:04", at)
+			if err != nil {
+				t.Fatal(err)
+			}
+			now := day.Add(time.Duration(clock.Hour())*time.Hour + time.Duration(clock.Minute())*time.Minute)
+			done = append(done, tracker.add(&types.PelicanStatus{State: s.state, Fan: s.fan, Time: now.UnixNano()})...)
+		}
+
+		if len(done) != len(test.want) {
+			t.Errorf("%s: completed %d periods, want %d", test.name, len(done), len(test.want))
+			continue
+		}
+		for i, got := range done {
+			want := test.want[i]
+			// Periods are compared without their bounds
+			want.Start, want.End, want.Time = got.Start, got.End, got.End
+			want.observed = got.observed
+			if *got != want {
+				t.Errorf("%s: period %d is %+v, want %+v", test.name, i, *got, want)
+			}
+		}
+	}
+}
+
+// Periods are hours and days of the thermostat's time zone
+func TestRuntimePeriods(t *testing.T) {
+	location, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker := newRuntimeTracker(location)
+	at := time.Date(2020, 3, 8, 10, 30, 0, 0, location)
+
+	hour := tracker.newPeriod(RUNTIME_PERIOD_HOURLY, at)
+	if start := time.Unix(0, hour.Start).In(location); start.Hour() != 10 || start.Minute() != 0 || hour.End-hour.Start != int64(time.Hour) {
+		t.Errorf("Hour containing %v starts at %v and lasts %v", at, start, time.Duration(hour.End-hour.Start))
+	}
+	// Clocks went forward that morning
+	day := tracker.newPeriod(RUNTIME_PERIOD_DAILY, at)
+	if start := time.Unix(0, day.Start).In(location); start.Hour() != 0 || day.End-day.Start != int64(23*time.Hour) {
+		t.Errorf("Day containing %v starts at %v and lasts %v, want midnight and 23h", at, start, time.Duration(day.End-day.Start))
+	}
+	day.observed = 23 * time.Hour
+	if day.finish().Partial {
+		t.Error("A fully observed 23 hour day is partial")
+	}
+}
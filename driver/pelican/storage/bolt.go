@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/SoftwareDefinedBuildings/bw2-contrib/driver/pelican/types"
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+var boltBucket = []byte("pelicans")
+
+// Stores each site's inventory as a JSON value keyed by site name
+type boltStore struct {
+	db *bolt.DB
+}
+
+func newBoltStore(path string) (*boltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to open BoltDB %s", path)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "Failed to create Pelican bucket")
+	}
+	return &boltStore{db: db}, nil
+}
+
+func (store *boltStore) Save(sitename string, pelicans []*types.Pelican) error {
+	bytes, err := json.Marshal(pelicans)
+	if err != nil {
+		return errors.Wrap(err, "Failed to serialize Pelicans")
+	}
+	err = store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Put([]byte(sitename), bytes)
+	})
+	return errors.Wrap(err, "Failed to write to BoltDB")
+}
+
+func (store *boltStore) Load(sitename string) ([]*types.Pelican, error) {
+	pelicans := []*types.Pelican{}
+	err := store.db.View(func(tx *bolt.Tx) error {
+		bytes := tx.Bucket(boltBucket).Get([]byte(sitename))
+		if bytes == nil {
+			return nil
+		}
+		return json.Unmarshal(bytes, &pelicans)
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to read from BoltDB")
+	}
+	return pelicans, nil
+}
@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/SoftwareDefinedBuildings/bw2-contrib/driver/pelican/types"
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Stores every site's inventory in a single local file, keyed by site name.
+// The format is YAML for .yml/.yaml paths and JSON otherwise.
+type fileStore struct {
+	path string
+}
+
+func newFileStore(path string) *fileStore {
+	return &fileStore{path: path}
+}
+
+func (store *fileStore) isYAML() bool {
+	ext := strings.ToLower(filepath.Ext(store.path))
+	return ext == ".yml" || ext == ".yaml"
+}
+
+func (store *fileStore) readAll() (map[string][]*types.Pelican, error) {
+	sites := make(map[string][]*types.Pelican)
+	contents, err := ioutil.ReadFile(store.path)
+	if os.IsNotExist(err) {
+		return sites, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "Failed to read %s", store.path)
+	}
+
+	if store.isYAML() {
+		err = yaml.Unmarshal(contents, &sites)
+	} else {
+		err = json.Unmarshal(contents, &sites)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to deserialize Pelican info from %s", store.path)
+	}
+	return sites, nil
+}
+
+func (store *fileStore) Save(sitename string, pelicans []*types.Pelican) error {
+	sites, err := store.readAll()
+	if err != nil {
+		return err
+	}
+	sites[sitename] = pelicans
+
+	var contents []byte
+	if store.isYAML() {
+		contents, err = yaml.Marshal(sites)
+	} else {
+		contents, err = json.MarshalIndent(sites, "", "  ")
+	}
+	if err != nil {
+		return errors.Wrap(err, "Failed to serialize Pelicans")
+	}
+
+	// Write to a temporary file first so a crash never leaves a truncated inventory
+	tmpPath := store.path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, contents, 0644); err != nil {
+		return errors.Wrapf(err, "Failed to write %s", tmpPath)
+	}
+	if err := os.Rename(tmpPath, store.path); err != nil {
+		return errors.Wrapf(err, "Failed to replace %s", store.path)
+	}
+	return nil
+}
+
+func (store *fileStore) Load(sitename string) ([]*types.Pelican, error) {
+	sites, err := store.readAll()
+	if err != nil {
+		return nil, err
+	}
+	if pelicans, ok := sites[sitename]; ok {
+		return pelicans, nil
+	}
+	return []*types.Pelican{}, nil
+}
@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/SoftwareDefinedBuildings/bw2-contrib/driver/pelican/types"
+	sqlTypes "github.com/jmoiron/sqlx/types"
+	_ "github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+const dbKey = "pelicans"
+
+// Stores inventories as JSON rows of a "settings" table, newest row wins
+type postgresStore struct {
+	dsn string
+}
+
+func newPostgresStore(dsn string) *postgresStore {
+	return &postgresStore{dsn: dsn}
+}
+
+func (store *postgresStore) Save(sitename string, pelicans []*types.Pelican) error {
+	bytes, err := json.Marshal(pelicans)
+	if err != nil {
+		return errors.Wrap(err, "Failed to serialize Pelicans")
+	}
+	var json sqlTypes.JSONText
+	if err := json.Scan(bytes); err != nil {
+		return errors.Wrap(err, "Failed to convert to JSON Text for SQL")
+	}
+
+	db, err := sql.Open("postgres", store.dsn)
+	if err != nil {
+		return errors.Wrap(err, "Failed to connect to database")
+	}
+	defer db.Close()
+	_, err = db.Exec("INSERT INTO SETTINGS (sitename, inserted, key, object) VALUES ($1, $2, $3, $4)",
+		sitename, time.Now(), dbKey, json)
+	if err != nil {
+		return errors.Wrap(err, "Failed to insert into database")
+	}
+
+	return nil
+}
+
+func (store *postgresStore) Load(sitename string) ([]*types.Pelican, error) {
+	db, err := sql.Open("postgres", store.dsn)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to connect to database")
+	}
+	defer db.Close()
+
+	var ob sqlTypes.JSONText
+	err = db.QueryRow("SELECT object FROM settings where sitename = $1 and key = $2 order by inserted desc limit 1;",
+		sitename, dbKey).Scan(&ob)
+	if err == sql.ErrNoRows {
+		return []*types.Pelican{}, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "Failed to read from database")
+	}
+
+	var pelicans []*types.Pelican
+	if err := ob.Unmarshal(&pelicans); err != nil {
+		return nil, errors.Wrap(err, "Failed to deserialize Pelican info")
+	}
+	return pelicans, nil
+}
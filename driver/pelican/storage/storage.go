@@ -1,75 +1,82 @@
 package storage
 
 import (
-	"database/sql"
-	"encoding/json"
-	"time"
+	"fmt"
+	"net/url"
+	"strings"
 
 	"github.com/SoftwareDefinedBuildings/bw2-contrib/driver/pelican/types"
-	sqlTypes "github.com/jmoiron/sqlx/types"
-	_ "github.com/lib/pq"
 	"github.com/pkg/errors"
 )
 
-const dbURL = "postgres://xbosreadonly@corbusier.cs.berkeley.edu:26257/xbos?sslmode=verify-full&sslrootcert=ca.crt&sslcert=client.xbosreadonly.crt&sslkey=client.xbosreadonly.key"
-const dbKey = "pelicans"
-
-func WritePelicans(pelicans []*types.Pelican, sitename string) error {
-	bytes, err := json.Marshal(pelicans)
-	if err != nil {
-		return errors.Wrap(err, "Failed to serialize Pelicans")
-	}
-	var json sqlTypes.JSONText
-	if err := json.Scan(bytes); err != nil {
-		return errors.Wrap(err, "Failed to convert to JSON Text for SQL")
-	}
+// Store persists the inventory of thermostats discovered at a site
+type Store interface {
+	// Save replaces the site's inventory
+	Save(sitename string, pelicans []*types.Pelican) error
+	// Load returns the site's most recently saved inventory, or an empty
+	// slice if none has been saved. Only exported Pelican fields are restored.
+	Load(sitename string) ([]*types.Pelican, error)
+}
 
-	db, err := sql.Open("postgres", dbURL)
-	if err != nil {
-		return errors.Wrap(err, "Failed to connect to database")
+// NewStore opens the backend named by dsn's scheme:
+//   - file://pelicans.yml or file://pelicans.json: a local YAML or JSON file
+//   - bolt://pelicans.db: an embedded BoltDB database
+//   - postgres://user@host:port/db?sslmode=...&sslrootcert=...: a Postgres
+//     "settings" table, as used by the original XBOS deployment
+func NewStore(dsn string) (Store, error) {
+	scheme := strings.SplitN(dsn, "://", 2)
+	if len(scheme) != 2 {
+		return nil, errors.Errorf("Invalid storage DSN %s", dsn)
 	}
-	_, err = db.Exec("INSERT INTO SETTINGS (sitename, inserted, key, object) VALUES ($1, $2, $3, $4)",
-		sitename, time.Now(), dbKey, json)
-	if err != nil {
-		return errors.Wrap(err, "Failed to insert into database")
+	switch scheme[0] {
+	case "file":
+		return newFileStore(scheme[1]), nil
+	case "bolt":
+		return newBoltStore(scheme[1])
+	case "postgres", "postgresql":
+		if _, err := url.Parse(dsn); err != nil {
+			return nil, errors.Wrap(err, "Invalid Postgres DSN")
+		}
+		return newPostgresStore(dsn), nil
+	default:
+		return nil, errors.Errorf("Unknown storage backend %s", scheme[0])
 	}
-
-	return nil
 }
 
-func ReadPelicans(username, password, sitename string) ([]*types.Pelican, error) {
-	db, err := sql.Open("postgres", dbURL)
-	if err != nil {
-		return nil, errors.Wrap(err, "Failed to connect to database")
-	}
+func WritePelicans(store Store, pelicans []*types.Pelican, sitename string) error {
+	return store.Save(sitename, pelicans)
+}
 
-	var ob sqlTypes.JSONText
-	err = db.QueryRow("SELECT object FROM settings where sitename = $1 and key = $2 order by inserted desc limit 1;",
-		sitename, dbKey).Scan(&ob)
+// ReadPelicans loads a site's inventory and reconnects each thermostat to the
+// Pelican API. Thermostats that can no longer be found at the site, e.g.
+// because they were removed or renamed, are skipped; any other failure, such
+// as the site being unreachable, is returned. It returns an empty slice if
+// nothing has been stored or none of it could be found.
+func ReadPelicans(store Store, username, password, sitename string) ([]*types.Pelican, error) {
+	stored, err := store.Load(sitename)
 	if err != nil {
-		return nil, errors.Wrap(err, "Failed to read from database")
-	}
-
-	var pelicans []*types.Pelican
-	if err := ob.Unmarshal(&pelicans); err != nil {
-		return nil, errors.Wrap(err, "Failed to deserialize Pelican info")
+		return nil, err
 	}
 
 	// To properly regenerate internal fields
-	for i := 0; i < len(pelicans); i++ {
+	pelicans := make([]*types.Pelican, 0, len(stored))
+	for _, pelican := range stored {
 		newPelican, err := types.NewPelican(&types.NewPelicanParams{
 			Username:      username,
 			Password:      password,
 			Sitename:      sitename,
-			Name:          pelicans[i].Name,
-			HeatingStages: pelicans[i].HeatingStages,
-			CoolingStages: pelicans[i].CoolingStages,
-			Timezone:      pelicans[i].TimezoneName,
+			Name:          pelican.Name,
+			HeatingStages: pelican.HeatingStages,
+			CoolingStages: pelican.CoolingStages,
+			Timezone:      pelican.TimezoneName,
 		})
-		if err != nil {
-			return nil, errors.Wrap(err, "Failed to instantiate Pelican")
+		if _, ok := err.(*types.NotFoundError); ok {
+			fmt.Printf("Stored Pelican %s is no longer at the site, skipping it\n", pelican.Name)
+			continue
+		} else if err != nil {
+			return nil, errors.Wrapf(err, "Failed to instantiate stored Pelican %s", pelican.Name)
 		}
-		pelicans[i] = newPelican
+		pelicans = append(pelicans, newPelican)
 	}
 	return pelicans, nil
 }
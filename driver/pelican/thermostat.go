@@ -0,0 +1,675 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SoftwareDefinedBuildings/bw2-contrib/driver/pelican/types"
+	bw2 "gopkg.in/immesys/bw2bind.v5"
+)
+
+// The BOSSWAVE interfaces of a single thermostat. Interfaces are registered
+// once, under the name the thermostat had when first seen, and are kept even
+// if the thermostat is later renamed or removed from the site.
+type thermostat struct {
+	tstatIface     *bw2.Interface
+	drIface        *bw2.Interface
+	schedIface     *bw2.Interface
+	occupancyIface *bw2.Interface
+
+	service *bw2.Service
+	// URI component all of the thermostat's interfaces are registered under
+	name string
+	// Limits on the setpoints and modes the thermostat may be given
+	policies *sitePolicy
+	holds    *holdStore
+	// Least time the thermostat is kept off while its stages change
+	minOffTime time.Duration
+	runtime    *runtimeTracker
+	// Interfaces of attached sensors, registered as they are first seen
+	sensorIfaces map[string]*bw2.Interface
+
+	lock sync.Mutex
+	// nil while the thermostat is absent from the site
+	pel *types.Pelican
+	// closed to stop the thermostat's polling loops
+	stop chan bool
+	// Most recently polled status, nil until the first poll
+	status *types.PelicanStatus
+	// When the driver last changed the thermostat's mode
+	lastModeChange time.Time
+	// Fires when the thermostat's hold ends
+	holdTimer *time.Timer
+	// Whether the thermostat's stages have been compared with the configured
+	// ones since it joined the site
+	stagesChecked bool
+
+	// Serializes starting and ending holds
+	holdLock sync.Mutex
+}
+
+// Converts a thermostat name into a valid URI component
+func interfaceName(pelicanName string) string {
+	name := strings.Replace(pelicanName, " ", "_", -1)
+	name = strings.Replace(name, "&", "_and_", -1)
+	name = strings.Replace(name, "'", "", -1)
+	return name
+}
+
+func newThermostat(service *bw2.Service, pelican *types.Pelican, policies *sitePolicy, holds *holdStore, minOffTime time.Duration) *thermostat {
+	name := interfaceName(pelican.Name)
+	fmt.Println("Transforming", pelican.Name, "=>", name)
+	location, err := time.LoadLocation(pelican.TimezoneName)
+	if err != nil {
+		location = time.Local
+	}
+	t := &thermostat{
+		tstatIface:     service.RegisterInterface(name, "i.xbos.thermostat"),
+		drIface:        service.RegisterInterface(name, "i.xbos.demand_response"),
+		schedIface:     service.RegisterInterface(name, "i.xbos.thermostat_schedule"),
+		occupancyIface: service.RegisterInterface(name, "i.xbos.occupancy"),
+		service:        service,
+		name:           name,
+		policies:       policies,
+		holds:          holds,
+		minOffTime:     minOffTime,
+		runtime:        newRuntimeTracker(location),
+		sensorIfaces:   make(map[string]*bw2.Interface),
+	}
+	t.tstatIface.SubscribeSlot("setpoints", t.handleSetpoints)
+	t.tstatIface.SubscribeSlot("state", t.handleState)
+	t.tstatIface.SubscribeSlot("stages", t.handleStages)
+	t.schedIface.SubscribeSlot("schedule", t.handleSchedule)
+	t.drIface.SubscribeSlot("opt_out", t.handleOptOut)
+	return t
+}
+
+// The Pelican currently backing this thermostat, or nil if it has been removed
+func (t *thermostat) pelican() *types.Pelican {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.pel
+}
+
+// How often a thermostat's DR status and schedule are polled
+type pollIntervals struct {
+	dr    time.Duration
+	sched time.Duration
+	// Longest time between DR signals while the DR status is unchanged
+	drHeartbeat time.Duration
+}
+
+// Attaches a Pelican and starts polling it, replacing any previous one
+func (t *thermostat) start(pelican *types.Pelican, intervals pollIntervals) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.stop != nil {
+		close(t.stop)
+	}
+	// A renamed thermostat keeps its stages, so they are only checked again
+	// when the thermostat rejoins the site
+	if t.pel == nil {
+		t.stagesChecked = false
+	}
+	t.pel = pelican
+	t.stop = make(chan bool)
+	go t.pollDR(pelican, intervals.dr, intervals.drHeartbeat, t.stop)
+	go t.pollSchedule(pelican, intervals.sched, t.stop)
+	// Pick up a hold left over from before a restart or removal
+	if expires, ok := t.holds.get(pelican.ID()); ok {
+		t.scheduleHoldEndLocked(pelican.ID(), time.Until(expires))
+	}
+}
+
+// Detaches the thermostat's Pelican and stops polling it
+func (t *thermostat) halt() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.stop != nil {
+		close(t.stop)
+		t.stop = nil
+	}
+	if t.holdTimer != nil {
+		t.holdTimer.Stop()
+		t.holdTimer = nil
+	}
+	t.pel = nil
+}
+
+// Sleeps for the given interval, returning false if stop is closed first
+func sleepUntilStopped(interval time.Duration, stop chan bool) bool {
+	select {
+	case <-stop:
+		return false
+	case <-time.After(interval):
+		return true
+	}
+}
+
+// Publishes the DR status whenever it changes, and otherwise at least once
+// per heartbeat
+func (t *thermostat) pollDR(pelican *types.Pelican, interval, heartbeat time.Duration, stop chan bool) {
+	var lastStatus *types.ADREvent
+	var lastPublished time.Time
+	for {
+		if drStatus, drErr := pelican.TrackDREvent(); drErr != nil {
+			fmt.Printf("Failed to retrieve Pelican's DR status: %v\n", drErr)
+		} else if drStatus != nil && (!drStatus.SameState(lastStatus) || time.Since(lastPublished) >= heartbeat) {
+			fmt.Printf("%s DR Status: %+v\n", pelican.Name, drStatus)
+			po, err := bw2.CreateMsgPackPayloadObject(bw2.FromDotForm(DR_PO_DF), drStatus)
+			if err != nil {
+				fmt.Printf("Failed to create DR msgpack PO: %v", err)
+			} else {
+				t.drIface.PublishSignal("info", po)
+				lastStatus = drStatus
+				lastPublished = time.Now()
+			}
+		}
+		if !sleepUntilStopped(interval, stop) {
+			return
+		}
+	}
+}
+
+func (t *thermostat) pollSchedule(pelican *types.Pelican, interval time.Duration, stop chan bool) {
+	for {
+		if schedStatus, schedErr := pelican.GetSchedule(); schedErr != nil {
+			fmt.Printf("Failed to retrieve Pelican's Schedule: %v\n", schedErr)
+		} else {
+			fmt.Printf("%s Schedule: %+v\n", pelican.Name, schedStatus)
+			po, err := bw2.CreateMsgPackPayloadObject(bw2.FromDotForm(SCHED_PO_DF), schedStatus)
+			if err != nil {
+				fmt.Printf("Failed to create Schedule msgpack PO: %v", err)
+			}
+			t.schedIface.PublishSignal("info", po)
+		}
+		if !sleepUntilStopped(interval, stop) {
+			return
+		}
+	}
+}
+
+// Publishes a thermostat's share of a site-wide poll
+func (t *thermostat) publishReading(reading *types.PelicanReading) error {
+	if reading.Status != nil {
+		t.lock.Lock()
+		pelican := t.pel
+		checkStages := !t.stagesChecked
+		t.stagesChecked = true
+		t.lock.Unlock()
+		if pelican != nil {
+			if expires, ok := t.holds.get(pelican.ID()); ok {
+				reading.Status.HoldExpires = expires.UnixNano()
+			}
+		}
+		po, err := bw2.CreateMsgPackPayloadObject(bw2.FromDotForm(TSTAT_PO_DF), reading.Status)
+		if err != nil {
+			return fmt.Errorf("Failed to create msgpack PO: %v", err)
+		}
+		t.tstatIface.PublishSignal("info", po)
+		t.lock.Lock()
+		t.status = reading.Status
+		t.lock.Unlock()
+		t.publishRuntime(t.runtime.add(reading.Status))
+
+		// Ensure thermostat is running with correct number of stages. This is
+		// usually a no-op, but may keep the thermostat off for minOffTime.
+		if checkStages && pelican != nil && (reading.Status.EnabledHeatStages != pelican.HeatingStages ||
+			reading.Status.EnabledCoolStages != pelican.CoolingStages) {
+			go t.modifyStages(pelican, &pelican.HeatingStages, &pelican.CoolingStages)
+		}
+	}
+
+	// Only publish occupancy for thermostats with the necessary sensor
+	if reading.Occupancy != types.OCCUPANCY_UNKNOWN {
+		occupancyStatus := occupancyMsg{
+			Occupancy: (reading.Occupancy == types.OCCUPANCY_OCCUPIED),
+			Time:      time.Now().UnixNano(),
+		}
+		po, err := bw2.CreateMsgPackPayloadObject(bw2.FromDotForm(OCCUPANCY_PO_DF), occupancyStatus)
+		if err != nil {
+			fmt.Printf("Failed to create occupancy msgpack PO: %s\n", err)
+		} else {
+			t.occupancyIface.PublishSignal("info", po)
+		}
+	}
+
+	for _, sensor := range reading.Sensors {
+		t.publishSensor(sensor)
+	}
+	return nil
+}
+
+// XBOS interface and PO for each kind of sensor
+var sensorInterfaces = map[string]struct {
+	iface string
+	ponum string
+}{
+	types.SENSOR_KIND_OCCUPANCY:   {"i.xbos.occupancy_sensor", OCCUPANCY_PO_DF},
+	types.SENSOR_KIND_TEMPERATURE: {"i.xbos.temperature_sensor", SENSOR_PO_DF},
+	types.SENSOR_KIND_HUMIDITY:    {"i.xbos.humidity_sensor", SENSOR_PO_DF},
+	types.SENSOR_KIND_CO2:         {"i.xbos.co2_sensor", SENSOR_PO_DF},
+}
+
+// Publishes a sensor's reading on its own interface under the thermostat's
+func (t *thermostat) publishSensor(sensor *types.PelicanSensor) {
+	sensorIface, ok := sensorInterfaces[sensor.Kind]
+	if !ok {
+		return
+	}
+
+	var msg interface{}
+	now := time.Now().UnixNano()
+	switch sensor.Kind {
+	case types.SENSOR_KIND_OCCUPANCY:
+		msg = occupancyMsg{Occupancy: sensor.Reading == 1, Time: now}
+	case types.SENSOR_KIND_TEMPERATURE:
+		msg = temperatureSensorMsg{Temperature: sensor.Reading, Time: now}
+	case types.SENSOR_KIND_HUMIDITY:
+		msg = humiditySensorMsg{RelHumidity: sensor.Reading, Time: now}
+	case types.SENSOR_KIND_CO2:
+		msg = co2SensorMsg{CO2: sensor.Reading, Time: now}
+	}
+	po, err := bw2.CreateMsgPackPayloadObject(bw2.FromDotForm(sensorIface.ponum), msg)
+	if err != nil {
+		fmt.Printf("Failed to create sensor msgpack PO: %v\n", err)
+		return
+	}
+
+	key := sensorIface.iface + "/" + sensor.Name
+	t.lock.Lock()
+	iface, ok := t.sensorIfaces[key]
+	if !ok {
+		iface = t.service.RegisterInterface(t.name+"/"+interfaceName(sensor.Name), sensorIface.iface)
+		t.sensorIfaces[key] = iface
+	}
+	t.lock.Unlock()
+	iface.PublishSignal("info", po)
+}
+
+// Republishes the thermostat's recent history with the original timestamps,
+// filling the gap left in archived data while the driver was down
+func (t *thermostat) backfill(pelican *types.Pelican, window time.Duration) {
+	end := time.Now()
+	records, err := pelican.GetHistory(end.Add(-window), end)
+	if err != nil {
+		fmt.Printf("Failed to retrieve history for thermostat %s: %v\n", pelican.Name, err)
+		return
+	}
+	for _, record := range records {
+		po, err := bw2.CreateMsgPackPayloadObject(bw2.FromDotForm(TSTAT_PO_DF), record)
+		if err != nil {
+			fmt.Printf("Failed to create history msgpack PO: %v\n", err)
+			return
+		}
+		t.tstatIface.PublishSignal("history", po)
+	}
+	fmt.Printf("Backfilled %d history records for thermostat %s\n", len(records), pelican.Name)
+}
+
+func (t *thermostat) publishRuntime(periods []*runtimeMsg) {
+	for _, period := range periods {
+		po, err := bw2.CreateMsgPackPayloadObject(bw2.FromDotForm(TSTAT_PO_DF), period)
+		if err != nil {
+			fmt.Printf("Failed to create runtime msgpack PO: %v\n", err)
+			return
+		}
+		t.tstatIface.PublishSignal("runtime", po)
+	}
+}
+
+func (t *thermostat) handleSetpoints(msg *bw2.SimpleMessage) {
+	pelican := t.pelican()
+	if pelican == nil {
+		fmt.Println("Received message on setpoints slot for removed thermostat. Dropping.")
+		return
+	}
+	po := msg.GetOnePODF(TSTAT_PO_DF)
+	if po == nil {
+		fmt.Println("Received message on setpoints slot without required PO. Droping.")
+		return
+	}
+
+	var setpoints setpointsMsg
+	if err := po.(bw2.MsgPackPayloadObject).ValueInto(&setpoints); err != nil {
+		fmt.Println("Received malformed PO on setpoints slot. Dropping.", err)
+		return
+	}
+
+	cmd, result := t.checkPolicy(pelican, actuation{
+		HeatingSetpoint: setpoints.HeatingSetpoint,
+		CoolingSetpoint: setpoints.CoolingSetpoint,
+		HoldDuration:    setpoints.HoldDuration,
+	})
+	if cmd == nil {
+		fmt.Printf("Rejected setpoints for %s: %v\n", pelican.Name, result.Reasons)
+		t.publishActuationResult("setpoints", result)
+		return
+	}
+
+	var err error
+	if cmd.HoldDuration != nil {
+		// Setpoints only stick until the next scheduled block unless the
+		// schedule is overridden
+		override := float64(1)
+		err = pelican.ModifyState(&types.PelicanStateParams{
+			HeatingSetpoint: cmd.HeatingSetpoint,
+			CoolingSetpoint: cmd.CoolingSetpoint,
+			Override:        &override,
+		})
+	} else {
+		err = pelican.ModifySetpoints(&types.PelicanSetpointParams{
+			HeatingSetpoint: cmd.HeatingSetpoint,
+			CoolingSetpoint: cmd.CoolingSetpoint,
+		})
+	}
+	if err != nil {
+		fmt.Println(err)
+		result.Result = ACTUATION_FAILED
+		result.Reasons = append(result.Reasons, err.Error())
+	} else {
+		fmt.Printf("Set heating setpoint to %v and cooling setpoint to %v\n",
+			cmd.HeatingSetpoint, cmd.CoolingSetpoint)
+		if cmd.HoldDuration != nil {
+			t.startHold(pelican, time.Duration(*cmd.HoldDuration)*time.Second)
+		}
+	}
+	t.publishActuationResult("setpoints", result)
+}
+
+func (t *thermostat) handleState(msg *bw2.SimpleMessage) {
+	pelican := t.pelican()
+	if pelican == nil {
+		fmt.Println("Received message on state slot for removed thermostat. Dropping.")
+		return
+	}
+	po := msg.GetOnePODF(TSTAT_PO_DF)
+	if po == nil {
+		fmt.Println("Received message on state slot without required PO. Dropping.")
+		return
+	}
+
+	var state stateMsg
+	if err := po.(bw2.MsgPackPayloadObject).ValueInto(&state); err != nil {
+		fmt.Println("Received malformed PO on state slot. Dropping.", err)
+		return
+	}
+
+	cmd, result := t.checkPolicy(pelican, actuation{
+		HeatingSetpoint: state.HeatingSetpoint,
+		CoolingSetpoint: state.CoolingSetpoint,
+		Mode:            state.Mode,
+		HoldDuration:    state.HoldDuration,
+	})
+	if cmd == nil {
+		fmt.Printf("Rejected state for %s: %v\n", pelican.Name, result.Reasons)
+		t.publishActuationResult("state", result)
+		return
+	}
+
+	params := types.PelicanStateParams{
+		HeatingSetpoint: cmd.HeatingSetpoint,
+		CoolingSetpoint: cmd.CoolingSetpoint,
+	}
+	fmt.Printf("%+v", state)
+	if cmd.Mode != nil {
+		m := float64(*cmd.Mode)
+		params.Mode = &m
+	}
+
+	if (state.Override != nil && *state.Override) || cmd.HoldDuration != nil {
+		f := float64(1)
+		params.Override = &f
+	} else {
+		f := float64(0)
+		params.Override = &f
+	}
+
+	if state.Fan != nil && *state.Fan {
+		f := float64(1)
+		params.Fan = &f
+	} else {
+		f := float64(0)
+		params.Fan = &f
+	}
+
+	if err := pelican.ModifyState(&params); err != nil {
+		fmt.Println(err)
+		result.Result = ACTUATION_FAILED
+		result.Reasons = append(result.Reasons, err.Error())
+	} else {
+		fmt.Printf("Set Pelican state to: %+v\n", params)
+		// Any other state replaces the hold, whether by returning to the
+		// schedule or by overriding it indefinitely
+		if cmd.HoldDuration != nil {
+			t.startHold(pelican, time.Duration(*cmd.HoldDuration)*time.Second)
+		} else {
+			t.endHold(pelican)
+		}
+		if cmd.Mode != nil {
+			t.lock.Lock()
+			if t.status == nil || int(t.status.Mode) != *cmd.Mode {
+				t.lastModeChange = time.Now()
+			}
+			t.lock.Unlock()
+		}
+	}
+	t.publishActuationResult("state", result)
+}
+
+// Holds the thermostat's current state for the given duration, after which
+// it returns to its schedule
+func (t *thermostat) startHold(pelican *types.Pelican, duration time.Duration) {
+	t.holdLock.Lock()
+	defer t.holdLock.Unlock()
+	if err := t.holds.set(pelican.ID(), time.Now().Add(duration)); err != nil {
+		fmt.Printf("Failed to save hold for thermostat %s: %v\n", pelican.Name, err)
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.scheduleHoldEndLocked(pelican.ID(), duration)
+	fmt.Printf("Holding thermostat %s for %v\n", pelican.Name, duration)
+}
+
+// Forgets the thermostat's hold without touching the thermostat
+func (t *thermostat) endHold(pelican *types.Pelican) {
+	t.holdLock.Lock()
+	defer t.holdLock.Unlock()
+	if err := t.holds.clear(pelican.ID()); err != nil {
+		fmt.Printf("Failed to clear hold for thermostat %s: %v\n", pelican.Name, err)
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.holdTimer != nil {
+		t.holdTimer.Stop()
+		t.holdTimer = nil
+	}
+}
+
+// Arranges for the thermostat to return to its schedule after delay,
+// replacing any earlier arrangement. Callers must hold t.lock.
+func (t *thermostat) scheduleHoldEndLocked(id string, delay time.Duration) {
+	if t.holdTimer != nil {
+		t.holdTimer.Stop()
+	}
+	t.holdTimer = time.AfterFunc(delay, func() { t.revertHold(id) })
+}
+
+// Returns the thermostat to its schedule if its hold is over, retrying
+// until the thermostat accepts
+func (t *thermostat) revertHold(id string) {
+	t.holdLock.Lock()
+	defer t.holdLock.Unlock()
+	pelican := t.pelican()
+	expires, ok := t.holds.get(id)
+	if pelican == nil || pelican.ID() != id || !ok {
+		return
+	}
+	if wait := time.Until(expires); wait > 0 {
+		// Superseded by a longer hold
+		t.lock.Lock()
+		t.scheduleHoldEndLocked(id, wait)
+		t.lock.Unlock()
+		return
+	}
+
+	override := float64(0)
+	if err := pelican.ModifyState(&types.PelicanStateParams{Override: &override}); err != nil {
+		fmt.Printf("Failed to end hold on thermostat %s, retrying in %v: %v\n", pelican.Name, holdRetryInterval, err)
+		t.lock.Lock()
+		if t.pel == pelican {
+			t.scheduleHoldEndLocked(id, holdRetryInterval)
+		}
+		t.lock.Unlock()
+		return
+	}
+	fmt.Printf("Hold on thermostat %s ended, returned to schedule\n", pelican.Name)
+	if err := t.holds.clear(id); err != nil {
+		fmt.Printf("Failed to clear hold for thermostat %s: %v\n", pelican.Name, err)
+	}
+}
+
+// Checks a command against the thermostat's policy, returning what to apply
+// (nil if the command was rejected) and the result to report
+func (t *thermostat) checkPolicy(pelican *types.Pelican, cmd actuation) (*actuation, *actuationResultMsg) {
+	t.lock.Lock()
+	status := t.status
+	lastModeChange := t.lastModeChange
+	t.lock.Unlock()
+	if status == nil {
+		// Not polled yet, so ask the thermostat directly
+		status, _ = pelican.GetStatus()
+	}
+	return t.policies.forThermostat(pelican.Name).check(cmd, status, lastModeChange)
+}
+
+func (t *thermostat) publishActuationResult(slot string, result *actuationResultMsg) {
+	result.Slot = slot
+	po, err := bw2.CreateMsgPackPayloadObject(bw2.FromDotForm(TSTAT_PO_DF), result)
+	if err != nil {
+		fmt.Printf("Failed to create actuation result msgpack PO: %v\n", err)
+		return
+	}
+	t.tstatIface.PublishSignal("actuation_result", po)
+}
+
+func (t *thermostat) handleStages(msg *bw2.SimpleMessage) {
+	pelican := t.pelican()
+	if pelican == nil {
+		fmt.Println("Received message on stage slot for removed thermostat. Dropping.")
+		return
+	}
+	po := msg.GetOnePODF(TSTAT_PO_DF)
+	if po == nil {
+		fmt.Println("Received message on stage slot without required PO. Dropping.")
+		return
+	}
+
+	var stages stageMsg
+	if err := po.(bw2.MsgPackPayloadObject).ValueInto(&stages); err != nil {
+		fmt.Println("Received malformed PO on stage slot. Dropping.", err)
+		return
+	}
+	if stages.HeatingStages == nil && stages.CoolingStages == nil {
+		fmt.Println("Received message on stage slot with no content. Dropping.")
+		return
+	}
+
+	t.modifyStages(pelican, stages.HeatingStages, stages.CoolingStages)
+}
+
+// Changes the thermostat's stages, publishing a record of any change made
+func (t *thermostat) modifyStages(pelican *types.Pelican, heatingStages, coolingStages *int32) {
+	change, err := pelican.ModifyStages(&types.PelicanStageParams{
+		HeatingStages: heatingStages,
+		CoolingStages: coolingStages,
+		MinOffTime:    t.minOffTime,
+	})
+	if err != nil {
+		fmt.Printf("Failed to configure heating/cooling stages for pelican %s: %s\n", pelican.Name, err)
+	}
+	if change == nil {
+		return
+	}
+	fmt.Printf("Changed stages of pelican %s: %+v\n", pelican.Name, change)
+
+	po, poErr := bw2.CreateMsgPackPayloadObject(bw2.FromDotForm(TSTAT_PO_DF), change)
+	if poErr != nil {
+		fmt.Printf("Failed to create stage change msgpack PO: %v\n", poErr)
+		return
+	}
+	t.tstatIface.PublishSignal("stage_change", po)
+	if !change.Restored {
+		// Nobody may be watching stdout, and the building is now without HVAC
+		t.tstatIface.PublishSignal("alert", po)
+	}
+}
+
+func (t *thermostat) handleSchedule(msg *bw2.SimpleMessage) {
+	pelican := t.pelican()
+	if pelican == nil {
+		fmt.Println("Received message on schedule slot for removed thermostat. Dropping.")
+		return
+	}
+	po := msg.GetOnePODF(SCHED_PO_DF)
+	if po == nil {
+		fmt.Println("Received message on stage slot without required PO. Dropping.")
+		return
+	}
+
+	var schedule types.ThermostatSchedule
+	if err := po.(bw2.MsgPackPayloadObject).ValueInto(&schedule); err != nil {
+		fmt.Println("Received malformed PO on stage slot. Dropping.", err)
+		return
+	}
+	if schedule.DaySchedules == nil {
+		fmt.Println("Received message on stage slot with no content. Dropping.")
+		return
+	}
+
+	report, err := pelican.SetSchedule(&schedule)
+	if err != nil {
+		fmt.Println(err)
+	} else {
+		fmt.Printf("Set pelican schedule to: %v\n", schedule)
+	}
+	fmt.Printf("Schedule changes for %s: %+v\n", pelican.Name, report)
+
+	po, poErr := bw2.CreateMsgPackPayloadObject(bw2.FromDotForm(SCHED_PO_DF), report)
+	if poErr != nil {
+		fmt.Printf("Failed to create schedule report msgpack PO: %v\n", poErr)
+		return
+	}
+	t.schedIface.PublishSignal("schedule_report", po)
+}
+
+func (t *thermostat) handleOptOut(msg *bw2.SimpleMessage) {
+	pelican := t.pelican()
+	if pelican == nil {
+		fmt.Println("Received message on opt_out slot for removed thermostat. Dropping.")
+		return
+	}
+	po := msg.GetOnePODF(DR_PO_DF)
+	if po == nil {
+		fmt.Println("Received message on opt_out slot without required PO. Dropping.")
+		return
+	}
+
+	var optOut optOutMsg
+	if err := po.(bw2.MsgPackPayloadObject).ValueInto(&optOut); err != nil {
+		fmt.Println("Received malformed PO on opt_out slot. Dropping.", err)
+		return
+	}
+	if optOut.OptOut == nil {
+		fmt.Println("Received message on opt_out slot with no content. Dropping.")
+		return
+	}
+
+	if err := pelican.SetDROptOut(*optOut.OptOut); err != nil {
+		fmt.Println(err)
+	} else {
+		fmt.Printf("Set site DR opt-out to: %v\n", *optOut.OptOut)
+	}
+}
@@ -32,28 +32,38 @@ type ADREventWrapperAPI struct {
 }
 
 type ADREventAPI struct {
-	End    string `xml:"OpenADREventEnd"`
-	Start  string `xml:"OpenADREventStart"`
-	Status string `xml:"OpenADRStatus"`
-	Type   string `xml:"OpenADREventType"`
+	End         string `xml:"OpenADREventEnd"`
+	Start       string `xml:"OpenADREventStart"`
+	Status      string `xml:"OpenADRStatus"`
+	Type        string `xml:"OpenADREventType"`
+	ID          string `xml:"OpenADREventId"`
+	SignalLevel int32  `xml:"OpenADRSignalLevel"`
+	OptOut      string `xml:"OpenADROptOut"`
 }
 
 type ADREvent struct {
-	EventEnd   int64           `msgpack:"event_end"`
-	EventStart int64           `msgpack:"event_start"`
-	EventType  DR_EVENT_TYPE   `msgpack:"event_type"`
-	DRStatus   DR_EVENT_STATUS `msgpack:"dr_status"`
-	Time       int64           `msgpack:"time"`
+	EventEnd    int64           `msgpack:"event_end"`
+	EventStart  int64           `msgpack:"event_start"`
+	EventType   DR_EVENT_TYPE   `msgpack:"event_type"`
+	DRStatus    DR_EVENT_STATUS `msgpack:"dr_status"`
+	EventID     string          `msgpack:"event_id"`
+	SignalLevel int32           `msgpack:"signal_level"`
+	OptedOut    bool            `msgpack:"opted_out"`
+	Time        int64           `msgpack:"time"`
+}
+
+// SameState reports whether two events differ only in when they were observed
+func (event *ADREvent) SameState(other *ADREvent) bool {
+	if event == nil || other == nil {
+		return event == other
+	}
+	a, b := *event, *other
+	a.Time, b.Time = 0, 0
+	return a == b
 }
 
 func (pel *Pelican) TrackDREvent() (*ADREvent, error) {
-	resp, _, errs := pel.drReq.Get(pel.target).
-		Param("username", pel.username).
-		Param("password", pel.password).
-		Param("request", "get").
-		Param("object", "Site").
-		Param("value", "OpenADREventEnd;OpenADREventStart;OpenADRStatus;OpenADREventType").
-		End()
+	resp, errs := pel.session.api("get", "Site", "", "OpenADREventEnd;OpenADREventStart;OpenADRStatus;OpenADREventType;OpenADREventId;OpenADRSignalLevel;OpenADROptOut")
 
 	if errs != nil {
 		return nil, fmt.Errorf("Error retrieving thermostat demand-response status from %s: %v", pel.target, errs)
@@ -98,11 +108,38 @@ func (pel *Pelican) TrackDREvent() (*ADREvent, error) {
 	}
 	output.EventType = eventType
 
+	output.EventID = event.ID
+	output.SignalLevel = event.SignalLevel
+	output.OptedOut = event.OptOut == "Yes"
 	output.Time = time.Now().UnixNano()
 
 	return &output, nil
 }
 
+// SetDROptOut opts the site out of (or back into) OpenADR events
+func (pel *Pelican) SetDROptOut(optOut bool) error {
+	value := "OpenADROptOut:No;"
+	if optOut {
+		value = "OpenADROptOut:Yes;"
+	}
+	resp, errs := pel.session.api("set", "Site", "", value)
+
+	if errs != nil {
+		return fmt.Errorf("Error setting demand-response opt-out on %s: %v", pel.target, errs)
+	}
+
+	defer resp.Body.Close()
+	var result apiResult
+	dec := xml.NewDecoder(resp.Body)
+	if err := dec.Decode(&result); err != nil {
+		return fmt.Errorf("Failed to decode response XML: %v", err)
+	}
+	if result.Success == 0 {
+		return fmt.Errorf("Error setting demand-response opt-out on %s: %s", resp.Request.URL, result.Message)
+	}
+	return nil
+}
+
 func drTimeToUnix(DRTime string, timezone *time.Location) (int64, error) {
 	// Time field is empty or nil
 	if len(DRTime) == 0 {
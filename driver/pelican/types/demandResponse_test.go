@@ -0,0 +1,79 @@
+package types
+
+import (
+	"testing"
+	"time"
+
+	"github.com/SoftwareDefinedBuildings/bw2-contrib/driver/pelican/fakecloud"
+)
+
+func TestTrackDREvent(t *testing.T) {
+	cloud, pelicans := newTestSite(t, fakecloud.Thermostat{Name: "Office"})
+	defer cloud.Close()
+	office := pelicans["Office"]
+
+	event, err := office.TrackDREvent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.DRStatus != DR_EVENT_STATUS_INACTIVE || event.EventType != DR_EVENT_TYPE_NO_EVENT || event.EventStart != 0 {
+		t.Errorf("Event without a DR event is %+v, want inactive", event)
+	}
+
+	// The API reports times to the minute in the site's time zone
+	start := time.Now().Truncate(time.Minute).Add(time.Hour)
+	end := start.Add(2 * time.Hour)
+	cloud.SetDREvent(fakecloud.DREvent{Start: start, End: end, Status: "Active", Type: "High"})
+	if event, err = office.TrackDREvent(); err != nil {
+		t.Fatal(err)
+	}
+	if event.EventStart != start.UnixNano() || event.EventEnd != end.UnixNano() ||
+		event.DRStatus != DR_EVENT_STATUS_ACTIVE || event.EventType != DR_EVENT_TYPE_HIGH {
+		t.Errorf("Event is %+v, want an active high event from %v to %v", event, start, end)
+	}
+}
+
+func TestDREventDetails(t *testing.T) {
+	cloud, pelicans := newTestSite(t, fakecloud.Thermostat{Name: "Office"})
+	defer cloud.Close()
+	office := pelicans["Office"]
+
+	cloud.SetDREvent(fakecloud.DREvent{ID: "event-1", Status: "Active", Type: "Moderate", SignalLevel: 3})
+	event, err := office.TrackDREvent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.EventID != "event-1" || event.SignalLevel != 3 || event.OptedOut {
+		t.Errorf("Event is %+v, want event-1 at signal level 3", event)
+	}
+
+	// Only a change in the event itself is a new state
+	again, err := office.TrackDREvent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !event.SameState(again) {
+		t.Errorf("Events %+v and %+v differ, want the same state", event, again)
+	}
+
+	if err := office.SetDROptOut(true); err != nil {
+		t.Fatal(err)
+	}
+	if !cloud.DREvent().OptOut {
+		t.Error("SetDROptOut did not opt the site out")
+	}
+	optedOut, err := office.TrackDREvent()
+	if err != nil || !optedOut.OptedOut {
+		t.Fatalf("Event after opting out is %+v, %v; want opted out", optedOut, err)
+	}
+	if event.SameState(optedOut) {
+		t.Error("Opting out did not change the event's state")
+	}
+
+	if err := office.SetDROptOut(false); err != nil {
+		t.Fatal(err)
+	}
+	if cloud.DREvent().OptOut {
+		t.Error("SetDROptOut did not opt the site back in")
+	}
+}
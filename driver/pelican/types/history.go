@@ -0,0 +1,90 @@
+package types
+
+import (
+	"encoding/xml"
+	"fmt"
+	"time"
+)
+
+// ThermostatHistory attributes needed to build a PelicanHistoryRecord
+const historyValues = "timestamp;temperature;humidity;heatSetting;coolSetting;system;runStatus"
+
+// Longest time range requested from the API at once
+const historyChunk = 24 * time.Hour
+
+// A past sample of a thermostat's state. Field names match PelicanStatus so
+// both can be archived into the same streams.
+type PelicanHistoryRecord struct {
+	Temperature     float64 `msgpack:"temperature"`
+	RelHumidity     float64 `msgpack:"relative_humidity"`
+	HeatingSetpoint float64 `msgpack:"heating_setpoint"`
+	CoolingSetpoint float64 `msgpack:"cooling_setpoint"`
+	Mode            int32   `msgpack:"mode"`
+	State           int32   `msgpack:"state"`
+	// Unit of all temperatures in this message, always TEMP_UNIT_FAHRENHEIT
+	TemperatureUnit string `msgpack:"temperature_unit"`
+	// When the sample was taken, rather than when it was retrieved
+	Time int64 `msgpack:"time"`
+}
+
+// GetHistory retrieves the thermostat's history records between start and
+// end, oldest first
+func (pel *Pelican) GetHistory(start, end time.Time) ([]*PelicanHistoryRecord, error) {
+	var records []*PelicanHistoryRecord
+	for chunkStart := start; chunkStart.Before(end); chunkStart = chunkStart.Add(historyChunk) {
+		chunkEnd := chunkStart.Add(historyChunk)
+		if chunkEnd.After(end) {
+			chunkEnd = end
+		}
+		chunk, err := pel.getHistoryChunk(chunkStart, chunkEnd)
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range chunk {
+			// Chunk boundaries are inclusive, so skip records already seen
+			if len(records) > 0 && record.Time <= records[len(records)-1].Time {
+				continue
+			}
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+func (pel *Pelican) getHistoryChunk(start, end time.Time) ([]*PelicanHistoryRecord, error) {
+	resp, errs := pel.session.api("get", "ThermostatHistory", fmt.Sprintf("name:%s;startDateTime:%s;endDateTime:%s;", pel.Name,
+		start.In(pel.timezone).Format(time.RFC3339), end.In(pel.timezone).Format(time.RFC3339)), historyValues)
+	if errs != nil {
+		return nil, fmt.Errorf("Error retrieving thermostat history from %s: %v", pel.target, errs)
+	}
+	defer resp.Body.Close()
+
+	var result apiResultHistory
+	dec := xml.NewDecoder(resp.Body)
+	if err := dec.Decode(&result); err != nil {
+		return nil, fmt.Errorf("Failed to decode response XML: %v", err)
+	}
+	if result.Success == 0 {
+		return nil, fmt.Errorf("Error retrieving thermostat history from %s: %s", resp.Request.URL, result.Message)
+	}
+
+	records := make([]*PelicanHistoryRecord, 0, len(result.Records.History))
+	for _, history := range result.Records.History {
+		timestamp, err := time.ParseInLocation("2006-01-02T15:04", history.TimeStamp, pel.timezone)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing %v into Time struct: %v", history.TimeStamp, err)
+		}
+		records = append(records, &PelicanHistoryRecord{
+			Temperature:     pel.toFahrenheit(history.Temperature),
+			RelHumidity:     float64(history.RelHumidity),
+			HeatingSetpoint: pel.toFahrenheit(history.HeatSetting),
+			CoolingSetpoint: pel.toFahrenheit(history.CoolSetting),
+			Mode:            modeNameMappings[history.System],
+			// Anything but an active stage is reported as off, as for PelicanStatus
+			State:           stateMappings[history.RunStatus],
+			TemperatureUnit: TEMP_UNIT_FAHRENHEIT,
+			Time:            timestamp.UnixNano(),
+		})
+	}
+	return records, nil
+}
@@ -0,0 +1,55 @@
+package types
+
+import (
+	"testing"
+	"time"
+
+	"github.com/SoftwareDefinedBuildings/bw2-contrib/driver/pelican/fakecloud"
+)
+
+func TestGetHistory(t *testing.T) {
+	location, err := time.LoadLocation(testTimezone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Records every 6 hours across 3 days, so some fall on chunk boundaries
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, location)
+	var history []fakecloud.HistoryRecord
+	for at := start; !at.After(start.Add(3 * historyChunk)); at = at.Add(6 * time.Hour) {
+		history = append(history, fakecloud.HistoryRecord{Timestamp: at, Temperature: 70, HeatSetting: 65,
+			CoolSetting: 75, System: "Cool", RunStatus: "Cool-Stage2"})
+	}
+	cloud, pelicans := newTestSite(t, fakecloud.Thermostat{Name: "Office", History: history})
+	defer cloud.Close()
+	office := pelicans["Office"]
+
+	before := cloud.RequestCount()
+	records, err := office.GetHistory(start, start.Add(3*historyChunk))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := cloud.RequestCount() - before; n != 3 {
+		t.Errorf("Retrieving 3 days of history took %d requests, want 3", n)
+	}
+	if len(records) != len(history) {
+		t.Fatalf("Retrieved %d records, want %d without duplicates", len(records), len(history))
+	}
+	for i, record := range records {
+		if want := history[i].Timestamp.UnixNano(); record.Time != want {
+			t.Errorf("Record %d is from %v, want %v", i, time.Unix(0, record.Time), history[i].Timestamp)
+		}
+	}
+	if first := records[0]; first.Temperature != 70 || first.HeatingSetpoint != 65 || first.CoolingSetpoint != 75 ||
+		first.Mode != 2 || first.State != STATE_COOL_STAGE2 || first.TemperatureUnit != TEMP_UNIT_FAHRENHEIT {
+		t.Errorf("First record is %+v, want cooling in stage 2 at 70F", first)
+	}
+
+	// A window shorter than a chunk takes a single request
+	before = cloud.RequestCount()
+	if records, err = office.GetHistory(start.Add(time.Hour), start.Add(13*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if n := cloud.RequestCount() - before; n != 1 || len(records) != 2 {
+		t.Errorf("Retrieving 12 hours of history took %d requests for %d records, want 1 for 2", n, len(records))
+	}
+}
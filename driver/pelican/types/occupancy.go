@@ -29,14 +29,7 @@ type childSensor struct {
 }
 
 func (pel *Pelican) GetOccupancy() (int, error) {
-	resp, _, errs := pel.occupancyReq.Get(pel.target).
-		Param("username", pel.username).
-		Param("password", pel.password).
-		Param("request", "get").
-		Param("object", "thermostat").
-		Param("selection", fmt.Sprintf("name:%s;", pel.Name)).
-		Param("value", "slaves;").
-		End()
+	resp, errs := pel.session.api("get", "thermostat", fmt.Sprintf("name:%s;", pel.Name), "slaves;")
 
 	if errs != nil {
 		return 0, fmt.Errorf("Error retrieving thermostat occupancy data: %s", errs)
@@ -52,8 +45,13 @@ func (pel *Pelican) GetOccupancy() (int, error) {
 		return 0, fmt.Errorf("Error retrieving thermostat occupancy data: %s", occResp.Message)
 	}
 
+	return occupancyFromSensors(occResp.Thermostat.Sensors), nil
+}
+
+// Reads the first occupancy sensor among a thermostat's slaves
+func occupancyFromSensors(sensors []childSensor) int {
 	status := OCCUPANCY_UNKNOWN
-	for _, sensor := range occResp.Thermostat.Sensors {
+	for _, sensor := range sensors {
 		if strings.ToLower(sensor.Type) == "occupancy sensor" {
 			if strings.ToLower(sensor.Value) == "occupied" {
 				status = OCCUPANCY_OCCUPIED
@@ -63,5 +61,5 @@ func (pel *Pelican) GetOccupancy() (int, error) {
 			break
 		}
 	}
-	return status, nil
+	return status
 }
@@ -0,0 +1,34 @@
+package types
+
+import (
+	"testing"
+
+	"github.com/SoftwareDefinedBuildings/bw2-contrib/driver/pelican/fakecloud"
+)
+
+func TestGetOccupancy(t *testing.T) {
+	cloud, pelicans := newTestSite(t,
+		fakecloud.Thermostat{Name: "Office", Slaves: []fakecloud.Slave{
+			{Name: "Supply", Type: "Temperature Sensor", Value: "55"},
+			{Name: "Desk", Type: "Occupancy Sensor", Value: "Occupied"},
+		}},
+		fakecloud.Thermostat{Name: "Lobby", Slaves: []fakecloud.Slave{
+			{Name: "Door", Type: "Occupancy Sensor", Value: "Unoccupied"},
+		}},
+		fakecloud.Thermostat{Name: "Closet"})
+	defer cloud.Close()
+
+	for name, want := range map[string]int{
+		"Office": OCCUPANCY_OCCUPIED,
+		"Lobby":  OCCUPANCY_UNOCCUPIED,
+		"Closet": OCCUPANCY_UNKNOWN,
+	} {
+		occupancy, err := pelicans[name].GetOccupancy()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if occupancy != want {
+			t.Errorf("%s has occupancy %d, want %d", name, occupancy, want)
+		}
+	}
+}
@@ -3,11 +3,8 @@ package types
 import (
 	"encoding/xml"
 	"fmt"
-	"net/http"
 	"strings"
 	"time"
-
-	"github.com/parnurzeal/gorequest"
 )
 
 var modeNameMappings = map[string]int32{
@@ -18,33 +15,35 @@ var modeNameMappings = map[string]int32{
 }
 var modeValMappings = []string{"Off", "Heat", "Cool", "Auto"}
 
+// Values of PelicanStatus.State
+const (
+	STATE_OFF         int32 = 0
+	STATE_HEAT_STAGE1 int32 = 1
+	STATE_COOL_STAGE1 int32 = 2
+	STATE_HEAT_STAGE2 int32 = 4
+	STATE_COOL_STAGE2 int32 = 5
+)
+
 var stateMappings = map[string]int32{
-	"Off":         0,
-	"Heat-Stage1": 1,
-	"Heat-Stage2": 4,
-	"Cool-Stage1": 2,
-	"Cool-Stage2": 5,
+	"Off":         STATE_OFF,
+	"Heat-Stage1": STATE_HEAT_STAGE1,
+	"Heat-Stage2": STATE_HEAT_STAGE2,
+	"Cool-Stage1": STATE_COOL_STAGE1,
+	"Cool-Stage2": STATE_COOL_STAGE2,
 }
 
-// TODO Support case where the thermostat is configured to use Celsius
-
 type Pelican struct {
-	username      string
-	password      string
-	sitename      string
 	id            string
 	Name          string
 	HeatingStages int32
 	CoolingStages int32
 	TimezoneName  string
 	target        string
-	cookieTime    time.Time
-	timezone      *time.Location
-	cookie        *http.Cookie
-	req           *gorequest.SuperAgent
-	drReq         *gorequest.SuperAgent
-	occupancyReq  *gorequest.SuperAgent
-	scheduleReq   *gorequest.SuperAgent
+	// Unit the thermostat reports and accepts temperatures in
+	temperatureUnit string
+	timezone        *time.Location
+	// Shared with every other thermostat at the site
+	session *session
 }
 
 type PelicanStatus struct {
@@ -58,7 +57,12 @@ type PelicanStatus struct {
 	State             int32   `msgpack:"state"`
 	EnabledHeatStages int32   `msgpack:"enabled_heat_stages"`
 	EnabledCoolStages int32   `msgpack:"enabled_cool_stages"`
-	Time              int64   `msgpack:"time"`
+	// Unit of all temperatures in this message, always TEMP_UNIT_FAHRENHEIT
+	TemperatureUnit string `msgpack:"temperature_unit"`
+	// When the driver returns the thermostat to its schedule (UnixNano), or 0
+	// without a timed hold. Left for the driver to fill in.
+	HoldExpires int64 `msgpack:"hold_expires"`
+	Time        int64 `msgpack:"time"`
 }
 
 type PelicanSetpointParams struct {
@@ -77,8 +81,35 @@ type PelicanStateParams struct {
 type PelicanStageParams struct {
 	HeatingStages *int32
 	CoolingStages *int32
+	// Least time the thermostat is kept off while its stages change, so the
+	// compressor isn't restarted too soon after stopping
+	MinOffTime time.Duration
 }
 
+// PelicanStageChange records a stage change made by ModifyStages
+type PelicanStageChange struct {
+	PreviousHeatStages int32 `msgpack:"previous_heat_stages"`
+	PreviousCoolStages int32 `msgpack:"previous_cool_stages"`
+	HeatStages         int32 `msgpack:"heat_stages"`
+	CoolStages         int32 `msgpack:"cool_stages"`
+	// Mode the thermostat was in before the change
+	Mode int32 `msgpack:"mode"`
+	// False if the thermostat was left off because its mode couldn't be restored
+	Restored bool `msgpack:"restored"`
+	// Empty if the change succeeded
+	Error string `msgpack:"error"`
+	Time  int64  `msgpack:"time"`
+}
+
+// Attempts at restoring a thermostat's mode after a stage change, and the
+// delay between them (a variable so tests needn't wait)
+const stageRestoreAttempts = 5
+
+var stageRestoreRetryDelay = 10 * time.Second
+
+// Thermostat object attributes needed to build a PelicanStatus
+const statusValues = "temperature;humidity;heatSetting;coolSetting;setBy;HeatNeedsFan;system;runStatus;statusDisplay;schedule;heatStages;coolStages"
+
 // Thermostat Object API Result Structs
 type apiResult struct {
 	Thermostat apiThermostat `xml:"Thermostat"`
@@ -89,8 +120,8 @@ type apiResult struct {
 type apiThermostat struct {
 	Temperature     float64 `xml:"temperature"`
 	RelHumidity     int32   `xml:"humidity"`
-	HeatingSetpoint int32   `xml:"heatSetting"`
-	CoolingSetpoint int32   `xml:"coolSetting"`
+	HeatingSetpoint float64 `xml:"heatSetting"`
+	CoolingSetpoint float64 `xml:"coolSetting"`
 	SetBy           string  `xml:"setBy"`
 	Schedule        string  `xml:"schedule"`
 	HeatNeedsFan    string  `xml:"HeatNeedsFan"`
@@ -127,7 +158,13 @@ type apiRecords struct {
 }
 
 type apiHistory struct {
-	TimeStamp string `xml:"timestamp"`
+	TimeStamp   string  `xml:"timestamp"`
+	Temperature float64 `xml:"temperature"`
+	RelHumidity int32   `xml:"humidity"`
+	HeatSetting float64 `xml:"heatSetting"`
+	CoolSetting float64 `xml:"coolSetting"`
+	System      string  `xml:"system"`
+	RunStatus   string  `xml:"runStatus"`
 }
 
 // Thermostat Site Object API Result Structs
@@ -149,6 +186,15 @@ type NewPelicanParams struct {
 	HeatingStages int32
 	CoolingStages int32
 	Timezone      string
+	// Scheme and host of the site's web API, e.g. a local mock cloud.
+	// Defaults to https://<Sitename>.officeclimatecontrol.net when empty.
+	BaseURL string
+	// TEMP_UNIT_FAHRENHEIT or TEMP_UNIT_CELSIUS. Queried from the site when empty.
+	TemperatureUnit string
+}
+
+func siteBaseURL(sitename string) string {
+	return fmt.Sprintf("https://%s.officeclimatecontrol.net", sitename)
 }
 
 func NewPelican(params *NewPelicanParams) (*Pelican, error) {
@@ -156,38 +202,47 @@ func NewPelican(params *NewPelicanParams) (*Pelican, error) {
 	if err != nil {
 		return nil, err
 	}
+	baseURL := params.BaseURL
+	if baseURL == "" {
+		baseURL = siteBaseURL(params.Sitename)
+	}
+	sess := siteSession(baseURL, params.Username, params.Password, params.Sitename)
+	unit := params.TemperatureUnit
+	if unit == "" {
+		if unit, err = fetchTemperatureUnit(sess); err != nil {
+			return nil, err
+		}
+	}
+	id, err := sess.thermostatID(params.Name)
+	if err != nil {
+		return nil, err
+	}
 
-	newPelican := &Pelican{
-		username:      params.Username,
-		password:      params.Password,
-		sitename:      params.Sitename,
-		target:        fmt.Sprintf("https://%s.officeclimatecontrol.net/api.cgi", params.Sitename),
-		Name:          params.Name,
-		HeatingStages: params.HeatingStages,
-		CoolingStages: params.CoolingStages,
-		TimezoneName:  params.Timezone,
-		timezone:      timezone,
-		req:           gorequest.New(),
-		drReq:         gorequest.New(),
-		occupancyReq:  gorequest.New(),
-		scheduleReq:   gorequest.New(),
-	}
-	if error := newPelican.setCookieAndID(); error != nil {
-		return nil, error
-	}
-	return newPelican, nil
+	return &Pelican{
+		id:              id,
+		target:          sess.target,
+		temperatureUnit: unit,
+		Name:            params.Name,
+		HeatingStages:   params.HeatingStages,
+		CoolingStages:   params.CoolingStages,
+		TimezoneName:    params.Timezone,
+		timezone:        timezone,
+		session:         sess,
+	}, nil
 }
 
-func DiscoverPelicans(username, password, sitename string) ([]*Pelican, error) {
+// DiscoverPelicans finds every thermostat at a site. An empty baseURL selects
+// the site's default officeclimatecontrol.net endpoint.
+func DiscoverPelicans(username, password, sitename, baseURL string) ([]*Pelican, error) {
+	if baseURL == "" {
+		baseURL = siteBaseURL(sitename)
+	}
+
+	sess := siteSession(baseURL, username, password, sitename)
+
 	// Time zone retrieval logic
-	targetTimezone := fmt.Sprintf("https://%s.officeclimatecontrol.net/api.cgi", sitename)
-	respTimezone, _, errsTimezone := gorequest.New().Get(targetTimezone).
-		Param("username", username).
-		Param("password", password).
-		Param("request", "get").
-		Param("object", "Site").
-		Param("value", "timeZone;").
-		End()
+	targetTimezone := sess.target
+	respTimezone, errsTimezone := sess.api("get", "Site", "", "timeZone;")
 	if errsTimezone != nil {
 		return nil, fmt.Errorf("Error retrieving object result from %s: %s", targetTimezone, errsTimezone)
 	}
@@ -199,14 +254,13 @@ func DiscoverPelicans(username, password, sitename string) ([]*Pelican, error) {
 	}
 	timezoneName := resultTimezone.Attribute.Timezone
 
-	target := fmt.Sprintf("https://%s.officeclimatecontrol.net/api.cgi", sitename)
-	resp, _, errs := gorequest.New().Get(target).
-		Param("username", username).
-		Param("password", password).
-		Param("request", "get").
-		Param("object", "Thermostat").
-		Param("value", "name;heatStages;coolStages").
-		End()
+	target := sess.target
+	unit, err := fetchTemperatureUnit(sess)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, errs := sess.api("get", "Thermostat", "", "name;heatStages;coolStages")
 	if errs != nil {
 		return nil, fmt.Errorf("Error retrieving thermostat name from %s: %s", target, errs)
 	}
@@ -232,13 +286,15 @@ func DiscoverPelicans(username, password, sitename string) ([]*Pelican, error) {
 		}
 		if thermInfo.Name != "" {
 			newPelican, err := NewPelican(&NewPelicanParams{
-				Username:      username,
-				Password:      password,
-				Sitename:      sitename,
-				Name:          thermInfo.Name,
-				HeatingStages: thermInfo.HeatingStages,
-				CoolingStages: thermInfo.CoolingStages,
-				Timezone:      timezoneName,
+				Username:        username,
+				Password:        password,
+				Sitename:        sitename,
+				Name:            thermInfo.Name,
+				HeatingStages:   thermInfo.HeatingStages,
+				CoolingStages:   thermInfo.CoolingStages,
+				Timezone:        timezoneName,
+				BaseURL:         baseURL,
+				TemperatureUnit: unit,
 			})
 			if err != nil {
 				return nil, fmt.Errorf("Error creating thermostat: %s", err)
@@ -249,15 +305,14 @@ func DiscoverPelicans(username, password, sitename string) ([]*Pelican, error) {
 	return pelicans, nil
 }
 
+// ID is the thermostat's identifier within the Pelican site. Unlike Name,
+// it survives the thermostat being renamed.
+func (pel *Pelican) ID() string {
+	return pel.id
+}
+
 func (pel *Pelican) GetStatus() (*PelicanStatus, error) {
-	resp, _, errs := pel.req.Get(pel.target).
-		Param("username", pel.username).
-		Param("password", pel.password).
-		Param("request", "get").
-		Param("object", "Thermostat").
-		Param("selection", fmt.Sprintf("name:%s;", pel.Name)).
-		Param("value", "temperature;humidity;heatSetting;coolSetting;setBy;HeatNeedsFan;system;runStatus;statusDisplay;schedule;heatStages;coolStages").
-		End()
+	resp, errs := pel.session.api("get", "Thermostat", fmt.Sprintf("name:%s;", pel.Name), statusValues)
 	if errs != nil {
 		return nil, fmt.Errorf("Error retrieving thermostat status from %s: %v", pel.target, errs)
 	}
@@ -272,11 +327,40 @@ func (pel *Pelican) GetStatus() (*PelicanStatus, error) {
 		return nil, fmt.Errorf("Error retrieving thermostat status from %s: %s", resp.Request.URL, result.Message)
 	}
 
-	thermostat := result.Thermostat
+	status := pel.statusFromAPI(&result.Thermostat)
+	if status == nil {
+		return nil, nil
+	}
+
+	// Thermostat History Object Request to retrieve time stamps from past hour
+	endTime := time.Now().In(pel.timezone).Format(time.RFC3339)
+	startTime := time.Now().Add(-1 * time.Hour).In(pel.timezone).Format(time.RFC3339)
+
+	respHist, errsHist := pel.session.api("get", "ThermostatHistory", fmt.Sprintf("startDateTime:%s;endDateTime:%s;", startTime, endTime), "timestamp")
+	if errsHist != nil {
+		return nil, fmt.Errorf("Error retrieving thermostat status from %s: %v", pel.target, errsHist)
+	}
+	defer respHist.Body.Close()
+
+	var histResult apiResultHistory
+	histDec := xml.NewDecoder(respHist.Body)
+	if histErr := histDec.Decode(&histResult); histErr != nil {
+		return nil, fmt.Errorf("Failed to decode response XML: %v", histErr)
+	}
+	if histResult.Success == 0 {
+		return nil, fmt.Errorf("Error retrieving thermostat status from %s: %s", respHist.Request.URL, histResult.Message)
+	}
+
+	pel.checkHistory(histResult.Records.History)
+	return status, nil
+}
 
+// Converts a Thermostat object from the API into the status published by the
+// driver, or nil if the thermostat is unreachable
+func (pel *Pelican) statusFromAPI(thermostat *apiThermostat) *PelicanStatus {
 	if thermostat.StatusDisplay == "Unreachable" {
 		fmt.Printf("Thermostat %s is unreachable\n", pel.Name)
-		return nil, nil
+		return nil
 	}
 
 	var fanState bool
@@ -299,80 +383,52 @@ func (pel *Pelican) GetStatus() (*PelicanStatus, error) {
 		}
 	}
 
-	// Thermostat History Object Request to retrieve time stamps from past hour
-	endTime := time.Now().In(pel.timezone).Format(time.RFC3339)
-	startTime := time.Now().Add(-1 * time.Hour).In(pel.timezone).Format(time.RFC3339)
-
-	respHist, _, errsHist := pel.req.Get(pel.target).
-		Param("username", pel.username).
-		Param("password", pel.password).
-		Param("request", "get").
-		Param("object", "ThermostatHistory").
-		Param("selection", fmt.Sprintf("startDateTime:%s;endDateTime:%s;", startTime, endTime)).
-		Param("value", "timestamp").
-		End()
-	defer respHist.Body.Close()
-
-	if errsHist != nil {
-		return nil, fmt.Errorf("Error retrieving thermostat status from %s: %v", pel.target, errsHist)
-	}
-
-	var histResult apiResultHistory
-	histDec := xml.NewDecoder(respHist.Body)
-	if histErr := histDec.Decode(&histResult); histErr != nil {
-		return nil, fmt.Errorf("Failed to decode response XML: %v", histErr)
-	}
-	if histResult.Success == 0 {
-		return nil, fmt.Errorf("Error retrieving thermostat status from %s: %s", respHist.Request.URL, histResult.Message)
-	}
-
-	if len(histResult.Records.History) > 0 {
-		// Converting string timeStamp to int64 format
-		match := histResult.Records.History[len(histResult.Records.History)-1]
-		timestamp, timeErr := time.ParseInLocation("2006-01-02T15:04", match.TimeStamp, pel.timezone)
-		if timeErr != nil {
-			return nil, fmt.Errorf("Error parsing %v into Time struct: %v\n", match.TimeStamp, timeErr)
-		}
-
-		now := time.Now()
-		if timestamp.Before(now.Add(-2 * time.Hour)) {
-			fmt.Println("WARNING temperature data has not changed for 2 hours. This is not necessarily an error")
-		}
-	}
-
 	return &PelicanStatus{
-		Temperature:       thermostat.Temperature,
+		Temperature:       pel.toFahrenheit(thermostat.Temperature),
 		RelHumidity:       float64(thermostat.RelHumidity),
-		HeatingSetpoint:   float64(thermostat.HeatingSetpoint),
-		CoolingSetpoint:   float64(thermostat.CoolingSetpoint),
+		HeatingSetpoint:   pel.toFahrenheit(thermostat.HeatingSetpoint),
+		CoolingSetpoint:   pel.toFahrenheit(thermostat.CoolingSetpoint),
 		Override:          thermostat.Schedule != "On",
 		Fan:               fanState,
 		Mode:              modeNameMappings[thermostat.System],
 		State:             thermState,
 		EnabledHeatStages: thermostat.HeatStages,
 		EnabledCoolStages: thermostat.CoolStages,
+		TemperatureUnit:   TEMP_UNIT_FAHRENHEIT,
 		Time:              time.Now().UnixNano(),
-	}, nil
+	}
+}
+
+// Warns if the thermostat's most recent history record is stale
+func (pel *Pelican) checkHistory(history []apiHistory) {
+	if len(history) == 0 {
+		return
+	}
+	// Converting string timeStamp to int64 format
+	match := history[len(history)-1]
+	timestamp, timeErr := time.ParseInLocation("2006-01-02T15:04", match.TimeStamp, pel.timezone)
+	if timeErr != nil {
+		fmt.Printf("Error parsing %s's last history timestamp %v into Time struct: %v\n", pel.Name, match.TimeStamp, timeErr)
+		return
+	}
+
+	now := time.Now()
+	if timestamp.Before(now.Add(-2 * time.Hour)) {
+		fmt.Printf("WARNING %s temperature data has not changed for 2 hours. This is not necessarily an error\n", pel.Name)
+	}
 }
 
 func (pel *Pelican) ModifySetpoints(params *PelicanSetpointParams) error {
 	var value string
 	// heating setpoint
 	if params.HeatingSetpoint != nil {
-		value += fmt.Sprintf("heatSetting:%d;", int(*params.HeatingSetpoint))
+		value += fmt.Sprintf("heatSetting:%s;", pel.formatSetting(*params.HeatingSetpoint))
 	}
 	// cooling setpoint
 	if params.CoolingSetpoint != nil {
-		value += fmt.Sprintf("coolSetting:%d;", int(*params.CoolingSetpoint))
-	}
-	resp, _, errs := gorequest.New().Get(pel.target).
-		Param("username", pel.username).
-		Param("password", pel.password).
-		Param("request", "set").
-		Param("object", "thermostat").
-		Param("selection", fmt.Sprintf("name:%s;", pel.Name)).
-		Param("value", value).
-		End()
+		value += fmt.Sprintf("coolSetting:%s;", pel.formatSetting(*params.CoolingSetpoint))
+	}
+	resp, errs := pel.session.api("set", "thermostat", fmt.Sprintf("name:%s;", pel.Name), value)
 	if errs != nil {
 		return fmt.Errorf("Error modifying thermostat temp settings: %v", errs)
 	}
@@ -427,23 +483,16 @@ func (pel *Pelican) ModifyState(params *PelicanStateParams) error {
 
 	// heating setpoint
 	if params.HeatingSetpoint != nil {
-		value += fmt.Sprintf("heatSetting:%d;", int(*params.HeatingSetpoint))
+		value += fmt.Sprintf("heatSetting:%s;", pel.formatSetting(*params.HeatingSetpoint))
 	}
 	// cooling setpoint
 	if params.CoolingSetpoint != nil {
-		value += fmt.Sprintf("coolSetting:%d;", int(*params.CoolingSetpoint))
+		value += fmt.Sprintf("coolSetting:%s;", pel.formatSetting(*params.CoolingSetpoint))
 	}
 
-	resp, _, errs := gorequest.New().Get(pel.target).
-		Param("username", pel.username).
-		Param("password", pel.password).
-		Param("request", "set").
-		Param("object", "thermostat").
-		Param("selection", fmt.Sprintf("name:%s;", pel.Name)).
-		Param("value", value).
-		End()
+	resp, errs := pel.session.api("set", "thermostat", fmt.Sprintf("name:%s;", pel.Name), value)
 	if errs != nil {
-		return fmt.Errorf("Error modifying thermostat state: %v (%s)", errs, resp.Request.URL)
+		return fmt.Errorf("Error modifying thermostat state: %v", errs)
 	}
 
 	defer resp.Body.Close()
@@ -467,46 +516,89 @@ func (pel *Pelican) ModifyState(params *PelicanStateParams) error {
 	return nil
 }
 
-func (pel *Pelican) ModifyStages(params *PelicanStageParams) error {
-	// Turn the thermostat off, saving its previously active mode
+// ModifyStages changes the number of enabled heating and cooling stages. The
+// thermostat has to be off while its stages change, so it is turned off and
+// then back to its previous mode. Nothing is done, and a nil change returned,
+// if the thermostat already has the requested stages.
+func (pel *Pelican) ModifyStages(params *PelicanStageParams) (*PelicanStageChange, error) {
 	status, err := pel.GetStatus()
 	if err != nil {
-		return fmt.Errorf("Error retrieving thermostat status: %s", err)
+		return nil, fmt.Errorf("Error retrieving thermostat status: %s", err)
+	}
+	if status == nil {
+		return nil, fmt.Errorf("Thermostat %s is unreachable", pel.Name)
 	}
-	newMode := float64(0) // Off
-	if err := pel.ModifyState(&PelicanStateParams{Mode: &newMode}); err != nil {
-		return fmt.Errorf("Failed to turn thermostat off: %s", err)
+	change := &PelicanStageChange{
+		PreviousHeatStages: status.EnabledHeatStages,
+		PreviousCoolStages: status.EnabledCoolStages,
+		HeatStages:         status.EnabledHeatStages,
+		CoolStages:         status.EnabledCoolStages,
+		Mode:               status.Mode,
+		Restored:           true,
+		Time:               time.Now().UnixNano(),
+	}
+	if params.HeatingStages != nil {
+		change.HeatStages = *params.HeatingStages
+	}
+	if params.CoolingStages != nil {
+		change.CoolStages = *params.CoolingStages
+	}
+	if change.HeatStages == change.PreviousHeatStages && change.CoolStages == change.PreviousCoolStages {
+		return nil, nil
 	}
 
-	// Restore the thermostat to its previous mode
-	defer func() {
-		if status != nil {
-			oldMode := float64(status.Mode)
-			if err := pel.ModifyState(&PelicanStateParams{Mode: &oldMode}); err != nil {
-				fmt.Printf("Failed to restore thermostat to old mode: %s\n", err)
-			}
+	// Turn the thermostat off, unless it already is
+	var offSince time.Time
+	if status.Mode != modeNameMappings["Off"] {
+		newMode := float64(modeNameMappings["Off"])
+		if err := pel.ModifyState(&PelicanStateParams{Mode: &newMode}); err != nil {
+			return nil, fmt.Errorf("Failed to turn thermostat off: %s", err)
 		}
-	}()
+		offSince = time.Now()
+	}
 
-	// Change the thermostat's stage configuration
-	var value string
-	if params.HeatingStages != nil {
-		value += fmt.Sprintf("heatStages:%d;", *params.HeatingStages)
+	value := fmt.Sprintf("heatStages:%d;coolStages:%d;", change.HeatStages, change.CoolStages)
+	stagesErr := pel.setStages(value)
+	if stagesErr != nil {
+		change.HeatStages = change.PreviousHeatStages
+		change.CoolStages = change.PreviousCoolStages
+		change.Error = stagesErr.Error()
 	}
-	if params.CoolingStages != nil {
-		value += fmt.Sprintf("coolStages:%d;", *params.CoolingStages)
+
+	if offSince.IsZero() {
+		return change, stagesErr
+	}
+	time.Sleep(time.Until(offSince.Add(params.MinOffTime)))
+
+	// Restore the thermostat to its previous mode, as an HVAC system left off
+	// is worse than a failed stage change
+	oldMode := float64(status.Mode)
+	var restoreErr error
+	for attempt := 1; attempt <= stageRestoreAttempts; attempt++ {
+		if restoreErr = pel.ModifyState(&PelicanStateParams{Mode: &oldMode}); restoreErr == nil {
+			return change, stagesErr
+		}
+		fmt.Printf("Failed to restore thermostat %s to mode %s (attempt %d of %d): %s\n",
+			pel.Name, modeValMappings[status.Mode], attempt, stageRestoreAttempts, restoreErr)
+		if attempt < stageRestoreAttempts {
+			time.Sleep(stageRestoreRetryDelay)
+		}
+	}
+	change.Restored = false
+	restoreErr = fmt.Errorf("Thermostat %s left off, failed to restore it to mode %s: %s",
+		pel.Name, modeValMappings[status.Mode], restoreErr)
+	if stagesErr != nil {
+		change.Error = fmt.Sprintf("%s; %s", stagesErr, restoreErr)
+	} else {
+		change.Error = restoreErr.Error()
 	}
+	return change, fmt.Errorf("%s", change.Error)
+}
 
-	resp, _, errs := gorequest.New().Get(pel.target).
-		Param("username", pel.username).
-		Param("password", pel.password).
-		Param("request", "set").
-		Param("object", "thermostat").
-		Param("selection", fmt.Sprintf("name:%s;", pel.Name)).
-		Param("value", value).
-		End()
+func (pel *Pelican) setStages(value string) error {
+	resp, errs := pel.session.api("set", "thermostat", fmt.Sprintf("name:%s;", pel.Name), value)
 	if errs != nil {
-		return fmt.Errorf("Error modifying thermostat stages: %v (%s)", errs, resp.Request.URL)
+		return fmt.Errorf("Error modifying thermostat stages: %v", errs)
 	}
 
 	defer resp.Body.Close()
@@ -516,15 +608,7 @@ func (pel *Pelican) ModifyStages(params *PelicanStageParams) error {
 		return fmt.Errorf("Failed to decode response XML: %v", err)
 	}
 	if result.Success == 0 {
-		return fmt.Errorf("Error modifying thermostat state: %s", result.Message)
-	}
-
-	// rewrite default heat/cool stage info
-	if result.Thermostat.HeatStages == 0 {
-		result.Thermostat.HeatStages = 1
-	}
-	if result.Thermostat.CoolStages == 0 {
-		result.Thermostat.CoolStages = 1
+		return fmt.Errorf("Error modifying thermostat stages: %s", result.Message)
 	}
 	return nil
 }
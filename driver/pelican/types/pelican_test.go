@@ -0,0 +1,115 @@
+package types
+
+import (
+	"testing"
+
+	"github.com/SoftwareDefinedBuildings/bw2-contrib/driver/pelican/fakecloud"
+)
+
+const (
+	testUsername = "user"
+	testPassword = "pass"
+	testSitename = "site"
+	testTimezone = "America/Los_Angeles"
+)
+
+// Starts a fake site with the given thermostats and discovers them, keyed by name
+func newTestSite(t *testing.T, thermostats ...fakecloud.Thermostat) (*fakecloud.Server, map[string]*Pelican) {
+	t.Helper()
+	cloud := fakecloud.New(testUsername, testPassword, testSitename, testTimezone)
+	for _, tstat := range thermostats {
+		cloud.AddThermostat(tstat)
+	}
+	pelicans, err := DiscoverPelicans(testUsername, testPassword, testSitename, cloud.URL())
+	if err != nil {
+		cloud.Close()
+		t.Fatal(err)
+	}
+	byName := make(map[string]*Pelican)
+	for _, pel := range pelicans {
+		byName[pel.Name] = pel
+	}
+	return cloud, byName
+}
+
+func float(v float64) *float64 { return &v }
+
+func TestDiscoverPelicans(t *testing.T) {
+	cloud, pelicans := newTestSite(t,
+		fakecloud.Thermostat{Name: "Office"},
+		fakecloud.Thermostat{Name: "Lobby", HeatStages: 2, CoolStages: 2})
+	defer cloud.Close()
+
+	if len(pelicans) != 2 {
+		t.Fatalf("Discovered %d thermostats, want 2", len(pelicans))
+	}
+	lobby := pelicans["Lobby"]
+	if lobby == nil || lobby.HeatingStages != 2 || lobby.CoolingStages != 2 || lobby.TimezoneName != testTimezone {
+		t.Errorf("Discovered Lobby as %+v, want 2 stages in %s", lobby, testTimezone)
+	}
+	office, _ := cloud.Thermostat("Office")
+	if id := pelicans["Office"].ID(); id != office.ID {
+		t.Errorf("Office has ID %q, want %q", id, office.ID)
+	}
+}
+
+func TestGetStatus(t *testing.T) {
+	cloud, pelicans := newTestSite(t, fakecloud.Thermostat{
+		Name:         "Office",
+		Temperature:  71,
+		Humidity:     40,
+		HeatSetting:  68,
+		CoolSetting:  76,
+		Schedule:     "Off",
+		System:       "Heat",
+		RunStatus:    "Heat-Stage1",
+		HeatNeedsFan: "Yes",
+	})
+	defer cloud.Close()
+
+	status, err := pelicans["Office"].GetStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Temperature != 71 || status.RelHumidity != 40 || status.HeatingSetpoint != 68 || status.CoolingSetpoint != 76 {
+		t.Errorf("Status %+v, want 71F at 40%% with setpoints 68/76", status)
+	}
+	if !status.Override || !status.Fan || status.Mode != 1 || status.State != STATE_HEAT_STAGE1 {
+		t.Errorf("Status %+v, want overridden, heating with the fan on", status)
+	}
+	if status.TemperatureUnit != TEMP_UNIT_FAHRENHEIT || status.EnabledHeatStages != 1 {
+		t.Errorf("Status %+v, want Fahrenheit with 1 heating stage", status)
+	}
+
+	cloud.UpdateThermostat("Office", func(tstat *fakecloud.Thermostat) { tstat.StatusDisplay = "Unreachable" })
+	if status, err := pelicans["Office"].GetStatus(); status != nil || err != nil {
+		t.Errorf("Status of an unreachable thermostat is %+v, %v; want nil, nil", status, err)
+	}
+}
+
+func TestModifyState(t *testing.T) {
+	cloud, pelicans := newTestSite(t, fakecloud.Thermostat{Name: "Office", HeatSetting: 68, CoolSetting: 76})
+	defer cloud.Close()
+	office := pelicans["Office"]
+
+	mode, override, fan := float64(2), float64(1), float64(1)
+	err := office.ModifyState(&PelicanStateParams{
+		HeatingSetpoint: float(66),
+		CoolingSetpoint: float(78.4),
+		Mode:            &mode,
+		Override:        &override,
+		Fan:             &fan,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tstat, _ := cloud.Thermostat("Office")
+	if tstat.HeatSetting != 66 || tstat.CoolSetting != 78 || tstat.System != "Cool" || tstat.Schedule != "Off" || tstat.Fan != "On" {
+		t.Errorf("Thermostat is %+v, want cooling at 66/78 off schedule with the fan on", tstat)
+	}
+
+	invalid := float64(4)
+	if err := office.ModifyState(&PelicanStateParams{Mode: &invalid}); err == nil {
+		t.Error("ModifyState to mode 4 succeeded")
+	}
+}
@@ -3,114 +3,391 @@ package types
 import (
 	"encoding/xml"
 	"fmt"
+	"strings"
+	"time"
 
-	"github.com/parnurzeal/gorequest"
 	rrule "github.com/teambition/rrule-go"
 )
 
-func (pel *Pelican) SetSchedule(newSchedule *ThermostatSchedule) error {
-	// Retrieve thermostat's latest schedule for extra block deletion purposes
-	currentSchedule, currentErr := pel.GetSchedule()
-	if currentErr != nil {
-		return fmt.Errorf("Error retrieving thermostat %v's current schedule: %v", pel.Name, currentErr)
-	}
-
-	for _, day := range week {
-		if blocks, ok := newSchedule.DaySchedules[day]; ok {
-			// Delete Unnecessary Blocks + Error Checking
-			currentBlockCount := len(currentSchedule.DaySchedules[day])
-			requiredBlockCount := len(blocks)
-			for requiredBlockCount < currentBlockCount {
-				respDelete, _, errsDelete := gorequest.New().Get(pel.target).
-					Param("username", pel.username).
-					Param("password", pel.password).
-					Param("request", "set").
-					Param("object", "thermostatSchedule").
-					Param("selection", fmt.Sprintf("name:%s;dayOfWeek:%s;setTime:%v;", pel.Name, day, currentBlockCount)).
-					Param("value", "delete").
-					End()
-
-				if errsDelete != nil {
-					return fmt.Errorf("Error deleting thermostat schedule settings on day %v: %v\n", day, errsDelete)
-				}
-				defer respDelete.Body.Close()
-				var resultDelete apiResult
-				decDelete := xml.NewDecoder(respDelete.Body)
-				if errDecodeDelete := decDelete.Decode(&resultDelete); errDecodeDelete != nil {
-					return fmt.Errorf("Failed to decode thermostat schedule delete response XML: %v", errDecodeDelete)
-				}
-				if resultDelete.Success == 0 {
-					return fmt.Errorf("Error deleting thermostat schedule settings on day %v: %v\n", day, resultDelete.Message)
-				}
-				currentBlockCount -= 1
+const (
+	SCHEDULE_CHANGE_SET    = "set"
+	SCHEDULE_CHANGE_DELETE = "delete"
+)
+
+// A single schedule block written to or deleted from a thermostat
+type ScheduleChange struct {
+	Day string `msgpack:"day"`
+	// 1-based position of the block within the day
+	Block  int                      `msgpack:"block"`
+	Action string                   `msgpack:"action"`
+	Old    *ThermostatBlockSchedule `msgpack:"old"`
+	New    *ThermostatBlockSchedule `msgpack:"new"`
+}
+
+// Outcome of a SetSchedule call
+type ScheduleReport struct {
+	// Repeat type the schedule was written with
+	Repeat string `msgpack:"repeat"`
+	// Whether the thermostat's repeat type had to be switched
+	RepeatChanged bool `msgpack:"repeat_changed"`
+	// Days whose schedule differed from the requested one
+	ChangedDays []string `msgpack:"changed_days"`
+	// Block changes that were successfully applied, in order
+	Changes []ScheduleChange `msgpack:"changes"`
+	// Whether a failure caused the original schedule to be restored
+	RolledBack bool `msgpack:"rolled_back"`
+	// Whether the thermostat was re-read and found to hold the intended
+	// schedule: the requested one, or the original one after a rollback
+	Verified bool `msgpack:"verified"`
+	// Empty if the schedule was set
+	Error string `msgpack:"error"`
+	Time  int64  `msgpack:"time"`
+}
+
+// SetSchedule writes only the blocks that differ from the thermostat's current
+// schedule, switching the thermostat to newSchedule's repeat type first if
+// needed. Daily schedules are written as a single day and Weekday/Weekend ones
+// as two (Sunday for the weekend, Monday for weekdays); the days sharing a
+// schedule under the repeat type must not disagree, and any of them may be
+// omitted. Without a repeat type, the thermostat's current one is kept if it
+// can express newSchedule, and Weekly is used otherwise. Days left without
+// blocks are cleared.
+//
+// If any write fails, or the thermostat does not report the requested schedule
+// afterwards, the original schedule is restored. The returned report is never nil.
+func (pel *Pelican) SetSchedule(newSchedule *ThermostatSchedule) (*ScheduleReport, error) {
+	report, err := pel.setSchedule(newSchedule)
+	if err != nil {
+		report.Error = err.Error()
+	}
+	report.Time = time.Now().UnixNano()
+	return report, err
+}
+
+func (pel *Pelican) setSchedule(newSchedule *ThermostatSchedule) (*ScheduleReport, error) {
+	report := &ScheduleReport{}
+
+	// Reject malformed schedules before anything is written
+	for day, blocks := range newSchedule.DaySchedules {
+		if !isWeekday(day) {
+			return report, fmt.Errorf("Invalid day %v in schedule for thermostat %v", day, pel.Name)
+		}
+		for _, block := range blocks {
+			if _, err := pel.blockStartTime(&block); err != nil {
+				return report, err
 			}
+		}
+	}
 
-			// Construct and Set New Schedule Settings by Block
-			for index, block := range blocks {
-				var value string = ""
-				value += fmt.Sprintf("coolSetting:%.0f;", block.CoolSetting)
-				value += fmt.Sprintf("heatSetting:%.0f", block.HeatSetting)
-				value += fmt.Sprintf("system:%s", block.System)
-
-				// Convert Time to Pelican's Timezone
-				timeRRule, timeRRuleErr := rrule.StrToRRule(block.Time)
-				if timeRRuleErr != nil {
-					return fmt.Errorf("Error converting time string %v to RRule format: %v\n", block.Time, timeRRuleErr)
-				}
-				timeLocal := timeRRule.OrigOptions.Dtstart.In(pel.timezone)
-				value += fmt.Sprintf("startTime:%s;", timeLocal.Format("03:04"))
-
-				// Set Request + Error Checking
-				respSet, _, errsSet := gorequest.New().Get(pel.target).
-					Param("username", pel.username).
-					Param("password", pel.password).
-					Param("request", "set").
-					Param("object", "thermostatSchedule").
-					Param("selection", fmt.Sprintf("name:%s;dayOfWeek:%s;setTime:%v;", pel.Name, day, index+1)).
-					Param("value", value).
-					End()
-
-				if errsSet != nil {
-					return fmt.Errorf("Error setting thermostat schedule on day %v: %v\n", day, errsSet)
-				}
-				defer respSet.Body.Close()
-				var resultSet apiResult
-				decSet := xml.NewDecoder(respSet.Body)
-				if errDecodeSet := decSet.Decode(&resultSet); errDecodeSet != nil {
-					return fmt.Errorf("Failed to decode thermostat schedule set response XML: %v", errDecodeSet)
-				}
-				if resultSet.Success == 0 {
-					return fmt.Errorf("Error setting thermostat schedule on day %v: %v\n", day, resultSet.Message)
+	originalSchedule, err := pel.GetSchedule()
+	if err != nil {
+		return report, fmt.Errorf("Error retrieving thermostat %v's current schedule: %v", pel.Name, err)
+	}
+
+	repeat := newSchedule.Repeat
+	if repeat == "" {
+		repeat = originalSchedule.Repeat
+		if _, err := pel.expandSchedule(newSchedule, repeat); err != nil {
+			repeat = REPEAT_WEEKLY
+		}
+	}
+	targetSchedule, err := pel.expandSchedule(newSchedule, repeat)
+	if err != nil {
+		return report, err
+	}
+	report.Repeat = repeat
+
+	applyErr := pel.writeSchedule(originalSchedule, targetSchedule, report)
+	if applyErr == nil {
+		if len(report.ChangedDays) == 0 && !report.RepeatChanged {
+			report.Verified = true
+			return report, nil
+		}
+		if applyErr = pel.verifySchedule(targetSchedule); applyErr == nil {
+			report.Verified = true
+			return report, nil
+		}
+	}
+
+	// Put back whatever was there before, starting from the thermostat's actual state
+	report.RolledBack = true
+	rollbackErr := pel.restoreSchedule(originalSchedule)
+	if rollbackErr == nil {
+		rollbackErr = pel.verifySchedule(originalSchedule)
+	}
+	if rollbackErr != nil {
+		return report, fmt.Errorf("Failed to set schedule for thermostat %v (%v), and failed to restore original schedule: %v",
+			pel.Name, applyErr, rollbackErr)
+	}
+	report.Verified = true
+	return report, fmt.Errorf("Failed to set schedule for thermostat %v, original schedule restored: %v", pel.Name, applyErr)
+}
+
+// Rewrites the parts of the thermostat's schedule that differ from original
+func (pel *Pelican) restoreSchedule(original *ThermostatSchedule) error {
+	current, err := pel.GetSchedule()
+	if err != nil {
+		return fmt.Errorf("Error retrieving thermostat %v's schedule: %v", pel.Name, err)
+	}
+	return pel.writeSchedule(current, original, nil)
+}
+
+// Turns the thermostat's current schedule into target, which must be expanded
+// to every day of the week. Progress is recorded in report, if given.
+func (pel *Pelican) writeSchedule(current, target *ThermostatSchedule, report *ScheduleReport) error {
+	if current.Repeat != target.Repeat {
+		if err := pel.setScheduleRepeat(target.Repeat); err != nil {
+			return err
+		}
+		if report != nil {
+			report.RepeatChanged = true
+		}
+		// The thermostat now reads its stored blocks under the new repeat type
+		var err error
+		if current, err = pel.GetSchedule(); err != nil {
+			return fmt.Errorf("Error retrieving thermostat %v's schedule: %v", pel.Name, err)
+		}
+	}
+
+	var days []string
+	for _, group := range repeatGroups(target.Repeat) {
+		days = append(days, group[0])
+	}
+	changes, err := pel.diffSchedules(current, target, days)
+	if err != nil {
+		return err
+	}
+	if report != nil {
+		for _, group := range repeatGroups(target.Repeat) {
+			for _, day := range changedDays(changes) {
+				if day == group[0] {
+					report.ChangedDays = append(report.ChangedDays, group...)
 				}
 			}
-		} else {
-			// Delete Entire Day's Schedule
-			blockCount := len(currentSchedule.DaySchedules[day])
-			for i := blockCount; i >= 1; i-- {
-				respDelete, _, errsDelete := gorequest.New().Get(pel.target).
-					Param("username", pel.username).
-					Param("password", pel.password).
-					Param("request", "set").
-					Param("object", "thermostatSchedule").
-					Param("selection", fmt.Sprintf("name:%s;dayOfWeek:%s;setTime:%v;", pel.Name, day, i)).
-					Param("value", "delete").
-					End()
-
-				if errsDelete != nil {
-					return fmt.Errorf("Error deleting thermostat schedule settings on day %v: %v\n", day, errsDelete)
-				}
-				defer respDelete.Body.Close()
-				var resultDelete apiResult
-				decDelete := xml.NewDecoder(respDelete.Body)
-				if errDecodeDelete := decDelete.Decode(&resultDelete); errDecodeDelete != nil {
-					return fmt.Errorf("Failed to decode thermostat schedule delete response XML: %v", errDecodeDelete)
+		}
+	}
+	return pel.applyScheduleChanges(changes, report)
+}
+
+// Fills in every day of the week from the days schedule gives, according to
+// the repeat type. Days that share a schedule under the repeat type must agree.
+func (pel *Pelican) expandSchedule(schedule *ThermostatSchedule, repeat string) (*ThermostatSchedule, error) {
+	groups := repeatGroups(repeat)
+	if groups == nil {
+		return nil, fmt.Errorf("Invalid schedule repeat type %v for thermostat %v", repeat, pel.Name)
+	}
+
+	expanded := &ThermostatSchedule{
+		DaySchedules: make(map[string]([]ThermostatBlockSchedule), len(week)),
+		Repeat:       repeat,
+	}
+	for _, group := range groups {
+		var groupBlocks []ThermostatBlockSchedule
+		var groupDay string
+		for _, day := range group {
+			blocks, ok := schedule.DaySchedules[day]
+			if !ok {
+				continue
+			}
+			if groupDay == "" {
+				groupBlocks, groupDay = blocks, day
+				continue
+			}
+			// Compare the two days as schedules of their own
+			changes, err := pel.diffSchedules(
+				&ThermostatSchedule{DaySchedules: map[string]([]ThermostatBlockSchedule){groupDay: groupBlocks}},
+				&ThermostatSchedule{DaySchedules: map[string]([]ThermostatBlockSchedule){groupDay: blocks}},
+				[]string{groupDay})
+			if err != nil {
+				return nil, err
+			}
+			if len(changes) > 0 {
+				return nil, fmt.Errorf("Schedules for %v and %v differ, but must match for repeat type %v",
+					groupDay, day, repeat)
+			}
+		}
+		for _, day := range group {
+			expanded.DaySchedules[day] = groupBlocks
+		}
+	}
+	return expanded, nil
+}
+
+// Groups the days of the week that share a schedule under a repeat type. The
+// first day of each group is the one the thermostat stores the schedule under.
+func repeatGroups(repeat string) [][]string {
+	switch repeat {
+	case REPEAT_DAILY:
+		return [][]string{week[:]}
+	case REPEAT_WEEKDAY_WEEKEND:
+		return [][]string{
+			{"Sunday", "Saturday"},
+			{"Monday", "Tuesday", "Wednesday", "Thursday", "Friday"},
+		}
+	case REPEAT_WEEKLY:
+		groups := make([][]string, len(week))
+		for i, day := range week {
+			groups[i] = []string{day}
+		}
+		return groups
+	default:
+		return nil
+	}
+}
+
+// Re-reads the thermostat's schedule and checks that it matches expected
+func (pel *Pelican) verifySchedule(expected *ThermostatSchedule) error {
+	actual, err := pel.GetSchedule()
+	if err != nil {
+		return fmt.Errorf("Error re-reading thermostat %v's schedule: %v", pel.Name, err)
+	}
+	if actual.Repeat != expected.Repeat {
+		return fmt.Errorf("Thermostat %v's schedule repeats %v instead of %v", pel.Name, actual.Repeat, expected.Repeat)
+	}
+	changes, err := pel.diffSchedules(actual, expected, week[:])
+	if err != nil {
+		return err
+	}
+	if len(changes) > 0 {
+		return fmt.Errorf("Thermostat %v's schedule differs from the expected one on %v",
+			pel.Name, strings.Join(changedDays(changes), ", "))
+	}
+	return nil
+}
+
+// Computes the block writes and deletions that turn current into target on
+// the given days.
+// Deletions are ordered last block first so earlier positions stay valid.
+func (pel *Pelican) diffSchedules(current, target *ThermostatSchedule, days []string) ([]ScheduleChange, error) {
+	var changes []ScheduleChange
+	for _, day := range days {
+		currentBlocks := current.DaySchedules[day]
+		targetBlocks := target.DaySchedules[day]
+
+		for i := range targetBlocks {
+			newBlock := targetBlocks[i]
+			change := ScheduleChange{Day: day, Block: i + 1, Action: SCHEDULE_CHANGE_SET, New: &newBlock}
+			if i < len(currentBlocks) {
+				oldBlock := currentBlocks[i]
+				same, err := pel.sameBlock(&oldBlock, &newBlock)
+				if err != nil {
+					return nil, err
 				}
-				if resultDelete.Success == 0 {
-					return fmt.Errorf("Error deleting thermostat schedule settings on day %v: %v\n", day, resultDelete.Message)
+				if same {
+					continue
 				}
+				change.Old = &oldBlock
 			}
+			changes = append(changes, change)
 		}
+
+		for i := len(currentBlocks) - 1; i >= len(targetBlocks); i-- {
+			oldBlock := currentBlocks[i]
+			changes = append(changes, ScheduleChange{Day: day, Block: i + 1, Action: SCHEDULE_CHANGE_DELETE, Old: &oldBlock})
+		}
+	}
+	return changes, nil
+}
+
+// Compares blocks at the precision the thermostat stores them
+func (pel *Pelican) sameBlock(a, b *ThermostatBlockSchedule) (bool, error) {
+	startA, err := pel.blockStartTime(a)
+	if err != nil {
+		return false, err
+	}
+	startB, err := pel.blockStartTime(b)
+	if err != nil {
+		return false, err
 	}
+	return startA == startB && a.System == b.System &&
+		pel.formatSetting(a.HeatSetting) == pel.formatSetting(b.HeatSetting) &&
+		pel.formatSetting(a.CoolSetting) == pel.formatSetting(b.CoolSetting), nil
+}
 
+// Converts a block's RRule start time to a 24-hour time in the thermostat's timezone
+func (pel *Pelican) blockStartTime(block *ThermostatBlockSchedule) (string, error) {
+	timeRRule, err := rrule.StrToRRule(block.Time)
+	if err != nil {
+		return "", fmt.Errorf("Error converting time string %v to RRule format: %v", block.Time, err)
+	}
+	return timeRRule.OrigOptions.Dtstart.In(pel.timezone).Format("15:04"), nil
+}
+
+// Applies changes in order, stopping at the first failure. Successful changes
+// are appended to report, if given.
+func (pel *Pelican) applyScheduleChanges(changes []ScheduleChange, report *ScheduleReport) error {
+	for _, change := range changes {
+		value := "delete"
+		if change.Action == SCHEDULE_CHANGE_SET {
+			startTime, err := pel.blockStartTime(change.New)
+			if err != nil {
+				return err
+			}
+			value = fmt.Sprintf("coolSetting:%s;heatSetting:%s;system:%s;startTime:%s;",
+				pel.formatSetting(change.New.CoolSetting), pel.formatSetting(change.New.HeatSetting),
+				change.New.System, startTime)
+		}
+		if err := pel.setScheduleBlock(change.Day, change.Block, value); err != nil {
+			return err
+		}
+		if report != nil {
+			report.Changes = append(report.Changes, change)
+		}
+	}
+	return nil
+}
+
+// Writes (or, for a value of "delete", removes) a single schedule block
+func (pel *Pelican) setScheduleBlock(day string, setTime int, value string) error {
+	selection := fmt.Sprintf("name:%s;dayOfWeek:%s;setTime:%v;", pel.Name, day, setTime)
+	if err := pel.setThermostatSchedule(selection, value); err != nil {
+		return fmt.Errorf("Error setting thermostat schedule block %v on day %v: %v", setTime, day, err)
+	}
 	return nil
 }
+
+// Switches the days of the week the thermostat's schedule is kept for
+func (pel *Pelican) setScheduleRepeat(repeat string) error {
+	selection := fmt.Sprintf("name:%s;", pel.Name)
+	if err := pel.setThermostatSchedule(selection, fmt.Sprintf("repeat:%s;", repeat)); err != nil {
+		return fmt.Errorf("Error setting thermostat schedule repeat type to %v: %v", repeat, err)
+	}
+	return nil
+}
+
+func (pel *Pelican) setThermostatSchedule(selection, value string) error {
+	resp, errs := pel.session.api("set", "thermostatSchedule", selection, value)
+	if errs != nil {
+		return fmt.Errorf("%v", errs)
+	}
+	defer resp.Body.Close()
+
+	var result apiResult
+	dec := xml.NewDecoder(resp.Body)
+	if err := dec.Decode(&result); err != nil {
+		return fmt.Errorf("Failed to decode thermostat schedule set response XML: %v", err)
+	}
+	if result.Success == 0 {
+		return fmt.Errorf("%v", result.Message)
+	}
+	return nil
+}
+
+func isWeekday(day string) bool {
+	for _, weekday := range week {
+		if day == weekday {
+			return true
+		}
+	}
+	return false
+}
+
+func changedDays(changes []ScheduleChange) []string {
+	var days []string
+	for _, change := range changes {
+		if len(days) == 0 || days[len(days)-1] != change.Day {
+			days = append(days, change.Day)
+		}
+	}
+	return days
+}
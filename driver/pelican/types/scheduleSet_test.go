@@ -0,0 +1,231 @@
+package types
+
+import (
+	"testing"
+
+	"github.com/SoftwareDefinedBuildings/bw2-contrib/driver/pelican/fakecloud"
+)
+
+// A schedule block starting at start ("03:04:PM") on the given day
+func testBlock(t *testing.T, pel *Pelican, day int, start, system string, heat, cool float64) ThermostatBlockSchedule {
+	t.Helper()
+	rrule, err := convertTimeToRRule(day, start, pel.timezone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ThermostatBlockSchedule{Time: rrule, System: system, HeatSetting: heat, CoolSetting: cool}
+}
+
+func TestSetSchedule(t *testing.T) {
+	cloud, pelicans := newTestSite(t, fakecloud.Thermostat{Name: "Office"})
+	defer cloud.Close()
+	office := pelicans["Office"]
+
+	schedule := &ThermostatSchedule{DaySchedules: make(map[string][]ThermostatBlockSchedule)}
+	for i, day := range week {
+		schedule.DaySchedules[day] = []ThermostatBlockSchedule{
+			testBlock(t, office, i, "07:00:AM", "Auto", 68, 76),
+			testBlock(t, office, i, "06:30:PM", "Heat", 60, 85),
+		}
+	}
+	report, err := office.SetSchedule(schedule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Verified || report.RolledBack || report.Repeat != REPEAT_WEEKLY || len(report.Changes) != 14 {
+		t.Errorf("Report %+v, want 14 verified changes on a weekly schedule", report)
+	}
+	if report.Error != "" || report.Time == 0 {
+		t.Errorf("Report has error %q at time %d, want none at the time of writing", report.Error, report.Time)
+	}
+
+	tstat, _ := cloud.Thermostat("Office")
+	want := []fakecloud.ScheduleBlock{
+		{Start: "07:00", HeatSetting: 68, CoolSetting: 76, System: "Auto"},
+		{Start: "18:30", HeatSetting: 60, CoolSetting: 85, System: "Heat"},
+	}
+	for day, blocks := range tstat.Schedules {
+		if len(blocks) != len(want) || blocks[0] != want[0] || blocks[1] != want[1] {
+			t.Errorf("%s has blocks %+v, want %+v", week[day], blocks, want)
+		}
+	}
+
+	read, err := office.GetSchedule()
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes, err := office.diffSchedules(read, schedule, week[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) > 0 || read.Repeat != REPEAT_WEEKLY {
+		t.Errorf("Schedule read back with changes %+v repeating %s", changes, read.Repeat)
+	}
+}
+
+// A weekly schedule with the same two blocks every day
+func testWeek(t *testing.T, pel *Pelican) *ThermostatSchedule {
+	t.Helper()
+	schedule := &ThermostatSchedule{DaySchedules: make(map[string][]ThermostatBlockSchedule), Repeat: REPEAT_WEEKLY}
+	for i, day := range week {
+		schedule.DaySchedules[day] = []ThermostatBlockSchedule{
+			testBlock(t, pel, i, "07:00:AM", "Auto", 68, 76),
+			testBlock(t, pel, i, "06:30:PM", "Heat", 60, 85),
+		}
+	}
+	return schedule
+}
+
+// Only the blocks that differ from the thermostat's schedule are written
+func TestScheduleDiff(t *testing.T) {
+	cloud, pelicans := newTestSite(t, fakecloud.Thermostat{Name: "Office"})
+	defer cloud.Close()
+	office := pelicans["Office"]
+
+	schedule := testWeek(t, office)
+	if _, err := office.SetSchedule(schedule); err != nil {
+		t.Fatal(err)
+	}
+	report, err := office.SetSchedule(schedule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Verified || len(report.Changes) != 0 || len(report.ChangedDays) != 0 {
+		t.Errorf("Rewriting the same schedule gave report %+v, want no changes", report)
+	}
+
+	schedule.DaySchedules["Tuesday"] = []ThermostatBlockSchedule{
+		testBlock(t, office, 2, "07:00:AM", "Auto", 68, 76),
+		testBlock(t, office, 2, "09:00:PM", "Off", 55, 90),
+		testBlock(t, office, 2, "11:00:PM", "Heat", 60, 85),
+	}
+	report, err = office.SetSchedule(schedule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ScheduleChange{
+		{Day: "Tuesday", Block: 2, Action: SCHEDULE_CHANGE_SET},
+		{Day: "Tuesday", Block: 3, Action: SCHEDULE_CHANGE_SET},
+	}
+	if !report.Verified || len(report.ChangedDays) != 1 || report.ChangedDays[0] != "Tuesday" || len(report.Changes) != len(want) {
+		t.Fatalf("Report %+v, want %d changes on Tuesday", report, len(want))
+	}
+	for i, change := range report.Changes {
+		if change.Day != want[i].Day || change.Block != want[i].Block || change.Action != want[i].Action {
+			t.Errorf("Change %d is %s block %d (%s), want %s block %d (%s)", i,
+				change.Day, change.Block, change.Action, want[i].Day, want[i].Block, want[i].Action)
+		}
+	}
+
+	// Dropping a block deletes it from the end of the day
+	schedule.DaySchedules["Tuesday"] = schedule.DaySchedules["Tuesday"][:2]
+	if report, err = office.SetSchedule(schedule); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Changes) != 1 || report.Changes[0].Action != SCHEDULE_CHANGE_DELETE || report.Changes[0].Block != 3 {
+		t.Errorf("Report %+v, want block 3 on Tuesday deleted", report)
+	}
+	if tstat, _ := cloud.Thermostat("Office"); len(tstat.Schedules[2]) != 2 || tstat.Schedules[2][1].System != "Off" {
+		t.Errorf("Tuesday has blocks %+v, want 2 ending with Off", tstat.Schedules[2])
+	}
+}
+
+// A write the thermostat rejects puts back the blocks already written
+func TestScheduleRollback(t *testing.T) {
+	cloud, pelicans := newTestSite(t, fakecloud.Thermostat{Name: "Office"})
+	defer cloud.Close()
+	office := pelicans["Office"]
+
+	schedule := testWeek(t, office)
+	if _, err := office.SetSchedule(schedule); err != nil {
+		t.Fatal(err)
+	}
+	want := []fakecloud.ScheduleBlock{
+		{Start: "07:00", HeatSetting: 68, CoolSetting: 76, System: "Auto"},
+		{Start: "18:30", HeatSetting: 60, CoolSetting: 85, System: "Heat"},
+	}
+
+	// Monday is written before Wednesday's block is rejected
+	schedule.DaySchedules["Monday"] = []ThermostatBlockSchedule{testBlock(t, office, 1, "08:00:AM", "Cool", 60, 72)}
+	schedule.DaySchedules["Wednesday"] = []ThermostatBlockSchedule{testBlock(t, office, 3, "08:00:AM", "Turbo", 60, 72)}
+	report, err := office.SetSchedule(schedule)
+	if err == nil {
+		t.Fatal("Setting a block with an invalid system succeeded")
+	}
+	if !report.RolledBack || !report.Verified || report.Error != err.Error() {
+		t.Errorf("Report %+v, want a verified rollback with error %q", report, err)
+	}
+	if len(report.Changes) != 2 || report.Changes[0].Day != "Monday" || report.Changes[1].Day != "Monday" {
+		t.Errorf("Report has changes %+v, want only Monday's", report.Changes)
+	}
+
+	tstat, _ := cloud.Thermostat("Office")
+	for day, blocks := range tstat.Schedules {
+		if len(blocks) != len(want) || blocks[0] != want[0] || blocks[1] != want[1] {
+			t.Errorf("%s has blocks %+v after the rollback, want %+v", week[day], blocks, want)
+		}
+	}
+}
+
+func TestScheduleRepeat(t *testing.T) {
+	cloud, pelicans := newTestSite(t, fakecloud.Thermostat{Name: "Office"})
+	defer cloud.Close()
+	office := pelicans["Office"]
+
+	daily := &ThermostatSchedule{
+		DaySchedules: map[string][]ThermostatBlockSchedule{"Monday": {testBlock(t, office, 1, "06:00:AM", "Auto", 66, 78)}},
+		Repeat:       REPEAT_DAILY,
+	}
+	report, err := office.SetSchedule(daily)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Verified || !report.RepeatChanged || report.Repeat != REPEAT_DAILY || len(report.ChangedDays) != len(week) {
+		t.Errorf("Report %+v, want a verified switch to Daily changing every day", report)
+	}
+	if tstat, _ := cloud.Thermostat("Office"); tstat.Repeat != "Daily" {
+		t.Errorf("Thermostat repeats %s, want Daily", tstat.Repeat)
+	}
+	read, err := office.GetSchedule()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blocks := read.DaySchedules["Friday"]; read.Repeat != REPEAT_DAILY || len(blocks) != 1 || blocks[0].HeatSetting != 66 {
+		t.Errorf("Schedule read back as %+v, want Monday's block on Friday", read)
+	}
+
+	// Without a repeat type, Daily is kept as long as every day agrees
+	daily.Repeat = ""
+	daily.DaySchedules["Friday"] = []ThermostatBlockSchedule{testBlock(t, office, 5, "06:00:AM", "Auto", 66, 78)}
+	if report, err = office.SetSchedule(daily); err != nil {
+		t.Fatal(err)
+	}
+	if report.Repeat != REPEAT_DAILY || report.RepeatChanged || len(report.Changes) != 0 {
+		t.Errorf("Report %+v, want Daily kept without changes", report)
+	}
+
+	// ...and Weekly is used once they don't
+	daily.DaySchedules["Friday"] = []ThermostatBlockSchedule{testBlock(t, office, 5, "09:00:AM", "Auto", 66, 78)}
+	if report, err = office.SetSchedule(daily); err != nil {
+		t.Fatal(err)
+	}
+	if report.Repeat != REPEAT_WEEKLY || !report.RepeatChanged {
+		t.Errorf("Report %+v, want a switch to Weekly", report)
+	}
+	if tstat, _ := cloud.Thermostat("Office"); tstat.Repeat != "Weekly" || tstat.Schedules[5][0].Start != "09:00" || tstat.Schedules[1][0].Start != "06:00" {
+		t.Errorf("Thermostat is %+v, want Weekly with Friday starting at 09:00", tstat)
+	}
+
+	// Days that disagree can't be written as Daily
+	daily.Repeat = REPEAT_DAILY
+	if _, err = office.SetSchedule(daily); err == nil {
+		t.Error("Set a Daily schedule whose Monday and Friday differ")
+	}
+	if tstat, _ := cloud.Thermostat("Office"); tstat.Repeat != "Weekly" {
+		t.Errorf("Thermostat repeats %s after a rejected schedule, want Weekly", tstat.Repeat)
+	}
+
+	if _, err = office.SetSchedule(&ThermostatSchedule{Repeat: "Monthly"}); err == nil {
+		t.Error("Set a schedule repeating Monthly")
+	}
+}
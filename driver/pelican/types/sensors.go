@@ -0,0 +1,92 @@
+package types
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Kinds of sensor that can be attached to a thermostat
+const (
+	SENSOR_KIND_OCCUPANCY   = "occupancy"
+	SENSOR_KIND_TEMPERATURE = "temperature"
+	SENSOR_KIND_HUMIDITY    = "humidity"
+	SENSOR_KIND_CO2         = "co2"
+)
+
+// A sensor attached to a thermostat, as listed in its slaves
+type PelicanSensor struct {
+	Name string
+	// Sensor type as reported by Pelican, e.g. "Temperature Sensor"
+	Type string
+	// One of the SENSOR_KIND_* constants, or empty if the type or value
+	// was not recognized
+	Kind string
+	// Value as reported by Pelican
+	Value string
+	// Value as a number: degrees Fahrenheit for temperature sensors, percent
+	// for humidity, ppm for CO2, and 1 (occupied) or 0 for occupancy
+	Reading float64
+}
+
+// GetSensors lists every sensor attached to the thermostat
+func (pel *Pelican) GetSensors() ([]*PelicanSensor, error) {
+	resp, errs := pel.session.api("get", "thermostat", fmt.Sprintf("name:%s;", pel.Name), "slaves;")
+
+	if errs != nil {
+		return nil, fmt.Errorf("Error retrieving thermostat sensor data: %s", errs)
+	}
+	defer resp.Body.Close()
+
+	var sensorResp occupancyResponse
+	dec := xml.NewDecoder(resp.Body)
+	if err := dec.Decode(&sensorResp); err != nil {
+		return nil, fmt.Errorf("Failed to decode sensor API result: %s", err)
+	}
+	if sensorResp.Success == 0 {
+		return nil, fmt.Errorf("Error retrieving thermostat sensor data: %s", sensorResp.Message)
+	}
+
+	return pel.sensorsFromAPI(sensorResp.Thermostat.Sensors), nil
+}
+
+func (pel *Pelican) sensorsFromAPI(children []childSensor) []*PelicanSensor {
+	sensors := make([]*PelicanSensor, 0, len(children))
+	for _, child := range children {
+		sensor := &PelicanSensor{
+			Name:  child.Name,
+			Type:  child.Type,
+			Value: child.Value,
+		}
+		sensorType := strings.ToLower(child.Type)
+		switch {
+		case strings.Contains(sensorType, "occupancy"):
+			sensor.Kind = SENSOR_KIND_OCCUPANCY
+			if strings.ToLower(child.Value) == "occupied" {
+				sensor.Reading = 1
+			}
+		case strings.Contains(sensorType, "temperature"):
+			sensor.Kind = SENSOR_KIND_TEMPERATURE
+		case strings.Contains(sensorType, "humidity"):
+			sensor.Kind = SENSOR_KIND_HUMIDITY
+		case strings.Contains(sensorType, "co2"):
+			sensor.Kind = SENSOR_KIND_CO2
+		}
+
+		if sensor.Kind != "" && sensor.Kind != SENSOR_KIND_OCCUPANCY {
+			// Values may carry a unit suffix, e.g. "45%" or "800ppm"
+			reading, err := strconv.ParseFloat(strings.TrimRight(child.Value, " %°FCfcpm"), 64)
+			if err != nil {
+				fmt.Printf("Thermostat %s sensor %s has unrecognized value %q\n", pel.Name, child.Name, child.Value)
+				sensor.Kind = ""
+			} else if sensor.Kind == SENSOR_KIND_TEMPERATURE {
+				sensor.Reading = pel.toFahrenheit(reading)
+			} else {
+				sensor.Reading = reading
+			}
+		}
+		sensors = append(sensors, sensor)
+	}
+	return sensors
+}
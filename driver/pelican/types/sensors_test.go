@@ -0,0 +1,70 @@
+package types
+
+import (
+	"testing"
+
+	"github.com/SoftwareDefinedBuildings/bw2-contrib/driver/pelican/fakecloud"
+)
+
+func TestGetSensors(t *testing.T) {
+	cloud, pelicans := newTestSite(t, fakecloud.Thermostat{Name: "Office", Slaves: []fakecloud.Slave{
+		{Name: "Desk", Type: "Occupancy Sensor", Value: "Occupied"},
+		{Name: "Door", Type: "Occupancy Sensor", Value: "Unoccupied"},
+		{Name: "Window", Type: "Temperature Sensor", Value: "68.5°F"},
+		{Name: "Plant", Type: "Humidity Sensor", Value: "45%"},
+		{Name: "Vent", Type: "CO2 Sensor", Value: "800 ppm"},
+		{Name: "Broken", Type: "Temperature Sensor", Value: "--"},
+		{Name: "Relay", Type: "Relay", Value: "On"},
+	}})
+	defer cloud.Close()
+
+	sensors, err := pelicans["Office"].GetSensors()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []PelicanSensor{
+		{Name: "Desk", Type: "Occupancy Sensor", Kind: SENSOR_KIND_OCCUPANCY, Value: "Occupied", Reading: 1},
+		{Name: "Door", Type: "Occupancy Sensor", Kind: SENSOR_KIND_OCCUPANCY, Value: "Unoccupied"},
+		{Name: "Window", Type: "Temperature Sensor", Kind: SENSOR_KIND_TEMPERATURE, Value: "68.5°F", Reading: 68.5},
+		{Name: "Plant", Type: "Humidity Sensor", Kind: SENSOR_KIND_HUMIDITY, Value: "45%", Reading: 45},
+		{Name: "Vent", Type: "CO2 Sensor", Kind: SENSOR_KIND_CO2, Value: "800 ppm", Reading: 800},
+		// Unrecognized values and types are listed without a kind
+		{Name: "Broken", Type: "Temperature Sensor", Value: "--"},
+		{Name: "Relay", Type: "Relay", Value: "On"},
+	}
+	if len(sensors) != len(want) {
+		t.Fatalf("Got %d sensors, want %d", len(sensors), len(want))
+	}
+	for i, sensor := range sensors {
+		if *sensor != want[i] {
+			t.Errorf("Sensor %d is %+v, want %+v", i, *sensor, want[i])
+		}
+	}
+}
+
+func TestGetSensorsCelsius(t *testing.T) {
+	cloud := fakecloud.New(testUsername, testPassword, testSitename, testTimezone)
+	defer cloud.Close()
+	cloud.SetTemperatureUnits("Celsius")
+	cloud.AddThermostat(fakecloud.Thermostat{Name: "Office", Slaves: []fakecloud.Slave{
+		{Name: "Window", Type: "Temperature Sensor", Value: "20°C"},
+		{Name: "Plant", Type: "Humidity Sensor", Value: "45%"},
+	}})
+	pelicans, err := DiscoverPelicans(testUsername, testPassword, testSitename, cloud.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sensors, err := pelicans[0].GetSensors()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sensors) != 2 || sensors[0].Reading != 68 || sensors[1].Reading != 45 {
+		t.Errorf("Sensors %+v, want 20C read as 68F and humidity unconverted", sensors)
+	}
+
+	cloud.Close()
+	if _, err := pelicans[0].GetSensors(); err == nil {
+		t.Error("Getting sensors from a site that is down succeeded")
+	}
+}
@@ -0,0 +1,224 @@
+package types
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/parnurzeal/gorequest"
+)
+
+// A login to a Pelican site, shared by all of the site's thermostats. The
+// api.cgi endpoint authenticates every request on its own, while the AJAX
+// endpoints used for schedules need a session cookie from the login page.
+type session struct {
+	baseURL  string
+	target   string
+	username string
+	password string
+	sitename string
+
+	// Held for the duration of a login, so concurrent callers wait for a
+	// single login instead of each starting their own
+	loginLock sync.Mutex
+
+	lock    sync.RWMutex
+	cookies []*http.Cookie
+	// Thermostat IDs keyed by thermostat name
+	ids map[string]string
+}
+
+// NotFoundError is returned when a site has no thermostat by the given name
+type NotFoundError struct {
+	Name     string
+	Sitename string
+}
+
+func (err *NotFoundError) Error() string {
+	return fmt.Sprintf("No thermostat named %s at site %s", err.Name, err.Sitename)
+}
+
+var sessionsLock sync.Mutex
+var sessions = make(map[string]*session)
+
+// Returns the session shared by every thermostat of a site
+func siteSession(baseURL, username, password, sitename string) *session {
+	key := fmt.Sprintf("%s|%s|%s", baseURL, sitename, username)
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	sess, ok := sessions[key]
+	if !ok || sess.password != password {
+		sess = &session{
+			baseURL:  baseURL,
+			target:   baseURL + "/api.cgi",
+			username: username,
+			password: password,
+			sitename: sitename,
+			ids:      make(map[string]string),
+		}
+		sessions[key] = sess
+	}
+	return sess
+}
+
+// Makes an api.cgi request. The credentials are sent as form fields in the
+// request body rather than in the URL, keeping them out of logs.
+func (sess *session) api(request, object, selection, value string) (gorequest.Response, []error) {
+	form := map[string]interface{}{
+		"username": sess.username,
+		"password": sess.password,
+		"request":  request,
+		"object":   object,
+		"value":    value,
+	}
+	if selection != "" {
+		form["selection"] = selection
+	}
+	resp, _, errs := gorequest.New().Post(sess.target).Type("form").Send(form).End()
+	return resp, errs
+}
+
+// Makes a GET request to an AJAX endpoint, given relative to the site's base
+// URL, and decodes the JSON response into result. Logs in if there is no
+// session yet, and once more if the session has expired.
+func (sess *session) ajax(path string, result interface{}) error {
+	sess.lock.RLock()
+	cookies := sess.cookies
+	sess.lock.RUnlock()
+	if cookies == nil {
+		if err := sess.login(nil); err != nil {
+			return err
+		}
+		sess.lock.RLock()
+		cookies = sess.cookies
+		sess.lock.RUnlock()
+	}
+
+	body, expired, err := sess.ajaxOnce(path, cookies)
+	if expired {
+		if err := sess.login(cookies); err != nil {
+			return err
+		}
+		sess.lock.RLock()
+		cookies = sess.cookies
+		sess.lock.RUnlock()
+		body, expired, err = sess.ajaxOnce(path, cookies)
+		if expired {
+			return fmt.Errorf("Session for site %s expired immediately after logging in", sess.sitename)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.NewDecoder(bytes.NewReader(body)).Decode(result); err != nil {
+		return fmt.Errorf("Failed to decode response JSON from %s: %v", path, err)
+	}
+	return nil
+}
+
+// Returns the response body, or whether the session was rejected
+func (sess *session) ajaxOnce(path string, cookies []*http.Cookie) ([]byte, bool, error) {
+	resp, body, errs := gorequest.New().Get(sess.baseURL + path).Type("form").AddCookies(cookies).EndBytes()
+	if errs != nil {
+		return nil, false, fmt.Errorf("Error requesting %s: %v", path, errs)
+	}
+	// An expired session is either refused outright or redirected to the login page
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden ||
+		bytes.HasPrefix(bytes.TrimSpace(body), []byte("<")) {
+		return nil, true, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, false, fmt.Errorf("Error requesting %s: %s", path, resp.Status)
+	}
+	return body, false, nil
+}
+
+// Logs in and refreshes the thermostat IDs, unless the session has already
+// moved on from the stale cookies since the caller last saw them
+func (sess *session) login(stale []*http.Cookie) error {
+	sess.loginLock.Lock()
+	defer sess.loginLock.Unlock()
+
+	sess.lock.RLock()
+	current := sess.cookies
+	sess.lock.RUnlock()
+	if current != nil && (stale == nil || &current[0] != &stale[0]) {
+		return nil
+	}
+
+	loginInfo := map[string]interface{}{
+		"username": sess.username,
+		"password": sess.password,
+		"sitename": sess.sitename,
+	}
+	respLogin, _, errsLogin := gorequest.New().Post(sess.baseURL + "/#_loginPage").Type("form").Send(loginInfo).End()
+	if errsLogin != nil {
+		return fmt.Errorf("Error logging into climate control website to retrieve cookie: %v", errsLogin)
+	}
+	if respLogin.StatusCode != http.StatusOK {
+		return fmt.Errorf("Error logging into climate control website to retrieve cookie: %s", respLogin.Status)
+	}
+	cookies := (*http.Response)(respLogin).Cookies()
+	if len(cookies) == 0 {
+		return fmt.Errorf("Climate control website login for site %s returned no session cookie", sess.sitename)
+	}
+
+	ids, err := sess.fetchIDs(cookies)
+	if err != nil {
+		return err
+	}
+
+	sess.lock.Lock()
+	defer sess.lock.Unlock()
+	sess.cookies = cookies
+	sess.ids = ids
+	return nil
+}
+
+// Retrieves the ID of every thermostat the login has access to
+func (sess *session) fetchIDs(cookies []*http.Cookie) (map[string]string, error) {
+	body, expired, err := sess.ajaxOnce("/ajaxSchedule.cgi?request=getResourcesExtended&resourceType=Thermostats", cookies)
+	if expired {
+		return nil, fmt.Errorf("Session for site %s expired immediately after logging in", sess.sitename)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error retrieving Thermostat IDs: %v", err)
+	}
+	var IDRequest thermIDRequest
+	if err := json.NewDecoder(bytes.NewReader(body)).Decode(&IDRequest); err != nil {
+		return nil, fmt.Errorf("Failed to decode Thermostat ID response JSON: %v", err)
+	}
+
+	ids := make(map[string]string)
+	for _, resource := range IDRequest.Resources {
+		for _, child := range resource.Children {
+			ids[child.Name] = child.Id
+		}
+	}
+	return ids, nil
+}
+
+// Looks up a thermostat's ID by name, logging in again to pick up
+// thermostats added or renamed since the last login
+func (sess *session) thermostatID(name string) (string, error) {
+	sess.lock.RLock()
+	cookies := sess.cookies
+	id, ok := sess.ids[name]
+	sess.lock.RUnlock()
+	if ok {
+		return id, nil
+	}
+
+	if err := sess.login(cookies); err != nil {
+		return "", err
+	}
+	sess.lock.RLock()
+	id, ok = sess.ids[name]
+	sess.lock.RUnlock()
+	if !ok {
+		return "", &NotFoundError{Name: name, Sitename: sess.sitename}
+	}
+	return id, nil
+}
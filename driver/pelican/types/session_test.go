@@ -0,0 +1,93 @@
+package types
+
+import (
+	"testing"
+
+	"github.com/SoftwareDefinedBuildings/bw2-contrib/driver/pelican/fakecloud"
+)
+
+// Thermostats of a site share one login, renewed when the site expires it
+func TestSessionExpiry(t *testing.T) {
+	cloud, pelicans := newTestSite(t, fakecloud.Thermostat{Name: "Office"}, fakecloud.Thermostat{Name: "Lobby"})
+	defer cloud.Close()
+	office, lobby := pelicans["Office"], pelicans["Lobby"]
+	if office.session != lobby.session {
+		t.Error("Office and Lobby have separate sessions")
+	}
+
+	if _, err := office.GetSchedule(); err != nil {
+		t.Fatal(err)
+	}
+	cookies := office.session.cookies
+
+	cloud.ExpireSessions()
+	if _, err := lobby.GetSchedule(); err != nil {
+		t.Fatalf("Reading a schedule after the session expired failed: %v", err)
+	}
+	if &office.session.cookies[0] == &cookies[0] {
+		t.Error("Session kept its expired cookies")
+	}
+	if _, err := office.GetSchedule(); err != nil {
+		t.Errorf("Reading a schedule with the renewed session failed: %v", err)
+	}
+}
+
+// A thermostat added after the last login is found by logging in again
+func TestThermostatID(t *testing.T) {
+	cloud, pelicans := newTestSite(t, fakecloud.Thermostat{Name: "Office"})
+	defer cloud.Close()
+	if _, err := pelicans["Office"].GetSchedule(); err != nil {
+		t.Fatal(err)
+	}
+
+	cloud.AddThermostat(fakecloud.Thermostat{Name: "Annex"})
+	params := &NewPelicanParams{
+		Username: testUsername,
+		Password: testPassword,
+		Sitename: testSitename,
+		Name:     "Annex",
+		Timezone: testTimezone,
+		BaseURL:  cloud.URL(),
+	}
+	annex, err := NewPelican(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tstat, _ := cloud.Thermostat("Annex"); annex.ID() != tstat.ID {
+		t.Errorf("Annex has ID %q, want %q", annex.ID(), tstat.ID)
+	}
+	if _, err := annex.GetSchedule(); err != nil {
+		t.Errorf("Reading the new thermostat's schedule failed: %v", err)
+	}
+
+	params.Name = "Basement"
+	if _, err := NewPelican(params); err == nil {
+		t.Error("Created a thermostat the site doesn't have")
+	} else if _, ok := err.(*NotFoundError); !ok {
+		t.Errorf("Creating a thermostat the site doesn't have failed with %v, want a NotFoundError", err)
+	}
+	params.Name = "Annex"
+	cloud.Close()
+	if _, err := NewPelican(params); err == nil {
+		t.Error("Created a thermostat while the site is down")
+	} else if _, ok := err.(*NotFoundError); ok {
+		t.Errorf("Site being down reported as %v", err)
+	}
+}
+
+// Requests to a site that can't be reached fail instead of panicking
+func TestSiteDown(t *testing.T) {
+	cloud, pelicans := newTestSite(t, fakecloud.Thermostat{Name: "Office"})
+	cloud.Close()
+	office := pelicans["Office"]
+
+	if status, err := office.GetStatus(); err == nil {
+		t.Errorf("GetStatus of a site that is down returned %+v", status)
+	}
+	if err := office.ModifyState(&PelicanStateParams{HeatingSetpoint: float(70)}); err == nil {
+		t.Error("ModifyState of a site that is down succeeded")
+	}
+	if _, err := office.GetOccupancy(); err == nil {
+		t.Error("GetOccupancy of a site that is down succeeded")
+	}
+}
@@ -0,0 +1,151 @@
+package types
+
+import (
+	"encoding/xml"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// PelicanSite polls every thermostat at a site together. A poll costs two API
+// calls (Thermostat and ThermostatHistory) regardless of the number of
+// thermostats, instead of two GetStatus calls plus a GetOccupancy call each.
+type PelicanSite struct {
+	target   string
+	timezone *time.Location
+	session  *session
+
+	pelicansLock sync.RWMutex
+	pelicans     map[string]*Pelican
+}
+
+// PelicanReading is one thermostat's share of a site poll
+type PelicanReading struct {
+	// nil while the thermostat is unreachable
+	Status *PelicanStatus
+	// One of OCCUPANCY_UNKNOWN, OCCUPANCY_OCCUPIED or OCCUPANCY_UNOCCUPIED
+	Occupancy int
+	// Every sensor attached to the thermostat
+	Sensors []*PelicanSensor
+}
+
+// Site-wide Thermostat Object API Result Structs
+type apiResultThermostats struct {
+	XMLName     xml.Name            `xml:"result"`
+	Success     int32               `xml:"success"`
+	Message     string              `xml:"message"`
+	Thermostats []apiSiteThermostat `xml:"Thermostat"`
+}
+
+type apiSiteThermostat struct {
+	Name string `xml:"name"`
+	apiThermostat
+	Sensors []childSensor `xml:"slaves"`
+}
+
+type apiResultSiteHistory struct {
+	XMLName xml.Name     `xml:"result"`
+	Success int          `xml:"success"`
+	Message string       `xml:"message"`
+	Records []apiRecords `xml:"ThermostatHistory"`
+}
+
+// NewPelicanSite groups thermostats created by NewPelican or DiscoverPelicans.
+// All of them must belong to the same site.
+func NewPelicanSite(pelicans []*Pelican) (*PelicanSite, error) {
+	if len(pelicans) == 0 {
+		return nil, fmt.Errorf("No thermostats to poll")
+	}
+
+	first := pelicans[0]
+	site := &PelicanSite{
+		target:   first.target,
+		timezone: first.timezone,
+		session:  first.session,
+		pelicans: make(map[string]*Pelican, len(pelicans)),
+	}
+	for _, pel := range pelicans {
+		if err := site.Add(pel); err != nil {
+			return nil, err
+		}
+	}
+	return site, nil
+}
+
+// Add includes a thermostat in future polls, replacing any with the same name
+func (site *PelicanSite) Add(pel *Pelican) error {
+	if pel.session != site.session {
+		return fmt.Errorf("Thermostat %s does not belong to site at %s", pel.Name, site.target)
+	}
+	site.pelicansLock.Lock()
+	defer site.pelicansLock.Unlock()
+	site.pelicans[pel.Name] = pel
+	return nil
+}
+
+// Remove excludes the named thermostat from future polls
+func (site *PelicanSite) Remove(name string) {
+	site.pelicansLock.Lock()
+	defer site.pelicansLock.Unlock()
+	delete(site.pelicans, name)
+}
+
+// Poll retrieves the status and occupancy of every thermostat at the site,
+// keyed by thermostat name. Thermostats the API did not report are omitted.
+func (site *PelicanSite) Poll() (map[string]*PelicanReading, error) {
+	resp, errs := site.session.api("get", "Thermostat", "", "name;"+statusValues+";slaves")
+	if errs != nil {
+		return nil, fmt.Errorf("Error retrieving site status from %s: %v", site.target, errs)
+	}
+
+	defer resp.Body.Close()
+	var result apiResultThermostats
+	dec := xml.NewDecoder(resp.Body)
+	if err := dec.Decode(&result); err != nil {
+		return nil, fmt.Errorf("Failed to decode response XML: %v", err)
+	}
+	if result.Success == 0 {
+		return nil, fmt.Errorf("Error retrieving site status from %s: %s", resp.Request.URL, result.Message)
+	}
+
+	// Thermostat History Object Request to retrieve time stamps from past hour
+	endTime := time.Now().In(site.timezone).Format(time.RFC3339)
+	startTime := time.Now().Add(-1 * time.Hour).In(site.timezone).Format(time.RFC3339)
+	respHist, errsHist := site.session.api("get", "ThermostatHistory", fmt.Sprintf("startDateTime:%s;endDateTime:%s;", startTime, endTime), "timestamp")
+	if errsHist != nil {
+		return nil, fmt.Errorf("Error retrieving site history from %s: %v", site.target, errsHist)
+	}
+
+	defer respHist.Body.Close()
+	var histResult apiResultSiteHistory
+	histDec := xml.NewDecoder(respHist.Body)
+	if err := histDec.Decode(&histResult); err != nil {
+		return nil, fmt.Errorf("Failed to decode response XML: %v", err)
+	}
+	if histResult.Success == 0 {
+		return nil, fmt.Errorf("Error retrieving site history from %s: %s", respHist.Request.URL, histResult.Message)
+	}
+
+	site.pelicansLock.RLock()
+	defer site.pelicansLock.RUnlock()
+	for _, records := range histResult.Records {
+		if pel, ok := site.pelicans[records.Name]; ok {
+			pel.checkHistory(records.History)
+		}
+	}
+
+	readings := make(map[string]*PelicanReading, len(result.Thermostats))
+	for i := range result.Thermostats {
+		thermostat := &result.Thermostats[i]
+		pel, ok := site.pelicans[thermostat.Name]
+		if !ok {
+			continue
+		}
+		readings[pel.Name] = &PelicanReading{
+			Status:    pel.statusFromAPI(&thermostat.apiThermostat),
+			Occupancy: occupancyFromSensors(thermostat.Sensors),
+			Sensors:   pel.sensorsFromAPI(thermostat.Sensors),
+		}
+	}
+	return readings, nil
+}
@@ -0,0 +1,86 @@
+package types
+
+import (
+	"testing"
+
+	"github.com/SoftwareDefinedBuildings/bw2-contrib/driver/pelican/fakecloud"
+)
+
+func TestPoll(t *testing.T) {
+	cloud, pelicans := newTestSite(t,
+		fakecloud.Thermostat{Name: "Office", Temperature: 70, RunStatus: "Cool-Stage1", Slaves: []fakecloud.Slave{
+			{Name: "Desk", Type: "Occupancy Sensor", Value: "Occupied"},
+		}},
+		fakecloud.Thermostat{Name: "Lobby", Temperature: 65},
+		fakecloud.Thermostat{Name: "Closet", StatusDisplay: "Unreachable"},
+		fakecloud.Thermostat{Name: "Attic"})
+	defer cloud.Close()
+
+	var tracked []*Pelican
+	for name, pel := range pelicans {
+		if name != "Attic" {
+			tracked = append(tracked, pel)
+		}
+	}
+	site, err := NewPelicanSite(tracked)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := cloud.RequestCount()
+	readings, err := site.Poll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := cloud.RequestCount() - before; n != 2 {
+		t.Errorf("Polling 3 thermostats took %d requests, want 2", n)
+	}
+
+	if len(readings) != 3 {
+		t.Errorf("Polled %d thermostats, want 3 without the untracked Attic", len(readings))
+	}
+	office := readings["Office"]
+	if office == nil || office.Status == nil || office.Status.Temperature != 70 || office.Status.State != STATE_COOL_STAGE1 ||
+		office.Occupancy != OCCUPANCY_OCCUPIED || len(office.Sensors) != 1 {
+		t.Errorf("Office reading %+v, want cooling at 70F, occupied, with 1 sensor", office)
+	}
+	if lobby := readings["Lobby"]; lobby == nil || lobby.Status == nil || lobby.Status.Temperature != 65 ||
+		lobby.Occupancy != OCCUPANCY_UNKNOWN {
+		t.Errorf("Lobby reading %+v, want 65F with unknown occupancy", lobby)
+	}
+	if closet := readings["Closet"]; closet == nil || closet.Status != nil {
+		t.Errorf("Closet reading %+v, want no status while unreachable", closet)
+	}
+
+	// Removed thermostats are left out of later polls
+	site.Remove("Lobby")
+	if readings, err = site.Poll(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := readings["Lobby"]; ok || len(readings) != 2 {
+		t.Errorf("Polled %d thermostats after removing Lobby, want 2", len(readings))
+	}
+
+	cloud.Close()
+	if _, err := site.Poll(); err == nil {
+		t.Error("Polling a site that is down succeeded")
+	}
+}
+
+func TestPelicanSiteAdd(t *testing.T) {
+	cloud, pelicans := newTestSite(t, fakecloud.Thermostat{Name: "Office"})
+	defer cloud.Close()
+	other, others := newTestSite(t, fakecloud.Thermostat{Name: "Office"})
+	defer other.Close()
+
+	site, err := NewPelicanSite([]*Pelican{pelicans["Office"]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := site.Add(others["Office"]); err == nil {
+		t.Error("Added a thermostat from another site")
+	}
+	if _, err := NewPelicanSite(nil); err == nil {
+		t.Error("Created a site without thermostats")
+	}
+}
@@ -0,0 +1,135 @@
+package types
+
+import (
+	"testing"
+	"time"
+
+	"github.com/SoftwareDefinedBuildings/bw2-contrib/driver/pelican/fakecloud"
+)
+
+func stages(v int32) *int32 { return &v }
+
+func TestModifyStages(t *testing.T) {
+	cloud, pelicans := newTestSite(t, fakecloud.Thermostat{Name: "Office", System: "Heat"})
+	defer cloud.Close()
+	office := pelicans["Office"]
+
+	change, err := office.ModifyStages(&PelicanStageParams{HeatingStages: stages(2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if change == nil || change.PreviousHeatStages != 1 || change.HeatStages != 2 || change.Mode != 1 || !change.Restored {
+		t.Errorf("Stage change %+v, want from 1 to 2 heating stages and restored to heating", change)
+	}
+	if tstat, _ := cloud.Thermostat("Office"); tstat.HeatStages != 2 || tstat.CoolStages != 1 || tstat.System != "Heat" {
+		t.Errorf("Thermostat is %+v, want heating with 2 heating stages", tstat)
+	}
+
+	// Nothing to do, so the thermostat is left running
+	before := cloud.RequestCount()
+	if change, err := office.ModifyStages(&PelicanStageParams{HeatingStages: stages(2), CoolingStages: stages(1)}); change != nil || err != nil {
+		t.Errorf("Repeated stage change returned %+v, %v; want nil, nil", change, err)
+	}
+	if n := cloud.RequestCount() - before; n != 2 {
+		t.Errorf("Unchanged stages took %d requests, want 2 to read the status", n)
+	}
+
+	cloud.UpdateThermostat("Office", func(tstat *fakecloud.Thermostat) { tstat.StatusDisplay = "Unreachable" })
+	if change, err := office.ModifyStages(&PelicanStageParams{HeatingStages: stages(1)}); err == nil {
+		t.Errorf("ModifyStages of an unreachable thermostat returned %+v, want an error", change)
+	}
+	if tstat, _ := cloud.Thermostat("Office"); tstat.HeatStages != 2 || tstat.System != "Heat" {
+		t.Errorf("Unreachable thermostat was changed to %+v", tstat)
+	}
+}
+
+// The thermostat stays off for at least MinOffTime while its stages change
+func TestModifyStagesMinOffTime(t *testing.T) {
+	cloud, pelicans := newTestSite(t,
+		fakecloud.Thermostat{Name: "Office", System: "Cool"},
+		fakecloud.Thermostat{Name: "Lobby", System: "Off"})
+	defer cloud.Close()
+
+	minOffTime := 300 * time.Millisecond
+	start := time.Now()
+	done := make(chan *PelicanStageChange)
+	go func() {
+		change, err := pelicans["Office"].ModifyStages(&PelicanStageParams{CoolingStages: stages(2), MinOffTime: minOffTime})
+		if err != nil {
+			t.Error(err)
+		}
+		done <- change
+	}()
+	time.Sleep(minOffTime / 3)
+	if tstat, _ := cloud.Thermostat("Office"); tstat.System != "Off" || tstat.CoolStages != 2 {
+		t.Errorf("Thermostat is %+v while its stages change, want off with 2 cooling stages", tstat)
+	}
+	change := <-done
+	if elapsed := time.Since(start); elapsed < minOffTime {
+		t.Errorf("Thermostat was turned back on after %v, want at least %v", elapsed, minOffTime)
+	}
+	if tstat, _ := cloud.Thermostat("Office"); tstat.System != "Cool" || change == nil || !change.Restored {
+		t.Errorf("Thermostat is %+v after %+v, want cooling again", tstat, change)
+	}
+
+	// A thermostat that is already off is changed without waiting or turning it on
+	start = time.Now()
+	change, err := pelicans["Lobby"].ModifyStages(&PelicanStageParams{HeatingStages: stages(2), MinOffTime: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) > minOffTime {
+		t.Errorf("Changing the stages of a thermostat that is off took %v", time.Since(start))
+	}
+	if tstat, _ := cloud.Thermostat("Lobby"); tstat.System != "Off" || tstat.HeatStages != 2 || !change.Restored {
+		t.Errorf("Thermostat is %+v after %+v, want off with 2 heating stages", tstat, change)
+	}
+}
+
+// A rejected stage change still turns the thermostat back on
+func TestModifyStagesRejected(t *testing.T) {
+	cloud, pelicans := newTestSite(t, fakecloud.Thermostat{Name: "Office", System: "Auto"})
+	defer cloud.Close()
+
+	change, err := pelicans["Office"].ModifyStages(&PelicanStageParams{HeatingStages: stages(3)})
+	if err == nil {
+		t.Fatal("Setting 3 heating stages succeeded")
+	}
+	if change == nil || change.HeatStages != 1 || change.Error == "" || !change.Restored {
+		t.Errorf("Stage change %+v, want 1 heating stage kept with an error, and restored", change)
+	}
+	if tstat, _ := cloud.Thermostat("Office"); tstat.System != "Auto" || tstat.HeatStages != 1 {
+		t.Errorf("Thermostat is %+v, want back in auto with 1 heating stage", tstat)
+	}
+}
+
+// A thermostat that can't be turned back on is reported as left off
+func TestModifyStagesNotRestored(t *testing.T) {
+	defer func(delay time.Duration) { stageRestoreRetryDelay = delay }(stageRestoreRetryDelay)
+	stageRestoreRetryDelay = 10 * time.Millisecond
+
+	cloud, pelicans := newTestSite(t, fakecloud.Thermostat{Name: "Office", System: "Heat"})
+	minOffTime := 300 * time.Millisecond
+	done := make(chan error)
+	var change *PelicanStageChange
+	go func() {
+		var err error
+		change, err = pelicans["Office"].ModifyStages(&PelicanStageParams{HeatingStages: stages(2), MinOffTime: minOffTime})
+		done <- err
+	}()
+	// The site goes down while the thermostat is off
+	time.Sleep(minOffTime / 3)
+	cloud.Close()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("ModifyStages succeeded without restoring the thermostat")
+		}
+	case <-time.After(minOffTime + stageRestoreAttempts*time.Second):
+		t.Fatal("ModifyStages kept retrying")
+	}
+	if change == nil || change.Restored || change.HeatStages != 2 || change.Error == "" {
+		t.Errorf("Stage change %+v, want 2 heating stages, not restored, with an error", change)
+	}
+}
@@ -2,16 +2,14 @@ package types
 
 import (
 	"bytes"
-	"encoding/json"
 	"fmt"
-	"net/http"
 	"strconv"
 	"time"
 
 	rrule "github.com/teambition/rrule-go"
 )
 
-// Login, Authentication, Thermostat ID Retrieval Structs
+// Thermostat ID Retrieval Structs
 type thermIDRequest struct {
 	Resources []thermIDResources `json:"resources"`
 }
@@ -24,6 +22,7 @@ type thermIDResources struct {
 
 type thermIDChild struct {
 	Id          string `json:"id"`
+	Name        string `json:"name"`
 	Permissions string `json:"permissions"`
 }
 
@@ -63,8 +62,17 @@ type scheduleTimeBlock struct {
 // Struct mapping each day of the week to its daily schedule
 type ThermostatSchedule struct {
 	DaySchedules map[string]([]ThermostatBlockSchedule) `msgpack:"day_schedules"`
+	// One of the REPEAT_* types. Optional when setting a schedule.
+	Repeat string `msgpack:"repeat"`
 }
 
+// Schedule repeat types, as named by the Pelican API
+const (
+	REPEAT_DAILY           = "Daily"
+	REPEAT_WEEKLY          = "Weekly"
+	REPEAT_WEEKDAY_WEEKEND = "Weekday/Weekend"
+)
+
 // Struct containing data defining the settings of each schedule block
 type ThermostatBlockSchedule struct {
 	CoolSetting float64 `msgpack:"cool_setting"`
@@ -73,20 +81,15 @@ type ThermostatBlockSchedule struct {
 	Time        string  `msgpack:"time"`
 }
 
-// Time Constant for Cookie Refresh. 720 Hours = 30 Days
-const cookieDuration = 720 * time.Hour
-
 var week = [...]string{"Sunday", "Monday", "Tuesday", "Wednesday", "Thursday", "Friday", "Saturday"}
+
+// Block start times are anchored to the week beginning on this Sunday, so
+// their RRules stay parseable and fall on the block's day of the week
+var rruleSunday = time.Date(1970, time.January, 4, 0, 0, 0, 0, time.UTC)
+
 var weekRRule = [...]rrule.Weekday{rrule.SU, rrule.MO, rrule.TU, rrule.WE, rrule.TH, rrule.FR, rrule.SA}
 
 func (pel *Pelican) GetSchedule() (*ThermostatSchedule, error) {
-	// Check if cookie needs to be refreshed
-	if time.Since(pel.cookieTime) > cookieDuration {
-		if cookieAndIDError := pel.setCookieAndID(); cookieAndIDError != nil {
-			return nil, cookieAndIDError
-		}
-	}
-
 	thermSchedule := ThermostatSchedule{
 		DaySchedules: make(map[string]([]ThermostatBlockSchedule), len(week)),
 	}
@@ -99,9 +102,10 @@ func (pel *Pelican) GetSchedule() (*ThermostatSchedule, error) {
 	repeatType := settings.Repeat
 	nodename := settings.Nodename
 	epnum := settings.Epnum
+	thermSchedule.Repeat = repeatType
 
 	// Build Schedule by Repeat Type
-	if repeatType == "Daily" {
+	if repeatType == REPEAT_DAILY {
 		schedule, scheduleError := pel.getScheduleByDay(0, epnum, nodename)
 		if scheduleError != nil {
 			return nil, fmt.Errorf("Error retrieving schedule for thermostat %v: %v", nodename, scheduleError)
@@ -109,7 +113,7 @@ func (pel *Pelican) GetSchedule() (*ThermostatSchedule, error) {
 		for _, day := range week {
 			thermSchedule.DaySchedules[day] = *schedule
 		}
-	} else if repeatType == "Weekly" {
+	} else if repeatType == REPEAT_WEEKLY {
 		for index, day := range week {
 			schedule, scheduleError := pel.getScheduleByDay(index, epnum, nodename)
 			if scheduleError != nil {
@@ -117,7 +121,7 @@ func (pel *Pelican) GetSchedule() (*ThermostatSchedule, error) {
 			}
 			thermSchedule.DaySchedules[day] = *schedule
 		}
-	} else if repeatType == "Weekday/Weekend" {
+	} else if repeatType == REPEAT_WEEKDAY_WEEKEND {
 		weekend, weekendError := pel.getScheduleByDay(0, epnum, nodename)
 		if weekendError != nil {
 			return nil, fmt.Errorf("Error retrieving schedule for thermostat %v on weekend (day 0): %v", nodename, weekendError)
@@ -141,18 +145,13 @@ func (pel *Pelican) GetSchedule() (*ThermostatSchedule, error) {
 
 func (pel *Pelican) getSettings() (*settingsWrapper, error) {
 	var requestURL bytes.Buffer
-	requestURL.WriteString(fmt.Sprintf("https://%s.officeclimatecontrol.net/ajaxThermostat.cgi?id=", pel.sitename))
+	requestURL.WriteString("/ajaxThermostat.cgi?id=")
 	requestURL.WriteString(pel.id)
 	requestURL.WriteString(":Thermostat&request=GetSchedule")
 
-	resp, _, errs := pel.scheduleReq.Get(requestURL.String()).Type("form").AddCookie(pel.cookie).End()
-	if errs != nil {
-		return nil, fmt.Errorf("Failed to retrieve schedule settings for thermostat %v: %v", pel.id, errs)
-	}
 	var result settingsRequest
-	decoder := json.NewDecoder(resp.Body)
-	if decodeError := decoder.Decode(&result); decodeError != nil {
-		return nil, fmt.Errorf("Failed to decode schedule settings for thermostat %v: %v", pel.id, decodeError)
+	if err := pel.session.ajax(requestURL.String(), &result); err != nil {
+		return nil, fmt.Errorf("Failed to retrieve schedule settings for thermostat %v: %v", pel.id, err)
 	}
 	return &result.Userdata, nil
 }
@@ -160,7 +159,7 @@ func (pel *Pelican) getSettings() (*settingsWrapper, error) {
 func (pel *Pelican) getScheduleByDay(dayOfWeek int, epnum float64, thermostatID string) (*[]ThermostatBlockSchedule, error) {
 	// Construct Request URL for Thermostat Schedule by Day of Week
 	var requestURL bytes.Buffer
-	requestURL.WriteString(fmt.Sprintf("https://%s.officeclimatecontrol.net/thermDayEdit.cgi?section=json&nodename=", pel.sitename))
+	requestURL.WriteString("/thermDayEdit.cgi?section=json&nodename=")
 	requestURL.WriteString(thermostatID)
 	requestURL.WriteString("&epnum=")
 	requestURL.WriteString(fmt.Sprintf("%.0f", epnum))
@@ -168,22 +167,17 @@ func (pel *Pelican) getScheduleByDay(dayOfWeek int, epnum float64, thermostatID
 	requestURL.WriteString(strconv.Itoa(dayOfWeek))
 
 	// Make Request, Decode into Response Struct
-	resp, _, errs := pel.scheduleReq.Get(requestURL.String()).Type("form").AddCookie(pel.cookie).End()
-	if errs != nil {
-		return nil, fmt.Errorf("Failed to retrieve schedule for thermostat %v on day of week %v: %v", thermostatID, dayOfWeek, errs)
-	}
 	var result scheduleRequest
-	decoder := json.NewDecoder(resp.Body)
-	if decodeError := decoder.Decode(&result); decodeError != nil {
-		return nil, fmt.Errorf("Failed to decode schedule for thermostat %v on day of week %v: %v", thermostatID, dayOfWeek, decodeError)
+	if err := pel.session.ajax(requestURL.String(), &result); err != nil {
+		return nil, fmt.Errorf("Failed to retrieve schedule for thermostat %v on day of week %v: %v", thermostatID, dayOfWeek, err)
 	}
 
 	// Transfer Response Struct Data into return struct
 	var daySchedule []ThermostatBlockSchedule
 	for _, block := range result.ClientData.SetTimes {
 		returnBlock := ThermostatBlockSchedule{
-			CoolSetting: block.CoolSetting,
-			HeatSetting: block.HeatSetting,
+			CoolSetting: pel.toFahrenheit(block.CoolSetting),
+			HeatSetting: pel.toFahrenheit(block.HeatSetting),
 			System:      block.System,
 		}
 
@@ -206,7 +200,7 @@ func convertTimeToRRule(dayOfWeek int, blockTime string, timezone *time.Location
 	rruleSched, rruleSchedErr := rrule.NewRRule(rrule.ROption{
 		Freq:    rrule.WEEKLY,
 		Wkst:    weekRRule[dayOfWeek],
-		Dtstart: time.Date(0, 0, 0, timeParsed.Hour(), timeParsed.Minute(), 0, 0, timezone),
+		Dtstart: time.Date(1970, time.January, rruleSunday.Day()+dayOfWeek, timeParsed.Hour(), timeParsed.Minute(), 0, 0, timezone),
 	})
 	if rruleSchedErr != nil {
 		return "", fmt.Errorf("Error creating rruleSchedule object: %v\n", rruleSchedErr)
@@ -214,32 +208,3 @@ func convertTimeToRRule(dayOfWeek int, blockTime string, timezone *time.Location
 
 	return rruleSched.String(), nil
 }
-
-// Handles setting the Pelican fields (cookie, id) that can only be retrieved by AJAX Requests
-func (pel *Pelican) setCookieAndID() error {
-	// Set the cookie field using the pelican's login information
-	loginInfo := map[string]interface{}{
-		"username": pel.username,
-		"password": pel.password,
-		"sitename": pel.sitename,
-	}
-	respLogin, _, errsLogin := pel.scheduleReq.Post(fmt.Sprintf("https://%s.officeclimatecontrol.net/#_loginPage", pel.sitename)).Type("form").Send(loginInfo).End()
-	if (errsLogin != nil) || (respLogin.StatusCode != 200) {
-		return fmt.Errorf("Error logging into climate control website to retrieve cookie: %v", errsLogin)
-	}
-	pel.cookie = (*http.Response)(respLogin).Cookies()[0]
-	pel.cookieTime = time.Now()
-
-	// Set the Thermostat ID using the thermostat resources AJAX Request
-	respTherms, _, errsTherms := pel.scheduleReq.Get(fmt.Sprintf("https://%s.officeclimatecontrol.net/ajaxSchedule.cgi?request=getResourcesExtended&resourceType=Thermostats", pel.sitename)).Type("form").AddCookie(pel.cookie).End()
-	if (errsTherms != nil) || (respTherms.StatusCode != 200) {
-		return fmt.Errorf("Error retrieving Thermostat IDs: %v", errsTherms)
-	}
-	var IDRequest thermIDRequest
-	decoder := json.NewDecoder(respTherms.Body)
-	if decodeError := decoder.Decode(&IDRequest); decodeError != nil {
-		return fmt.Errorf("Failed to decode Thermostat ID response JSON: %v\n", decodeError)
-	}
-	pel.id = IDRequest.Resources[0].Children[0].Id
-	return nil
-}
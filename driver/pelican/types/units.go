@@ -0,0 +1,70 @@
+package types
+
+import (
+	"encoding/xml"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// All temperatures exchanged with the rest of the driver (PelicanStatus, the
+// setpoint/state params, ThermostatSchedule) are in Fahrenheit. Sites
+// configured for Celsius are converted at the API boundary.
+const (
+	TEMP_UNIT_FAHRENHEIT = "F"
+	TEMP_UNIT_CELSIUS    = "C"
+)
+
+type apiResultUnits struct {
+	XMLName   xml.Name `xml:"result"`
+	Success   int      `xml:"success"`
+	Message   string   `xml:"message"`
+	Attribute struct {
+		TemperatureUnits string `xml:"temperatureUnits"`
+	} `xml:"attribute"`
+}
+
+// Retrieves the temperature unit the site's thermostats are configured to use
+func fetchTemperatureUnit(sess *session) (string, error) {
+	resp, errs := sess.api("get", "Site", "", "temperatureUnits;")
+	if errs != nil {
+		return "", fmt.Errorf("Error retrieving site temperature units from %s: %v", sess.target, errs)
+	}
+
+	defer resp.Body.Close()
+	var result apiResultUnits
+	dec := xml.NewDecoder(resp.Body)
+	if err := dec.Decode(&result); err != nil {
+		return "", fmt.Errorf("Failed to decode response XML: %v", err)
+	}
+	if result.Success == 0 {
+		return "", fmt.Errorf("Error retrieving site temperature units from %s: %s", sess.target, result.Message)
+	}
+	return parseTemperatureUnit(result.Attribute.TemperatureUnits), nil
+}
+
+// Accepts "C"/"Celsius" in any case; everything else is the API's default of Fahrenheit
+func parseTemperatureUnit(unit string) string {
+	if strings.HasPrefix(strings.ToUpper(strings.TrimSpace(unit)), TEMP_UNIT_CELSIUS) {
+		return TEMP_UNIT_CELSIUS
+	}
+	return TEMP_UNIT_FAHRENHEIT
+}
+
+// Converts a temperature reported by the thermostat into Fahrenheit
+func (pel *Pelican) toFahrenheit(temp float64) float64 {
+	if pel.temperatureUnit != TEMP_UNIT_CELSIUS {
+		return temp
+	}
+	return temp*9/5 + 32
+}
+
+// Formats a Fahrenheit setpoint in the thermostat's native unit for a set
+// request. Celsius thermostats accept half-degree steps, Fahrenheit whole degrees.
+func (pel *Pelican) formatSetting(fahrenheit float64) string {
+	if pel.temperatureUnit != TEMP_UNIT_CELSIUS {
+		return fmt.Sprintf("%d", int(math.Round(fahrenheit)))
+	}
+	celsius := (fahrenheit - 32) * 5 / 9
+	return fmt.Sprintf("%.1f", math.Round(celsius*2)/2)
+}
@@ -0,0 +1,69 @@
+package types
+
+import (
+	"math"
+	"testing"
+
+	"github.com/SoftwareDefinedBuildings/bw2-contrib/driver/pelican/fakecloud"
+)
+
+func TestParseTemperatureUnit(t *testing.T) {
+	for unit, want := range map[string]string{
+		"Celsius":    TEMP_UNIT_CELSIUS,
+		" c ":        TEMP_UNIT_CELSIUS,
+		"Fahrenheit": TEMP_UNIT_FAHRENHEIT,
+		"":           TEMP_UNIT_FAHRENHEIT,
+	} {
+		if got := parseTemperatureUnit(unit); got != want {
+			t.Errorf("parseTemperatureUnit(%q) = %s, want %s", unit, got, want)
+		}
+	}
+}
+
+// Everything the driver sees is in Fahrenheit, whatever the site's unit
+func TestCelsius(t *testing.T) {
+	cloud := fakecloud.New(testUsername, testPassword, testSitename, testTimezone)
+	defer cloud.Close()
+	cloud.SetTemperatureUnits("Celsius")
+	cloud.AddThermostat(fakecloud.Thermostat{Name: "Office", Temperature: 21, HeatSetting: 20, CoolSetting: 25})
+	pelicans, err := DiscoverPelicans(testUsername, testPassword, testSitename, cloud.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	office := pelicans[0]
+
+	status, err := office.GetStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(status.Temperature-69.8) > 1e-9 || status.HeatingSetpoint != 68 || status.CoolingSetpoint != 77 {
+		t.Errorf("Status %+v, want 69.8F with setpoints 68/77", status)
+	}
+
+	// Setpoints are written in half degrees Celsius
+	if err := office.ModifyState(&PelicanStateParams{HeatingSetpoint: float(70), CoolingSetpoint: float(78)}); err != nil {
+		t.Fatal(err)
+	}
+	if tstat, _ := cloud.Thermostat("Office"); tstat.HeatSetting != 21 || tstat.CoolSetting != 25.5 {
+		t.Errorf("Setpoints of 70F/78F written as %vC/%vC, want 21C/25.5C", tstat.HeatSetting, tstat.CoolSetting)
+	}
+
+	schedule := &ThermostatSchedule{
+		DaySchedules: map[string][]ThermostatBlockSchedule{"Monday": {testBlock(t, office, 1, "08:00:AM", "Auto", 68, 77)}},
+		Repeat:       REPEAT_WEEKDAY_WEEKEND,
+	}
+	if _, err := office.SetSchedule(schedule); err != nil {
+		t.Fatal(err)
+	}
+	tstat, _ := cloud.Thermostat("Office")
+	if blocks := tstat.Schedules[1]; len(blocks) != 1 || blocks[0].HeatSetting != 20 || blocks[0].CoolSetting != 25 {
+		t.Errorf("Monday's blocks are %+v, want 20C/25C", blocks)
+	}
+	read, err := office.GetSchedule()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blocks := read.DaySchedules["Friday"]; len(blocks) != 1 || blocks[0].HeatSetting != 68 || blocks[0].CoolSetting != 77 {
+		t.Errorf("Friday's blocks read back as %+v, want 68F/77F", blocks)
+	}
+}
@@ -1,11 +1,7 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"net/http"
 	"net/url"
 	"sync"
 	"time"
@@ -17,6 +13,8 @@ import (
 const (
 	NAMESPACE_UUID = `d8b61708-2797-11e6-836b-0cc47a0f7eea`
 	PONUM          = "2.1.1.0"
+	SENSOR_PONUM   = "2.1.2.0"
+	SCHEDULE_PONUM = "2.1.2.2"
 )
 
 func (ir *InfoResponse) ToMsgPackPO() bw2.PayloadObject {
@@ -27,43 +25,90 @@ func (ir *InfoResponse) ToMsgPackPO() bw2.PayloadObject {
 	return po
 }
 
-func NewXbosInfoPO(time int64, temp float64, relHumidity float64, heatingSetpoint float64, coolingSetpoint float64, override bool, fan bool, mode int, state int) bw2.PayloadObject {
-	msg := map[string]interface{}{
-		"temperature":       temp,
-		"relative_humidity": relHumidity,
-		"heating_setpoint":  heatingSetpoint,
-		"cooling_setpoint":  coolingSetpoint,
-		"override":          override,
-		"fan":               fan,
-		"mode":              mode,
-		"state":             state,
-		"time":              time}
-	po, err := bw2.CreateMsgPackPayloadObject(bw2.FromDotForm(PONUM), msg)
+// Published on the info signal of i.xbos.thermostat. Temperatures are in
+// Fahrenheit.
+type XbosInfo struct {
+	Time             int64   `msgpack:"time"`
+	Temperature      float64 `msgpack:"temperature"`
+	RelativeHumidity float64 `msgpack:"relative_humidity"`
+	HeatingSetpoint  float64 `msgpack:"heating_setpoint"`
+	CoolingSetpoint  float64 `msgpack:"cooling_setpoint"`
+	Override         bool    `msgpack:"override"`
+	Fan              bool    `msgpack:"fan"`
+	// "auto", "on" or "circulate"
+	FanMode string `msgpack:"fan_mode"`
+	Mode    int    `msgpack:"mode"`
+	State   int    `msgpack:"state"`
+	Away    bool   `msgpack:"away"`
+	Holiday bool   `msgpack:"holiday"`
+	// Set on commercial models when the thermostat is forced unoccupied
+	ForceUnoccupied bool `msgpack:"force_unoccupied"`
+	// Left out by firmware that doesn't report its stages
+	EnabledHeatStages *int `msgpack:"enabled_heat_stages"`
+	EnabledCoolStages *int `msgpack:"enabled_cool_stages"`
+}
+
+func (xi *XbosInfo) ToMsgPackPO() bw2.PayloadObject {
+	po, err := bw2.CreateMsgPackPayloadObject(bw2.FromDotForm(PONUM), xi)
 	if err != nil {
 		panic(err)
 	}
 	return po
 }
 
+// The signal side of a *bw2.Interface, so that tests can record what the
+// driver publishes
+type publisher interface {
+	PublishSignal(signal string, poz ...bw2.PayloadObject) error
+}
+
 type Driver struct {
-	bwc            *bw2.BW2Client
-	r              DiscoveryRecord
-	upd            chan DiscoveryRecord
-	base           string
-	svc            *bw2.Service
-	iface          *bw2.Interface
-	xbos_iface     *bw2.Interface
-	lastheat       float64
-	lastcool       float64
-	lastfan        bool
+	bwc *bw2.BW2Client
+	// Updated from discovery, so only read through record()
+	r          DiscoveryRecord
+	recordLock sync.Mutex
+	upd        chan DiscoveryRecord
+	// Name the interfaces are registered under, which stays the same if the
+	// thermostat is renamed
+	ifaceName    string
+	base         string
+	svc          *bw2.Service
+	iface        publisher
+	xbos_iface   publisher
+	sched_iface  publisher
+	sensorIfaces map[string]*bw2.Interface
+	lastheat     float64
+	lastcool     float64
+	lastfan      int
+	lastmode     int
+	// Humidity reported by the thermostat's own sensor, for firmware that
+	// leaves it out of /query/info
+	lasthum *float64
+	// The last successful scrape, nil until there is one
+	lastinfo       *InfoResponse
 	override       bool
-	fan            bool
 	timeseriesUUID string
+	// Last state seen of each alert, by name
+	activeAlerts map[string]bool
+	// Start of the last day whose run times were published
+	lastRuntime int64
+	// Consecutive failed scrapes after which the thermostat is offline
+	offlineAfter int
+	liveness     liveness
 	sync.Mutex
 }
 
-func newThermostat(base string, bwc *bw2.BW2Client, r DiscoveryRecord) chan DiscoveryRecord {
-	d := Driver{base: base, bwc: bwc, r: r, upd: make(chan DiscoveryRecord)}
+func newThermostat(base string, bwc *bw2.BW2Client, r DiscoveryRecord, offlineAfter int) chan DiscoveryRecord {
+	d := Driver{
+		base:         base,
+		bwc:          bwc,
+		r:            r,
+		upd:          make(chan DiscoveryRecord),
+		ifaceName:    r.Name,
+		offlineAfter: offlineAfter,
+		sensorIfaces: make(map[string]*bw2.Interface),
+		activeAlerts: make(map[string]bool),
+	}
 	d.svc = bwc.RegisterService(base, "s.venstar")
 
 	rootUUID := uuid.FromStringOrNil(NAMESPACE_UUID)
@@ -74,16 +119,17 @@ func newThermostat(base string, bwc *bw2.BW2Client, r DiscoveryRecord) chan Disc
 }
 
 func (d *Driver) Start() {
-	go func() {
-		//We do not use this at the moment
-		for _ = range d.upd {
-		}
-	}()
-	d.iface = d.svc.RegisterInterface(d.r.Name, "i.venstar")
-	d.iface.SubscribeSlot("control", d.Control)
+	go d.watchUpdates()
+	iface := d.svc.RegisterInterface(d.ifaceName, "i.venstar")
+	d.iface = iface
+	iface.SubscribeSlot("control", d.Control)
+	iface.SubscribeSlot("schedule", d.handleSchedule)
+
+	d.sched_iface = d.svc.RegisterInterface(d.ifaceName, "i.xbos.thermostat_schedule")
 
-	d.xbos_iface = d.svc.RegisterInterface(d.r.Name, "i.xbos.thermostat")
-	d.xbos_iface.SubscribeSlot("setpoints", func(msg *bw2.SimpleMessage) {
+	xbos_iface := d.svc.RegisterInterface(d.ifaceName, "i.xbos.thermostat")
+	d.xbos_iface = xbos_iface
+	xbos_iface.SubscribeSlot("setpoints", func(msg *bw2.SimpleMessage) {
 		fmt.Println("got message from slot setpoints:")
 		msg.Dump()
 
@@ -110,10 +156,10 @@ func (d *Driver) Start() {
 			return
 		}
 
-		d.SetSetpoints(nil, data.Heating_setpoint, data.Cooling_setpoint, nil, nil)
+		d.actuate("setpoints", command{HeatingSetpoint: data.Heating_setpoint, CoolingSetpoint: data.Cooling_setpoint})
 	})
 
-	d.xbos_iface.SubscribeSlot("state", func(msg *bw2.SimpleMessage) {
+	xbos_iface.SubscribeSlot("state", func(msg *bw2.SimpleMessage) {
 		fmt.Println("got message from slot state:")
 		msg.Dump()
 
@@ -129,12 +175,36 @@ func (d *Driver) Start() {
 			return
 		}
 
+		var data command
+		err = msgpo.ValueInto(&data)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+
+		d.actuate("state", data)
+
+	})
+
+	xbos_iface.SubscribeSlot("stages", func(msg *bw2.SimpleMessage) {
+		fmt.Println("got message from slot stages:")
+		msg.Dump()
+
+		po := msg.GetOnePODF(PONUM)
+		if po == nil {
+			fmt.Println("Received actuation command without valid PO, dropping")
+			return
+		}
+
+		msgpo, err := bw2.LoadMsgPackPayloadObject(po.GetPONum(), po.GetContents())
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+
 		var data struct {
-			Heating_setpoint *float64 `msgpack:"heating_setpoint"`
-			Cooling_setpoint *float64 `msgpack:"cooling_setpoint"`
-			Mode             *int     `msgpack:"mode"`
-			Override         *bool    `msgpack:"override"`
-			Fan              *bool    `msgpack:"fan"`
+			Heat_stages *int `msgpack:"enabled_heat_stages"`
+			Cool_stages *int `msgpack:"enabled_cool_stages"`
 		}
 		err = msgpo.ValueInto(&data)
 		if err != nil {
@@ -142,19 +212,54 @@ func (d *Driver) Start() {
 			return
 		}
 
-		d.SetSetpoints(data.Mode, data.Heating_setpoint, data.Cooling_setpoint, data.Fan, data.Override)
-
+		d.actuate("stages", command{HeatingStages: data.Heat_stages, CoolingStages: data.Cool_stages})
 	})
 
+	go d.pollStatus()
 	for {
-		d.Scrape()
+		d.updateLiveness(d.Scrape())
+		d.ScrapeSensors()
 		time.Sleep(10 * time.Second)
 	}
 }
 
-func (d *Driver) SetSetpoints(mode *int, heat *float64, cool *float64, fan *bool, override *bool) {
+// Sets the thermostat's mode, setpoints, fan mode and override. Setpoints are
+// in Fahrenheit and fan is one of the FAN_* constants. Values left nil keep
+// their last scraped value. The command is checked against the modes,
+// setpoint ranges and setpoint delta the thermostat reports, and is not sent
+// at all if it violates them. Returns an *ActuationError if the command was
+// not applied.
+func (d *Driver) SetSetpoints(mode *int, heat *float64, cool *float64, fan *int, override *bool) error {
 	d.Lock()
 	defer d.Unlock()
+	if d.lastinfo == nil {
+		return actuationErrorf(ERR_NO_STATE, "thermostat %s has not been scraped yet", d.ifaceName)
+	}
+	inf := d.lastinfo
+	units := inf.TempUnits
+	if heat != nil {
+		value := fromFahrenheit(*heat, units)
+		heat = &value
+	}
+	if cool != nil {
+		value := fromFahrenheit(*cool, units)
+		cool = &value
+	}
+	if fan != nil && (*fan < FAN_AUTO || *fan > FAN_CIRCULATE) {
+		return actuationErrorf(ERR_INVALID_COMMAND, "unknown fan mode %d", *fan)
+	}
+	if mode != nil {
+		if err := checkMode(*mode, inf.AvailableModes); err != nil {
+			return err
+		}
+	}
+	if heat != nil && inf.HeatTempMax != 0 && (*heat < inf.HeatTempMin || *heat > inf.HeatTempMax) {
+		return actuationErrorf(ERR_SETPOINT_RANGE, "heating setpoint %v%s outside of [%v, %v]", *heat, unitName(units), inf.HeatTempMin, inf.HeatTempMax)
+	}
+	if cool != nil && inf.CooltempMax != 0 && (*cool < inf.CoolTempMin || *cool > inf.CooltempMax) {
+		return actuationErrorf(ERR_SETPOINT_RANGE, "cooling setpoint %v%s outside of [%v, %v]", *cool, unitName(units), inf.CoolTempMin, inf.CooltempMax)
+	}
+
 	if heat == nil {
 		heat = &d.lastheat
 	}
@@ -165,14 +270,18 @@ func (d *Driver) SetSetpoints(mode *int, heat *float64, cool *float64, fan *bool
 		fan = &d.lastfan
 	}
 	if mode == nil {
-		auto := 3
-		mode = &auto
+		mode = &d.lastmode
+	}
+	// Both setpoints only apply at once in auto mode
+	if *mode == MODE_AUTO && *cool-*heat < inf.SetpointDelta {
+		return actuationErrorf(ERR_SETPOINT_DELTA, "heating setpoint %v%s and cooling setpoint %v%s are closer than %v", *heat, unitName(units), *cool, unitName(units), inf.SetpointDelta)
 	}
+
 	values := url.Values{
 		"mode":     {fmt.Sprintf("%d", *mode)},
 		"fan":      {fmt.Sprintf("%d", *fan)},
-		"heattemp": {fmt.Sprintf("%d", int(*heat))},
-		"cooltemp": {fmt.Sprintf("%d", int(*cool))},
+		"heattemp": {formatSetpoint(*heat, units)},
+		"cooltemp": {formatSetpoint(*cool, units)},
 	}
 
 	// set schedule to the opposite of override; for the venstar, we disable the schedule when we enable override
@@ -183,47 +292,86 @@ func (d *Driver) SetSetpoints(mode *int, heat *float64, cool *float64, fan *bool
 		} else {
 			schedValues.Add("schedule", "1")
 		}
-		d.override = *override
-		resp, err := http.PostForm("http://"+d.r.IP+"/settings", schedValues)
-		defer resp.Body.Close()
-		if err != nil {
-			fmt.Println("SET FAILURE: ", err)
-			return
+		if err := d.post("/settings", schedValues); err != nil {
+			return actuationErrorf(ERR_REQUEST_FAILED, "%v", err)
 		}
-		contents, _ := ioutil.ReadAll(resp.Body)
-		fmt.Println("set response: ", string(contents))
+		d.override = *override
 	}
 
 	fmt.Println(*mode, *fan, *heat, *cool)
-	resp, err := http.PostForm("http://"+d.r.IP+"/control", values)
-	defer resp.Body.Close()
-	if err != nil {
-		fmt.Println("SET FAILURE: ", err)
-		return
+	if err := d.post("/control", values); err != nil {
+		return actuationErrorf(ERR_REQUEST_FAILED, "%v", err)
+	}
+	d.lastheat = *heat
+	d.lastcool = *cool
+	d.lastfan = *fan
+	d.lastmode = *mode
+	return nil
+}
+
+// Fails unless the thermostat offers mode
+func checkMode(mode int, available int) error {
+	ok := false
+	switch mode {
+	case MODE_OFF:
+		ok = true
+	case MODE_HEAT:
+		ok = available != AVAILABLE_COOL
+	case MODE_COOL:
+		ok = available != AVAILABLE_HEAT
+	case MODE_AUTO:
+		ok = available == AVAILABLE_ALL
 	}
-	contents, _ := ioutil.ReadAll(resp.Body)
-	fmt.Println("set response: ", string(contents))
-	if !bytes.Contains(contents, []byte("error")) {
-		// if no errors, then update internal state
-		d.lastheat = *heat
-		d.lastcool = *cool
-		d.lastfan = *fan
+	if !ok {
+		return actuationErrorf(ERR_MODE_UNAVAILABLE, "mode %d is not available (available modes %d)", mode, available)
 	}
+	return nil
 }
-func (d *Driver) SetAway(val int) {
-	resp, err := http.PostForm("http://"+d.r.IP+"/settings", url.Values{
-		"away": {fmt.Sprintf("%d", val)},
-	})
-	if err != nil {
-		fmt.Println("SET FAILURE: ", err)
+
+// Sets how many heating and cooling stages the thermostat may run. Values left
+// nil are not changed. Needs firmware that supports it; older firmware
+// rejects the request.
+func (d *Driver) SetStages(heat *int, cool *int) error {
+	d.Lock()
+	defer d.Unlock()
+	values := url.Values{}
+	for _, stages := range []struct {
+		name  string
+		value *int
+	}{
+		{"heatstages", heat},
+		{"coolstages", cool},
+	} {
+		if stages.value == nil {
+			continue
+		}
+		if *stages.value < 1 || *stages.value > MAX_STAGES {
+			return actuationErrorf(ERR_INVALID_COMMAND, "%s %d outside of [1, %d]", stages.name, *stages.value, MAX_STAGES)
+		}
+		values.Set(stages.name, fmt.Sprintf("%d", *stages.value))
+	}
+	if err := d.post("/settings", values); err != nil {
+		return actuationErrorf(ERR_REQUEST_FAILED, "%v", err)
 	}
-	contents, _ := ioutil.ReadAll(resp.Body)
-	fmt.Println("set response: ", string(contents))
-	resp.Body.Close()
+	return nil
+}
+
+func (d *Driver) SetAway(away bool) error {
+	d.Lock()
+	defer d.Unlock()
+	value := "0"
+	if away {
+		value = "1"
+	}
+	if err := d.post("/settings", url.Values{"away": {value}}); err != nil {
+		return actuationErrorf(ERR_REQUEST_FAILED, "%v", err)
+	}
+	return nil
 }
 
 func (d *Driver) Control(sm *bw2.SimpleMessage) {
-	//Commands:
+	//Commands, kept for backward compatibility; away and setpoints can be
+	//set through the state slot of i.xbos.thermostat instead:
 	//{"cmd":"set_away","value": 1 / 0}
 	//{"cmd":"set_auto_setpoints", "heattemp": val, "cooltemp": val}
 	fmt.Println("got message:")
@@ -248,7 +396,8 @@ func (d *Driver) Control(sm *bw2.SimpleMessage) {
 							fmt.Println("DROPPING COMMAND set_away - invalid 'value'")
 							continue
 						}
-						d.SetAway(int(val))
+						away := val != 0
+						d.actuate("control", command{Away: &away})
 					case "set_auto_setpoints":
 						heattemp, hok := cm["heattemp"].(float64)
 						cooltemp, cok := cm["cooltemp"].(float64)
@@ -260,7 +409,7 @@ func (d *Driver) Control(sm *bw2.SimpleMessage) {
 						if cok {
 							ct = &cooltemp
 						}
-						d.SetSetpoints(nil, ht, ct, nil, nil)
+						d.actuate("control", command{HeatingSetpoint: ht, CoolingSetpoint: ct})
 					}
 				}
 			}
@@ -268,44 +417,56 @@ func (d *Driver) Control(sm *bw2.SimpleMessage) {
 	}
 }
 
-func (d *Driver) Scrape() {
-	resp, err := http.Get("http://" + d.r.IP + "/query/info")
-	if err != nil {
-		fmt.Println(err)
-		return
-	}
-
-	contents, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		fmt.Println(err)
-		return
-	}
-
-	resp.Body.Close()
+// Publishes the thermostat's info, failing if it could not be read
+func (d *Driver) Scrape() error {
 	inf := InfoResponse{}
-	json.Unmarshal(contents, &inf)
+	if err := d.query("/query/info", &inf); err != nil {
+		return err
+	}
 	inf.Time = time.Now().UnixNano()
 	inf.UUID = d.timeseriesUUID
 	po := inf.ToMsgPackPO()
 	// detect broken state
 	if inf.HeatTemp == 0 && inf.CoolTemp == 0 {
-		return
+		return fmt.Errorf("Thermostat reported heating and cooling setpoints of 0")
 	}
 	fmt.Printf("%+v\n", inf)
 
 	d.iface.PublishSignal("info", po)
-	xbosPO := NewXbosInfoPO(
-		inf.Time,
-		inf.SpaceTemp,
-		0.0,
-		inf.HeatTemp,
-		inf.CoolTemp,
-		d.override,
-		inf.Fan == 1,
-		inf.Mode,
-		inf.State)
-	d.xbos_iface.PublishSignal("info", xbosPO)
+	d.Lock()
+	humidity := inf.Humidity
+	if humidity == nil {
+		humidity = d.lasthum
+	}
+	xbosInfo := XbosInfo{
+		Time:              inf.Time,
+		Temperature:       toFahrenheit(inf.SpaceTemp, inf.TempUnits),
+		HeatingSetpoint:   toFahrenheit(inf.HeatTemp, inf.TempUnits),
+		CoolingSetpoint:   toFahrenheit(inf.CoolTemp, inf.TempUnits),
+		Override:          d.override,
+		Fan:               inf.Fan == FAN_ON,
+		FanMode:           fanModeName(inf.Fan),
+		Mode:              inf.Mode,
+		State:             inf.State,
+		Away:              inf.Away == 1,
+		Holiday:           inf.Holiday == 1,
+		ForceUnoccupied:   inf.ForceUnocc == 1,
+		EnabledHeatStages: inf.HeatStages,
+		EnabledCoolStages: inf.CoolStages,
+	}
+	if humidity != nil {
+		xbosInfo.RelativeHumidity = *humidity
+	}
+	d.Unlock()
+	d.xbos_iface.PublishSignal("info", xbosInfo.ToMsgPackPO())
+	d.publishSchedule(&inf)
+
+	d.Lock()
 	d.lastheat = inf.HeatTemp
 	d.lastcool = inf.CoolTemp
-	d.lastfan = inf.Fan == 1
+	d.lastfan = inf.Fan
+	d.lastmode = inf.Mode
+	d.lastinfo = &inf
+	d.Unlock()
+	return nil
 }
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"testing"
+
+	"github.com/SoftwareDefinedBuildings/bw2-contrib/driver/venstar/fakecolortouch"
+	bw2 "gopkg.in/immesys/bw2bind.v5"
+)
+
+// Records the signals published on an interface
+type recorder struct {
+	lock    sync.Mutex
+	signals map[string][]bw2.PayloadObject
+}
+
+func newRecorder() *recorder {
+	return &recorder{signals: make(map[string][]bw2.PayloadObject)}
+}
+
+func (rec *recorder) PublishSignal(signal string, poz ...bw2.PayloadObject) error {
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+	rec.signals[signal] = append(rec.signals[signal], poz...)
+	return nil
+}
+
+// Decodes the last PO published on signal into v, failing the test if there is none
+func (rec *recorder) last(t *testing.T, signal string, v interface{}) {
+	t.Helper()
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+	pos := rec.signals[signal]
+	if len(pos) == 0 {
+		t.Fatalf("Nothing published on %s", signal)
+	}
+	if err := pos[len(pos)-1].(bw2.MsgPackPayloadObject).ValueInto(v); err != nil {
+		t.Fatalf("Failed to decode %s: %v", signal, err)
+	}
+}
+
+func (rec *recorder) count(signal string) int {
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+	return len(rec.signals[signal])
+}
+
+// A Driver for dev that publishes to recorders instead of BOSSWAVE
+func newTestDriver(dev *fakecolortouch.Device) (*Driver, *recorder) {
+	xbos := newRecorder()
+	d := &Driver{
+		r:            DiscoveryRecord{IP: dev.Addr(), Name: dev.Thermostat().Name},
+		ifaceName:    dev.Thermostat().Name,
+		iface:        newRecorder(),
+		xbos_iface:   xbos,
+		sched_iface:  newRecorder(),
+		sensorIfaces: make(map[string]*bw2.Interface),
+		activeAlerts: make(map[string]bool),
+		offlineAfter: 3,
+	}
+	return d, xbos
+}
+
+func float(v float64) *float64 { return &v }
+func integer(v int) *int       { return &v }
+func boolean(v bool) *bool     { return &v }
+
+func TestScrape(t *testing.T) {
+	dev := fakecolortouch.New(fakecolortouch.Thermostat{
+		Mode:      fakecolortouch.ModeHeat,
+		SpaceTemp: 65,
+		HeatTemp:  68,
+		CoolTemp:  76,
+		Humidity:  41,
+		Away:      1,
+	})
+	defer dev.Close()
+	d, xbos := newTestDriver(dev)
+	if err := d.Scrape(); err != nil {
+		t.Fatal(err)
+	}
+
+	var info XbosInfo
+	xbos.last(t, "info", &info)
+	if info.Temperature != 65 || info.HeatingSetpoint != 68 || info.CoolingSetpoint != 76 {
+		t.Errorf("Published temperatures %+v, want 65, 68 and 76", info)
+	}
+	if info.Mode != fakecolortouch.ModeHeat || info.State != fakecolortouch.StateHeating {
+		t.Errorf("Published mode %d and state %d, want heat and heating", info.Mode, info.State)
+	}
+	if info.RelativeHumidity != 41 || !info.Away {
+		t.Errorf("Published humidity %v and away %v, want 41 and true", info.RelativeHumidity, info.Away)
+	}
+}
+
+func TestScrapeCelsius(t *testing.T) {
+	dev := fakecolortouch.New(fakecolortouch.Thermostat{
+		TempUnits: fakecolortouch.UnitsC,
+		SpaceTemp: 21,
+		HeatTemp:  20,
+		CoolTemp:  25,
+	})
+	defer dev.Close()
+	d, xbos := newTestDriver(dev)
+	if err := d.Scrape(); err != nil {
+		t.Fatal(err)
+	}
+	var info XbosInfo
+	xbos.last(t, "info", &info)
+	if math.Abs(info.Temperature-69.8) > 1e-9 || info.HeatingSetpoint != 68 || info.CoolingSetpoint != 77 {
+		t.Errorf("Published temperatures %+v, want 69.8, 68 and 77", info)
+	}
+
+	// Commands are in Fahrenheit too
+	if err := d.SetSetpoints(nil, float(70), nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if heat := dev.Thermostat().HeatTemp; heat != 21 {
+		t.Errorf("Heating setpoint of 70F set to %vC, want 21C", heat)
+	}
+}
+
+func TestSetSetpoints(t *testing.T) {
+	dev := fakecolortouch.New(fakecolortouch.Thermostat{
+		Mode:           fakecolortouch.ModeHeat,
+		HeatTemp:       68,
+		CoolTemp:       76,
+		HeatTempMin:    40,
+		HeatTempMax:    80,
+		CoolTempMin:    60,
+		CoolTempMax:    90,
+		SetpointDelta:  3,
+		AvailableModes: fakecolortouch.AvailableAll,
+		Schedule:       fakecolortouch.ScheduleOn,
+	})
+	defer dev.Close()
+	d, _ := newTestDriver(dev)
+
+	if err, ok := d.SetSetpoints(nil, float(70), nil, nil, nil).(*ActuationError); !ok || err.Code != ERR_NO_STATE {
+		t.Errorf("SetSetpoints before the first scrape returned %v, want %s", err, ERR_NO_STATE)
+	}
+	if err := d.Scrape(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Leaving the mode out keeps the thermostat in heat mode
+	if err := d.SetSetpoints(nil, float(70), nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	tstat := dev.Thermostat()
+	if tstat.Mode != fakecolortouch.ModeHeat || tstat.HeatTemp != 70 || tstat.CoolTemp != 76 {
+		t.Errorf("Thermostat in mode %d at %v/%v, want heat at 70/76", tstat.Mode, tstat.HeatTemp, tstat.CoolTemp)
+	}
+
+	for _, test := range []struct {
+		mode       *int
+		heat, cool *float64
+		code       string
+	}{
+		{nil, float(85), nil, ERR_SETPOINT_RANGE},
+		{nil, nil, float(55), ERR_SETPOINT_RANGE},
+		{integer(fakecolortouch.ModeAuto), float(72), float(74), ERR_SETPOINT_DELTA},
+	} {
+		err, ok := d.SetSetpoints(test.mode, test.heat, test.cool, nil, nil).(*ActuationError)
+		if !ok || err.Code != test.code {
+			t.Errorf("SetSetpoints(%v, %v, %v) returned %v, want %s", test.mode, test.heat, test.cool, err, test.code)
+		}
+	}
+	if after := dev.Thermostat(); after != tstat {
+		t.Errorf("Rejected commands changed the thermostat from %+v to %+v", tstat, after)
+	}
+
+	if err := d.SetSetpoints(integer(fakecolortouch.ModeAuto), float(68), float(74), integer(FAN_ON), boolean(true)); err != nil {
+		t.Fatal(err)
+	}
+	tstat = dev.Thermostat()
+	if tstat.Mode != fakecolortouch.ModeAuto || tstat.HeatTemp != 68 || tstat.CoolTemp != 74 ||
+		tstat.Fan != fakecolortouch.FanOn || tstat.Schedule != fakecolortouch.ScheduleOff {
+		t.Errorf("Thermostat is %+v, want auto at 68/74 with the fan on and no schedule", tstat)
+	}
+
+	dev.Update(func(tstat *fakecolortouch.Thermostat) { tstat.AvailableModes = fakecolortouch.AvailableHeat })
+	if err := d.Scrape(); err != nil {
+		t.Fatal(err)
+	}
+	if err, ok := d.SetSetpoints(integer(fakecolortouch.ModeCool), nil, nil, nil, nil).(*ActuationError); !ok || err.Code != ERR_MODE_UNAVAILABLE {
+		t.Errorf("SetSetpoints to cool on a heat-only thermostat returned %v, want %s", err, ERR_MODE_UNAVAILABLE)
+	}
+}
+
+func TestControl(t *testing.T) {
+	dev := fakecolortouch.New(fakecolortouch.Thermostat{Mode: fakecolortouch.ModeAuto, HeatTemp: 68, CoolTemp: 76})
+	defer dev.Close()
+	d, xbos := newTestDriver(dev)
+	if err := d.Scrape(); err != nil {
+		t.Fatal(err)
+	}
+
+	control := func(cmd map[string]interface{}) {
+		po, err := bw2.CreateMsgPackPayloadObject(bw2.PONumMsgPack, cmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.Control(&bw2.SimpleMessage{POs: []bw2.PayloadObject{po}})
+	}
+
+	control(map[string]interface{}{"cmd": "set_away", "value": float64(1)})
+	if away := dev.Thermostat().Away; away != 1 {
+		t.Errorf("set_away left away at %d", away)
+	}
+	control(map[string]interface{}{"cmd": "set_auto_setpoints", "heattemp": float64(66), "cooltemp": float64(78)})
+	if tstat := dev.Thermostat(); tstat.HeatTemp != 66 || tstat.CoolTemp != 78 {
+		t.Errorf("set_auto_setpoints left setpoints at %v/%v, want 66/78", tstat.HeatTemp, tstat.CoolTemp)
+	}
+	control(map[string]interface{}{"cmd": "set_auto_setpoints", "heattemp": float64(75), "cooltemp": float64(76)})
+
+	if n := xbos.count("response"); n != 3 {
+		t.Fatalf("Published %d responses, want 3", n)
+	}
+	var resp responseMsg
+	xbos.last(t, "response", &resp)
+	if resp.Success || resp.Error != ERR_SETPOINT_DELTA {
+		t.Errorf("Response to setpoints within the delta is %+v, want %s", resp, ERR_SETPOINT_DELTA)
+	}
+}
+
+func TestFanAndStages(t *testing.T) {
+	dev := fakecolortouch.New(fakecolortouch.Thermostat{})
+	defer dev.Close()
+	d, xbos := newTestDriver(dev)
+	if err := d.Scrape(); err != nil {
+		t.Fatal(err)
+	}
+
+	circulate := "circulate"
+	d.actuate("state", command{FanMode: &circulate})
+	stages := 2
+	d.actuate("stages", command{HeatingStages: &stages, CoolingStages: &stages})
+	if tstat := dev.Thermostat(); tstat.Fan != fakecolortouch.FanCirculate || tstat.HeatStages != 2 || tstat.CoolStages != 2 {
+		t.Errorf("Thermostat is %+v, want the fan circulating with 2 stages", tstat)
+	}
+	if err := d.Scrape(); err != nil {
+		t.Fatal(err)
+	}
+	var info XbosInfo
+	xbos.last(t, "info", &info)
+	if info.FanMode != "circulate" || info.EnabledHeatStages == nil || *info.EnabledHeatStages != 2 ||
+		info.EnabledCoolStages == nil || *info.EnabledCoolStages != 2 {
+		t.Errorf("Published %+v, want fan mode circulate with 2 stages", info)
+	}
+
+	before := dev.Thermostat()
+	unknown := "turbo"
+	stages = 3
+	for _, cmd := range []command{{FanMode: &unknown}, {CoolingStages: &stages}} {
+		d.actuate("state", cmd)
+		var resp responseMsg
+		xbos.last(t, "response", &resp)
+		if resp.Success || resp.Error != ERR_INVALID_COMMAND {
+			t.Errorf("Response to %+v is %+v, want %s", cmd, resp, ERR_INVALID_COMMAND)
+		}
+	}
+	if after := dev.Thermostat(); after != before {
+		t.Errorf("Rejected commands changed the thermostat from %+v to %+v", before, after)
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	dev := fakecolortouch.New(fakecolortouch.Thermostat{Schedule: fakecolortouch.ScheduleOn})
+	defer dev.Close()
+	d, _ := newTestDriver(dev)
+	sched := d.sched_iface.(*recorder)
+	if err := d.Scrape(); err != nil {
+		t.Fatal(err)
+	}
+	var info scheduleMsg
+	sched.last(t, "info", &info)
+	if !info.Enabled || info.Part != 0 {
+		t.Errorf("Published schedule %+v, want enabled in part 0", info)
+	}
+
+	po, err := bw2.CreateMsgPackPayloadObject(bw2.PONumMsgPack, scheduleCommand{Enabled: boolean(false)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.handleSchedule(&bw2.SimpleMessage{POs: []bw2.PayloadObject{po}})
+	if schedule := dev.Thermostat().Schedule; schedule != fakecolortouch.ScheduleOff {
+		t.Errorf("Disabling the schedule left it at %d", schedule)
+	}
+	if err := d.Scrape(); err != nil {
+		t.Fatal(err)
+	}
+	sched.last(t, "info", &info)
+	if info.Enabled || info.Part != 255 {
+		t.Errorf("Published schedule %+v, want disabled in part 255", info)
+	}
+}
+
+func TestLiveness(t *testing.T) {
+	dev := fakecolortouch.New(fakecolortouch.Thermostat{})
+	d, xbos := newTestDriver(dev)
+
+	d.updateLiveness(d.Scrape())
+	var status statusMsg
+	xbos.last(t, "status", &status)
+	if !status.Online {
+		t.Errorf("Status after a successful scrape is %+v, want online", status)
+	}
+
+	dev.Close()
+	for i := 1; i < d.offlineAfter; i++ {
+		d.updateLiveness(d.Scrape())
+	}
+	if n := xbos.count("status"); n != 1 {
+		t.Errorf("Published %d statuses before offlineAfter failures, want 1", n)
+	}
+	d.updateLiveness(d.Scrape())
+	xbos.last(t, "status", &status)
+	if status.Online || status.Failures != d.offlineAfter || status.LastSeen == 0 {
+		t.Errorf("Status after %d failures is %+v, want offline", d.offlineAfter, status)
+	}
+
+	// A new address from discovery brings it back
+	dev = fakecolortouch.New(fakecolortouch.Thermostat{})
+	defer dev.Close()
+	d.upd = make(chan DiscoveryRecord, 1)
+	d.upd <- DiscoveryRecord{IP: dev.Addr(), Name: d.ifaceName}
+	close(d.upd)
+	d.watchUpdates()
+	d.updateLiveness(d.Scrape())
+	xbos.last(t, "status", &status)
+	if !status.Online || status.IP != dev.Addr() {
+		t.Errorf("Status after moving to %s is %+v, want online there", dev.Addr(), status)
+	}
+}
@@ -0,0 +1,424 @@
+// Package fakecolortouch simulates a Venstar ColorTouch thermostat on
+// loopback. It serves the local API's /query/info, /control and /settings
+// endpoints over HTTP and answers SSDP M-SEARCH requests for colortouch:ecp,
+// so the driver can be exercised without real hardware:
+//
+//	dev := fakecolortouch.New(fakecolortouch.Thermostat{Name: "Office"})
+//	defer dev.Close()
+//	resp, err := http.Get("http://" + dev.Addr() + "/query/info")
+package fakecolortouch
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+)
+
+// Modes, states and settings as numbered by the local API
+const (
+	ModeOff  = 0
+	ModeHeat = 1
+	ModeCool = 2
+	ModeAuto = 3
+
+	StateIdle     = 0
+	StateHeating  = 1
+	StateCooling  = 2
+	StateLockout  = 3
+	StateError    = 4
+	FanAuto       = 0
+	FanOn         = 1
+	FanCirculate  = 2
+	UnitsF        = 0
+	UnitsC        = 1
+	ScheduleOff   = 0
+	ScheduleOn    = 1
+	AvailableAll  = 0
+	AvailableHC   = 1
+	AvailableHeat = 2
+	AvailableCool = 3
+)
+
+// Thermostat is the simulated state of a ColorTouch, with fields named after
+// the local API's. Temperatures are in the thermostat's TempUnits.
+type Thermostat struct {
+	Name string
+	// Colon-separated, as in the SSDP USN
+	MAC string
+	// "residential" or "commercial"
+	Type string
+	// Sent over SSDP instead of the USN built from MAC, Name and Type, to
+	// simulate malformed replies
+	USN            string
+	Mode           int
+	State          int
+	Fan            int
+	FanState       int
+	TempUnits      int
+	Schedule       int
+	SchedulePart   int
+	Away           int
+	Holiday        int
+	Override       int
+	ForceUnocc     int
+	SpaceTemp      float64
+	Humidity       float64
+	HeatTemp       float64
+	CoolTemp       float64
+	HeatTempMin    float64
+	HeatTempMax    float64
+	CoolTempMin    float64
+	CoolTempMax    float64
+	SetpointDelta  float64
+	AvailableModes int
+	// Enabled heating and cooling stages, 1 or 2
+	HeatStages int
+	CoolStages int
+}
+
+// Device serves one simulated ColorTouch
+type Device struct {
+	http *httptest.Server
+	ssdp net.PacketConn
+
+	mu       sync.Mutex
+	tstat    Thermostat
+	requests int
+}
+
+// New starts a simulated ColorTouch on loopback. Unset fields get the
+// defaults of an idle residential thermostat in auto mode at 72F.
+func New(tstat Thermostat) *Device {
+	if tstat.Name == "" {
+		tstat.Name = "Thermostat"
+	}
+	if tstat.MAC == "" {
+		tstat.MAC = "00:23:a7:00:00:01"
+	}
+	if tstat.Type == "" {
+		tstat.Type = "residential"
+	}
+	if tstat.HeatTempMax == 0 && tstat.CoolTempMax == 0 {
+		if tstat.TempUnits == UnitsC {
+			tstat.HeatTempMin, tstat.HeatTempMax = 2, 32
+			tstat.CoolTempMin, tstat.CoolTempMax = 2, 37
+		} else {
+			tstat.HeatTempMin, tstat.HeatTempMax = 35, 90
+			tstat.CoolTempMin, tstat.CoolTempMax = 35, 99
+		}
+	}
+	if tstat.SetpointDelta == 0 {
+		tstat.SetpointDelta = 2
+	}
+	if tstat.HeatTemp == 0 && tstat.CoolTemp == 0 {
+		if tstat.TempUnits == UnitsC {
+			tstat.HeatTemp, tstat.CoolTemp = 20, 25
+		} else {
+			tstat.HeatTemp, tstat.CoolTemp = 68, 76
+		}
+	}
+	if tstat.HeatStages == 0 {
+		tstat.HeatStages = 1
+	}
+	if tstat.CoolStages == 0 {
+		tstat.CoolStages = 1
+	}
+	if tstat.SpaceTemp == 0 {
+		tstat.SpaceTemp = (tstat.HeatTemp + tstat.CoolTemp) / 2
+	}
+	dev := &Device{tstat: tstat}
+	dev.updateState()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/query/info", dev.handleInfo)
+	mux.HandleFunc("/control", dev.handleControl)
+	mux.HandleFunc("/settings", dev.handleSettings)
+	dev.http = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		dev.mu.Lock()
+		dev.requests++
+		dev.mu.Unlock()
+		mux.ServeHTTP(rw, req)
+	}))
+	return dev
+}
+
+// Addr is the host:port the thermostat serves its API on, as the driver's
+// DiscoveryRecord.IP
+func (dev *Device) Addr() string {
+	return dev.http.Listener.Addr().String()
+}
+
+func (dev *Device) Close() {
+	dev.http.Close()
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+	if dev.ssdp != nil {
+		dev.ssdp.Close()
+	}
+}
+
+// Thermostat returns a copy of the current state
+func (dev *Device) Thermostat() Thermostat {
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+	return dev.tstat
+}
+
+// Update changes the simulated state, e.g. to change the room temperature
+func (dev *Device) Update(update func(*Thermostat)) {
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+	update(&dev.tstat)
+	dev.updateState()
+}
+
+// Requests is the number of HTTP requests served so far
+func (dev *Device) Requests() int {
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+	return dev.requests
+}
+
+// Works out whether the thermostat is heating or cooling, as a real one
+// would once its cycle starts. Callers must hold dev.mu.
+func (dev *Device) updateState() {
+	tstat := &dev.tstat
+	heat := tstat.Mode == ModeHeat || tstat.Mode == ModeAuto
+	cool := tstat.Mode == ModeCool || tstat.Mode == ModeAuto
+	switch {
+	case heat && tstat.SpaceTemp < tstat.HeatTemp:
+		tstat.State = StateHeating
+	case cool && tstat.SpaceTemp > tstat.CoolTemp:
+		tstat.State = StateCooling
+	default:
+		tstat.State = StateIdle
+	}
+	tstat.FanState = 0
+	if tstat.Fan != FanAuto || tstat.State != StateIdle {
+		tstat.FanState = 1
+	}
+	// The schedule doesn't run while away
+	if tstat.Schedule == ScheduleOff || tstat.Away == 1 {
+		tstat.SchedulePart = 255
+	} else if tstat.SchedulePart == 255 {
+		tstat.SchedulePart = 0
+	}
+}
+
+func (dev *Device) handleInfo(rw http.ResponseWriter, req *http.Request) {
+	dev.mu.Lock()
+	tstat := dev.tstat
+	dev.mu.Unlock()
+	writeJSON(rw, map[string]interface{}{
+		"name":           tstat.Name,
+		"mode":           tstat.Mode,
+		"state":          tstat.State,
+		"fan":            tstat.Fan,
+		"fanstate":       tstat.FanState,
+		"tempunits":      tstat.TempUnits,
+		"schedule":       tstat.Schedule,
+		"schedulepart":   tstat.SchedulePart,
+		"away":           tstat.Away,
+		"holiday":        tstat.Holiday,
+		"override":       tstat.Override,
+		"overridetime":   0,
+		"forceunocc":     tstat.ForceUnocc,
+		"spacetemp":      tstat.SpaceTemp,
+		"heattemp":       tstat.HeatTemp,
+		"cooltemp":       tstat.CoolTemp,
+		"cooltempmin":    tstat.CoolTempMin,
+		"cooltempmax":    tstat.CoolTempMax,
+		"heattempmin":    tstat.HeatTempMin,
+		"heattempmax":    tstat.HeatTempMax,
+		"setpointdelta":  tstat.SetpointDelta,
+		"hum":            tstat.Humidity,
+		"availablemodes": tstat.AvailableModes,
+		"heatstages":     tstat.HeatStages,
+		"coolstages":     tstat.CoolStages,
+	})
+}
+
+// Applies mode, fan, heattemp and cooltemp, rejecting the whole request if
+// any of them is invalid, as the real API does
+func (dev *Device) handleControl(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(rw, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := req.ParseForm(); err != nil {
+		writeError(rw, err.Error())
+		return
+	}
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+	next := dev.tstat
+	var err error
+	if next.Mode, err = formInt(req, "mode", next.Mode); err != nil {
+		writeError(rw, err.Error())
+		return
+	}
+	if next.Fan, err = formInt(req, "fan", next.Fan); err != nil {
+		writeError(rw, err.Error())
+		return
+	}
+	if next.HeatTemp, err = formTemp(req, "heattemp", next.HeatTemp, next.TempUnits); err != nil {
+		writeError(rw, err.Error())
+		return
+	}
+	if next.CoolTemp, err = formTemp(req, "cooltemp", next.CoolTemp, next.TempUnits); err != nil {
+		writeError(rw, err.Error())
+		return
+	}
+
+	switch {
+	case next.Mode < ModeOff || next.Mode > ModeAuto || !modeAvailable(next.Mode, next.AvailableModes):
+		writeError(rw, fmt.Sprintf("mode %d not available", next.Mode))
+	case next.Fan < FanAuto || next.Fan > FanCirculate:
+		writeError(rw, fmt.Sprintf("invalid fan %d", next.Fan))
+	case next.HeatTemp < next.HeatTempMin || next.HeatTemp > next.HeatTempMax:
+		writeError(rw, "heattemp out of range")
+	case next.CoolTemp < next.CoolTempMin || next.CoolTemp > next.CoolTempMax:
+		writeError(rw, "cooltemp out of range")
+	case next.Mode == ModeAuto && next.CoolTemp-next.HeatTemp < next.SetpointDelta:
+		writeError(rw, "setpoints closer than setpointdelta")
+	default:
+		dev.tstat = next
+		dev.updateState()
+		writeJSON(rw, map[string]bool{"success": true})
+	}
+}
+
+// Applies away, schedule, holiday, tempunits, heatstages and coolstages
+func (dev *Device) handleSettings(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(rw, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := req.ParseForm(); err != nil {
+		writeError(rw, err.Error())
+		return
+	}
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+	next := dev.tstat
+	for _, setting := range []struct {
+		name  string
+		value *int
+	}{
+		{"away", &next.Away},
+		{"schedule", &next.Schedule},
+		{"holiday", &next.Holiday},
+		{"tempunits", &next.TempUnits},
+	} {
+		value, err := formInt(req, setting.name, *setting.value)
+		if err != nil {
+			writeError(rw, err.Error())
+			return
+		}
+		if value != 0 && value != 1 {
+			writeError(rw, fmt.Sprintf("invalid %s %d", setting.name, value))
+			return
+		}
+		*setting.value = value
+	}
+	for _, setting := range []struct {
+		name  string
+		value *int
+	}{
+		{"heatstages", &next.HeatStages},
+		{"coolstages", &next.CoolStages},
+	} {
+		value, err := formInt(req, setting.name, *setting.value)
+		if err != nil {
+			writeError(rw, err.Error())
+			return
+		}
+		if value != 1 && value != 2 {
+			writeError(rw, fmt.Sprintf("invalid %s %d", setting.name, value))
+			return
+		}
+		*setting.value = value
+	}
+	if next.TempUnits != dev.tstat.TempUnits {
+		convertUnits(&next)
+	}
+	dev.tstat = next
+	dev.updateState()
+	writeJSON(rw, map[string]bool{"success": true})
+}
+
+func modeAvailable(mode, available int) bool {
+	switch available {
+	case AvailableHC:
+		return mode != ModeAuto
+	case AvailableHeat:
+		return mode == ModeOff || mode == ModeHeat
+	case AvailableCool:
+		return mode == ModeOff || mode == ModeCool
+	}
+	return true
+}
+
+// Converts every temperature to the thermostat's new units
+func convertUnits(tstat *Thermostat) {
+	convert := func(temp float64) float64 {
+		if tstat.TempUnits == UnitsC {
+			return math.Round((temp-32)*5/9*2) / 2
+		}
+		return math.Round(temp*9/5 + 32)
+	}
+	for _, temp := range []*float64{&tstat.SpaceTemp, &tstat.HeatTemp, &tstat.CoolTemp,
+		&tstat.HeatTempMin, &tstat.HeatTempMax, &tstat.CoolTempMin, &tstat.CoolTempMax} {
+		*temp = convert(*temp)
+	}
+	if tstat.TempUnits == UnitsC {
+		tstat.SetpointDelta = math.Round(tstat.SetpointDelta * 5 / 9)
+	} else {
+		tstat.SetpointDelta = math.Round(tstat.SetpointDelta * 9 / 5)
+	}
+}
+
+func formInt(req *http.Request, key string, current int) (int, error) {
+	value := req.PostForm.Get(key)
+	if value == "" {
+		return current, nil
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q", key, value)
+	}
+	return parsed, nil
+}
+
+// Fahrenheit setpoints must be whole degrees and Celsius ones half degrees
+func formTemp(req *http.Request, key string, current float64, units int) (float64, error) {
+	value := req.PostForm.Get(key)
+	if value == "" {
+		return current, nil
+	}
+	parsed, err := strconv.ParseFloat(value, 64)
+	step := 1.0
+	if units == UnitsC {
+		step = 0.5
+	}
+	if err != nil || math.Mod(parsed, step) != 0 {
+		return 0, fmt.Errorf("invalid %s %q", key, value)
+	}
+	return parsed, nil
+}
+
+func writeJSON(rw http.ResponseWriter, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(v); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func writeError(rw http.ResponseWriter, reason string) {
+	writeJSON(rw, map[string]interface{}{"error": true, "reason": reason})
+}
@@ -0,0 +1,54 @@
+package fakecolortouch
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ServeSSDP answers M-SEARCH requests for colortouch:ecp on a loopback UDP
+// port, returning its address. Point the driver's M-SEARCH there instead of
+// the multicast group. Replies locate the device's HTTP server.
+func (dev *Device) ServeSSDP() (*net.UDPAddr, error) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	dev.mu.Lock()
+	dev.ssdp = conn
+	dev.mu.Unlock()
+	go dev.answerSSDP(conn)
+	return conn.LocalAddr().(*net.UDPAddr), nil
+}
+
+// USN is the unique service name the thermostat announces, with the MAC,
+// name and type the driver reads from it
+func (dev *Device) USN() string {
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+	if dev.tstat.USN != "" {
+		return dev.tstat.USN
+	}
+	return fmt.Sprintf("ecp:%s:name:%s:type:%s", dev.tstat.MAC, dev.tstat.Name, dev.tstat.Type)
+}
+
+func (dev *Device) answerSSDP(conn net.PacketConn) {
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		req := string(buf[:n])
+		if !strings.HasPrefix(req, "M-SEARCH * HTTP/1.1\r\n") || !strings.Contains(req, "\r\nST: colortouch:ecp\r\n") {
+			continue
+		}
+		resp := "HTTP/1.1 200 OK\r\n" +
+			"Cache-Control: max-age=300\r\n" +
+			"ST: colortouch:ecp\r\n" +
+			"Location: http://" + dev.Addr() + "/\r\n" +
+			"USN: " + dev.USN() + "\r\n" +
+			"\r\n"
+		conn.WriteTo([]byte(resp), from)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	bw2 "gopkg.in/immesys/bw2bind.v5"
+)
+
+// Whether the thermostat answers its scrapes. Only touched by the scrape loop.
+type liveness struct {
+	known    bool
+	online   bool
+	failures int
+	// Last successful scrape, zero if there has been none
+	lastSeen time.Time
+}
+
+// Published on the status signal of i.xbos.thermostat when the thermostat
+// goes online or offline
+type statusMsg struct {
+	Online bool   `msgpack:"online"`
+	IP     string `msgpack:"ip"`
+	// Consecutive failed scrapes
+	Failures int `msgpack:"failures"`
+	// Last successful scrape in nanoseconds since the epoch, 0 if none
+	LastSeen int64 `msgpack:"last_seen"`
+	Time     int64 `msgpack:"time"`
+}
+
+func (d *Driver) record() DiscoveryRecord {
+	d.recordLock.Lock()
+	defer d.recordLock.Unlock()
+	return d.r
+}
+
+// Applies discovery's updates, so that a thermostat is still reached when
+// DHCP gives it a new address. A renamed thermostat keeps publishing on the
+// interfaces registered under its original name.
+func (d *Driver) watchUpdates() {
+	for r := range d.upd {
+		d.recordLock.Lock()
+		if r.IP != d.r.IP {
+			fmt.Printf("Thermostat %s moved from %s to %s\n", d.ifaceName, d.r.IP, r.IP)
+		}
+		if r.Name != d.r.Name {
+			fmt.Printf("Thermostat %s renamed to %s, still publishing as %s\n", d.r.Name, r.Name, d.ifaceName)
+		}
+		d.r = r
+		d.recordLock.Unlock()
+	}
+}
+
+// Tracks the outcome of a scrape, publishing a status when the thermostat
+// goes online, or offline after offlineAfter consecutive failures
+func (d *Driver) updateLiveness(err error) {
+	live := &d.liveness
+	if err == nil {
+		live.failures = 0
+		live.lastSeen = time.Now()
+	} else {
+		live.failures++
+		fmt.Printf("Failed to scrape thermostat %s (%d in a row): %v\n", d.ifaceName, live.failures, err)
+	}
+
+	online := live.online
+	if err == nil {
+		online = true
+	} else if live.failures >= d.offlineAfter {
+		online = false
+	}
+	if live.known && online == live.online {
+		return
+	}
+	// Wait for a verdict before the first status
+	if !live.known && err != nil && live.failures < d.offlineAfter {
+		return
+	}
+	live.known = true
+	live.online = online
+
+	msg := statusMsg{
+		Online:   online,
+		IP:       d.record().IP,
+		Failures: live.failures,
+		Time:     time.Now().UnixNano(),
+	}
+	if !live.lastSeen.IsZero() {
+		msg.LastSeen = live.lastSeen.UnixNano()
+	}
+	fmt.Printf("Thermostat %s is online = %v\n", d.ifaceName, online)
+	po, err := bw2.CreateMsgPackPayloadObject(bw2.FromDotForm(PONUM), msg)
+	if err != nil {
+		fmt.Println("Failed to create status msgpack PO:", err)
+		return
+	}
+	d.xbos_iface.PublishSignal("status", po)
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"net"
+	"os"
 	"strings"
 	"time"
 
@@ -22,38 +23,92 @@ func main() {
 	if !strings.HasSuffix(baseURI, "/") {
 		baseURI += "/"
 	}
-	var err error
-	socks, err := openSockets()
-	for err != nil {
+	offlineAfter := params.MustInt("offline_after_failures")
+	targets, err := parseTargets(params.MustStringSlice("static_ips"))
+	if err != nil {
 		fmt.Println(err)
-		socks, err = openSockets()
-		time.Sleep(5 * time.Second)
+		os.Exit(1)
 	}
+
 	ch := make(chan DiscoveryRecord, 10)
-	go Discovery(socks, ch)
-	tstats := make(map[string]chan DiscoveryRecord)
-	tstatnames := make(map[string]string)
+	go Discovery(ch)
+	if len(targets) > 0 {
+		go Probe(targets, ch)
+	}
+
+	trackThermostats(ch, func(r DiscoveryRecord) chan DiscoveryRecord {
+		return newThermostat(baseURI, bwc, r, offlineAfter)
+	})
+}
+
+// Starts a driver with register for every new thermostat in ch, and sends
+// the records of known thermostats to their drivers. Thermostats are keyed by
+// MAC, or by IP if they have only been found by probing. Records from SSDP
+// and probing are matched up by IP, or by name if the thermostat moved.
+func trackThermostats(ch <-chan DiscoveryRecord, register func(r DiscoveryRecord) chan DiscoveryRecord) {
+	tstats := make(map[string]*knownThermostat)
 	for r := range ch {
-		tstat, ok := tstats[r.MAC]
-		if ok {
-			tstat <- r
-		} else {
-			existing, ok := tstatnames[r.Name]
-			if ok {
-				fmt.Printf("WARNING: dropping thermostat with identical name (%s on %s clashes with %s on %s)\n", r.Name, r.MAC, r.Name, existing)
-				continue
+		key, tstat := findThermostat(tstats, r)
+		if tstat != nil {
+			// Probing doesn't learn the MAC, USN or type
+			if r.MAC == "" {
+				r.MAC, r.USN, r.Type = tstat.r.MAC, tstat.r.USN, tstat.r.Type
+			}
+			if r.key() != key {
+				delete(tstats, key)
+				tstats[r.key()] = tstat
+			}
+			tstat.r = r
+			tstat.upd <- r
+			continue
+		}
+
+		clash := false
+		for _, other := range tstats {
+			if other.r.Name == r.Name {
+				fmt.Printf("WARNING: dropping thermostat with identical name (%s on %s clashes with %s on %s)\n", r.Name, r.IP, r.Name, other.r.IP)
+				clash = true
+				break
 			}
-			fmt.Println("registered new thermostat:")
-			fmt.Println("  ip  : ", r.IP)
-			fmt.Println("  mac : ", r.MAC)
-			fmt.Println("  name: ", r.Name)
-			fmt.Println("  type: ", r.Type)
-			tstatnames[r.Name] = r.MAC
-			tstats[r.MAC] = newThermostat(baseURI, bwc, r)
 		}
+		if clash {
+			continue
+		}
+		fmt.Println("registered new thermostat:")
+		fmt.Println("  ip  : ", r.IP)
+		fmt.Println("  mac : ", r.MAC)
+		fmt.Println("  name: ", r.Name)
+		fmt.Println("  type: ", r.Type)
+		tstats[r.key()] = &knownThermostat{r: r, upd: register(r)}
 	}
 }
 
+type knownThermostat struct {
+	r   DiscoveryRecord
+	upd chan DiscoveryRecord
+}
+
+// Looks a discovered thermostat up by MAC, then by IP. A thermostat whose MAC
+// is not known on one side, e.g. one only found by probing, is looked up by
+// name too, so that it is still matched after DHCP gives it a new address.
+// Returns its key and nil if it is new.
+func findThermostat(tstats map[string]*knownThermostat, r DiscoveryRecord) (string, *knownThermostat) {
+	if tstat, ok := tstats[r.MAC]; ok && r.MAC != "" {
+		return r.MAC, tstat
+	}
+	for key, tstat := range tstats {
+		if tstat.r.IP == r.IP && (tstat.r.MAC == "" || r.MAC == "") {
+			return key, tstat
+		}
+	}
+	for key, tstat := range tstats {
+		if tstat.r.Name == r.Name && (tstat.r.MAC == "" || r.MAC == "") {
+			return key, tstat
+		}
+	}
+	return "", nil
+}
+
 type DiscoveryRecord struct {
 	IP   string
 	USN  string
@@ -62,66 +117,140 @@ type DiscoveryRecord struct {
 	Type string
 }
 
-func Discovery(socks []*ipv4.PacketConn, discovery chan DiscoveryRecord) {
-	go DiscoverySend(socks)
+// The key the thermostat is tracked under
+func (r DiscoveryRecord) key() string {
+	if r.MAC == "" {
+		return r.IP
+	}
+	return r.MAC
+}
+
+// Discovers thermostats over SSDP for as long as the driver runs, reopening
+// the sockets whenever they fail
+func Discovery(discovery chan DiscoveryRecord) {
+	for {
+		socks, err := openSockets()
+		if err == nil {
+			err = discover(socks, discovery)
+		}
+		fmt.Println("SSDP discovery failed, reopening sockets:", err)
+		for _, s := range socks {
+			s.Close()
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
+
+// Runs discovery on the given sockets until one of them fails
+func discover(socks []*ipv4.PacketConn, discovery chan DiscoveryRecord) error {
+	// Each goroutine reports at most one failure, so none of them blocks
+	failed := make(chan error, len(socks)+1)
+	stop := make(chan bool)
+	defer close(stop)
+	go DiscoverySend(socks, failed, stop)
 	rch := make(chan []byte, 10)
 	for _, s := range socks {
-		go DiscoveryReceive(rch, s)
+		go DiscoveryReceive(rch, s, failed, stop)
 	}
-top:
-	for buf := range rch {
-		sf := string(buf)
-		if !strings.HasPrefix(sf, "HTTP/1.1 200 OK\r\n") {
-			continue
-		}
-		sfn := strings.Split(sf, "\r\n")
-		ip := ""
-		usn := ""
-		for _, ln := range sfn {
-			if strings.HasPrefix(ln, "ST: ") {
-				if strings.TrimSpace(ln[3:]) != "colortouch:ecp" {
-					continue top
-				}
-			}
-			if strings.HasPrefix(ln, "Location: http://") {
-				ip = strings.TrimSpace(ln[17 : len(ln)-1])
+	for {
+		select {
+		case err := <-failed:
+			return err
+		case buf := <-rch:
+			if r, ok := parseDiscoveryResponse(buf); ok {
+				discovery <- r
 			}
-			if strings.HasPrefix(ln, "USN: ecp:") {
-				usn = strings.TrimSpace(ln[9:])
+		}
+	}
+}
+
+// Parses a reply to the M-SEARCH, returning false if it is not from a ColorTouch
+func parseDiscoveryResponse(buf []byte) (DiscoveryRecord, bool) {
+	sf := string(buf)
+	if !strings.HasPrefix(sf, "HTTP/1.1 200 OK\r\n") {
+		return DiscoveryRecord{}, false
+	}
+	sfn := strings.Split(sf, "\r\n")
+	ip := ""
+	usn := ""
+	for _, ln := range sfn {
+		if strings.HasPrefix(ln, "ST: ") {
+			if strings.TrimSpace(ln[3:]) != "colortouch:ecp" {
+				return DiscoveryRecord{}, false
 			}
 		}
-		if ip != "" && usn != "" {
-			MAC := usn[:17]
-			Name := usn[23:]
-			nameend := strings.Index(Name, ":")
-			Type := Name[nameend+6:]
-			Name = Name[:nameend]
-
-			discovery <- DiscoveryRecord{IP: ip, USN: usn, Name: Name, Type: Type, MAC: MAC}
+		if strings.HasPrefix(ln, "Location: http://") {
+			ip = strings.TrimSuffix(strings.TrimSpace(ln[17:]), "/")
+		}
+		if strings.HasPrefix(ln, "USN: ecp:") {
+			usn = strings.TrimSpace(ln[9:])
 		}
 	}
+	if ip == "" {
+		return DiscoveryRecord{}, false
+	}
+	MAC, Name, Type, ok := parseUSN(usn)
+	if !ok {
+		fmt.Printf("Ignoring ColorTouch at %s with malformed USN %q\n", ip, usn)
+		return DiscoveryRecord{}, false
+	}
+	return DiscoveryRecord{IP: ip, USN: usn, Name: Name, Type: Type, MAC: MAC}, true
 }
 
-func DiscoverySend(socks []*ipv4.PacketConn) {
+// Splits a ColorTouch USN, <MAC>:name:<name>:type:<type>, into its parts
+func parseUSN(usn string) (mac string, name string, typ string, ok bool) {
+	// The MAC is six colon-separated bytes
+	if len(usn) < 18 || usn[17] != ':' {
+		return "", "", "", false
+	}
+	mac = usn[:17]
+	rest := usn[18:]
+	if !strings.HasPrefix(rest, "name:") {
+		return "", "", "", false
+	}
+	rest = rest[len("name:"):]
+	typeStart := strings.LastIndex(rest, ":type:")
+	if typeStart < 0 {
+		return "", "", "", false
+	}
+	name = rest[:typeStart]
+	typ = rest[typeStart+len(":type:"):]
+	return mac, name, typ, name != ""
+}
+
+// Where M-SEARCH requests are sent; tests point it at a fake thermostat
+var ssdpGroup = &net.UDPAddr{IP: net.IPv4(239, 255, 255, 250), Port: 1900}
+
+func DiscoverySend(socks []*ipv4.PacketConn, failed chan error, stop chan bool) {
 	solicitmsg := []byte("M-SEARCH * HTTP/1.1\r\nHost: 239.255.255.250:1900\r\nMan: ssdp:discover\r\nST: colortouch:ecp\r\n")
-	grp := &net.UDPAddr{IP: net.IPv4(239, 255, 255, 250), Port: 1900}
 	for {
 		for _, s := range socks {
-			_, err := s.WriteTo(solicitmsg, nil, grp)
+			_, err := s.WriteTo(solicitmsg, nil, ssdpGroup)
 			if err != nil {
-				panic(err)
+				failed <- err
+				return
 			}
 		}
-		time.Sleep(15 * time.Second)
+		select {
+		case <-stop:
+			return
+		case <-time.After(15 * time.Second):
+		}
 	}
 }
-func DiscoveryReceive(r chan []byte, s *ipv4.PacketConn) {
+
+func DiscoveryReceive(r chan []byte, s *ipv4.PacketConn, failed chan error, stop chan bool) {
 	for {
 		buff := make([]byte, 1500)
 		n, _, _, err := s.ReadFrom(buff)
 		if err != nil {
-			panic(err)
+			failed <- err
+			return
+		}
+		select {
+		case r <- buff[:n]:
+		case <-stop:
+			return
 		}
-		r <- buff[:n]
 	}
 }
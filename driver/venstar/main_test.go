@@ -0,0 +1,185 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/SoftwareDefinedBuildings/bw2-contrib/driver/venstar/fakecolortouch"
+	"golang.org/x/net/ipv4"
+)
+
+func TestParseUSN(t *testing.T) {
+	for _, test := range []struct {
+		usn            string
+		mac, name, typ string
+		ok             bool
+	}{
+		{"00:23:a7:3a:b2:72:name:Office:type:residential", "00:23:a7:3a:b2:72", "Office", "residential", true},
+		{"00:23:a7:3a:b2:72:name:A:type:commercial", "00:23:a7:3a:b2:72", "A", "commercial", true},
+		{"00:23:a7:3a:b2:72:name:Living%20Room:type:residential", "00:23:a7:3a:b2:72", "Living%20Room", "residential", true},
+		{"00:23:a7:3a:b2:72:name:A:type:", "00:23:a7:3a:b2:72", "A", "", true},
+		{"", "", "", "", false},
+		{"00:23:a7", "", "", "", false},
+		{"00:23:a7:3a:b2:72", "", "", "", false},
+		{"00:23:a7:3a:b2:72:name:", "", "", "", false},
+		{"00:23:a7:3a:b2:72:name:A", "", "", "", false},
+		{"00:23:a7:3a:b2:72:name::type:residential", "", "", "", false},
+		{"00:23:a7:3a:b2:72:type:residential", "", "", "", false},
+	} {
+		mac, name, typ, ok := parseUSN(test.usn)
+		if ok != test.ok || (ok && (mac != test.mac || name != test.name || typ != test.typ)) {
+			t.Errorf("parseUSN(%q) = %q, %q, %q, %v; want %q, %q, %q, %v",
+				test.usn, mac, name, typ, ok, test.mac, test.name, test.typ, test.ok)
+		}
+	}
+}
+
+func TestParseDiscoveryResponse(t *testing.T) {
+	for _, test := range []struct {
+		resp string
+		ok   bool
+	}{
+		{"HTTP/1.1 200 OK\r\nST: colortouch:ecp\r\nLocation: http://10.0.0.5/\r\nUSN: ecp:00:23:a7:3a:b2:72:name:A:type:residential\r\n\r\n", true},
+		{"HTTP/1.1 200 OK\r\nST: colortouch:ecp\r\nLocation: http://10.0.0.5\r\nUSN: ecp:00:23:a7:3a:b2:72:name:A:type:residential\r\n\r\n", true},
+		{"HTTP/1.1 200 OK\r\nST: upnp:rootdevice\r\nLocation: http://10.0.0.5/\r\nUSN: ecp:00:23:a7:3a:b2:72:name:A:type:residential\r\n\r\n", false},
+		{"HTTP/1.1 200 OK\r\nST: colortouch:ecp\r\nLocation: http://\r\nUSN: ecp:00:23:a7:3a:b2:72:name:A:type:residential\r\n\r\n", false},
+		{"HTTP/1.1 200 OK\r\nST: colortouch:ecp\r\nLocation: http://10.0.0.5/\r\nUSN: ecp:short\r\n\r\n", false},
+		{"HTTP/1.1 200 OK\r\nST: colortouch:ecp\r\nLocation: http://10.0.0.5/\r\nUSN: ecp:\r\n\r\n", false},
+		{"NOTIFY * HTTP/1.1\r\n\r\n", false},
+		{"", false},
+	} {
+		r, ok := parseDiscoveryResponse([]byte(test.resp))
+		if ok != test.ok {
+			t.Errorf("parseDiscoveryResponse(%q) = %+v, %v; want ok = %v", test.resp, r, ok, test.ok)
+		}
+		if ok && r.IP != "10.0.0.5" {
+			t.Errorf("parseDiscoveryResponse(%q) has IP %q, want 10.0.0.5", test.resp, r.IP)
+		}
+	}
+}
+
+// Runs SSDP discovery on loopback against a fake thermostat
+func TestDiscovery(t *testing.T) {
+	for _, tstat := range []fakecolortouch.Thermostat{
+		{Name: "Office", MAC: "00:23:a7:3a:b2:72", Type: "commercial"},
+		{Name: "A"},
+		// Malformed USNs must be skipped, not crash the driver
+		{Name: "Short", USN: "ecp:00:23:a7"},
+		{Name: "Unnamed", USN: "ecp:00:23:a7:3a:b2:72:name:"},
+	} {
+		dev := fakecolortouch.New(tstat)
+		defer dev.Close()
+		addr, err := dev.ServeSSDP()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ssdpGroup = addr
+
+		conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sock := ipv4.NewPacketConn(conn)
+		ch := make(chan DiscoveryRecord, 1)
+		done := make(chan error, 1)
+		go func() { done <- discover([]*ipv4.PacketConn{sock}, ch) }()
+
+		want := dev.Thermostat()
+		select {
+		case r := <-ch:
+			if tstat.USN != "" {
+				t.Errorf("Discovered %+v from malformed USN %q", r, tstat.USN)
+			} else if r.IP != dev.Addr() || r.Name != want.Name || r.MAC != want.MAC || r.Type != want.Type {
+				t.Errorf("Discovered %+v, want %s at %s (%s, %s)", r, want.Name, dev.Addr(), want.MAC, want.Type)
+			}
+		case err := <-done:
+			t.Errorf("Discovery of %s failed: %v", want.Name, err)
+		case <-time.After(time.Second):
+			if tstat.USN == "" {
+				t.Errorf("Did not discover %s", want.Name)
+			}
+		}
+
+		// Closing the socket must end discovery with an error
+		sock.Close()
+		select {
+		case err := <-done:
+			if err == nil {
+				t.Error("Discovery ended without an error")
+			}
+		case <-time.After(time.Second):
+			t.Error("Discovery did not end when its socket was closed")
+		}
+	}
+}
+
+func TestProbe(t *testing.T) {
+	dev := fakecolortouch.New(fakecolortouch.Thermostat{Name: "Office"})
+	defer dev.Close()
+	r, ok := probe(dev.Addr())
+	if !ok || r.Name != "Office" || r.IP != dev.Addr() {
+		t.Errorf("probe(%s) = %+v, %v; want Office", dev.Addr(), r, ok)
+	}
+	dev.Close()
+	if r, ok := probe(dev.Addr()); ok {
+		t.Errorf("probe of a closed thermostat found %+v", r)
+	}
+}
+
+// A thermostat only found by probing keeps its driver when it moves
+func TestTrackProbedThermostat(t *testing.T) {
+	dev := fakecolortouch.New(fakecolortouch.Thermostat{Name: "Office"})
+	defer dev.Close()
+	moved := fakecolortouch.New(fakecolortouch.Thermostat{Name: "Office"})
+	defer moved.Close()
+
+	ch := make(chan DiscoveryRecord, 2)
+	for _, addr := range []string{dev.Addr(), moved.Addr()} {
+		r, ok := probe(addr)
+		if !ok {
+			t.Fatalf("probe(%s) found nothing", addr)
+		}
+		ch <- r
+	}
+	close(ch)
+
+	var registered []DiscoveryRecord
+	upd := make(chan DiscoveryRecord, 2)
+	trackThermostats(ch, func(r DiscoveryRecord) chan DiscoveryRecord {
+		registered = append(registered, r)
+		return upd
+	})
+	if len(registered) != 1 || registered[0].IP != dev.Addr() {
+		t.Fatalf("Registered %+v, want Office at %s only", registered, dev.Addr())
+	}
+	select {
+	case r := <-upd:
+		if r.IP != moved.Addr() || r.Name != "Office" {
+			t.Errorf("Sent update %+v, want Office at %s", r, moved.Addr())
+		}
+	default:
+		t.Errorf("Office moving to %s was not sent to its driver", moved.Addr())
+	}
+}
+
+func TestParseTargets(t *testing.T) {
+	targets, err := parseTargets([]string{"10.0.0.5", "192.168.1.0/30", "172.16.0.8/31"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"10.0.0.5", "192.168.1.1", "192.168.1.2", "172.16.0.8", "172.16.0.9"}
+	if len(targets) != len(want) {
+		t.Fatalf("parseTargets = %v, want %v", targets, want)
+	}
+	for i := range want {
+		if targets[i] != want[i] {
+			t.Fatalf("parseTargets = %v, want %v", targets, want)
+		}
+	}
+	for _, bad := range []string{"venstar", "10.0.0.0/8", "fe80::/64"} {
+		if _, err := parseTargets([]string{bad}); err == nil {
+			t.Errorf("parseTargets accepted %q", bad)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// How often the static addresses are probed
+	PROBE_INTERVAL = time.Minute
+	PROBE_TIMEOUT  = 2 * time.Second
+	// How many addresses are probed at once
+	PROBE_PARALLELISM = 32
+	// Smallest CIDR prefix accepted in static_ips, so a typo can't have the
+	// driver probe millions of addresses
+	MIN_PROBE_PREFIX = 16
+)
+
+var probeClient = &http.Client{Timeout: PROBE_TIMEOUT}
+
+// Expands the static_ips param, a list of IPs and CIDR ranges, into the
+// addresses to probe
+func parseTargets(entries []string) ([]string, error) {
+	var targets []string
+	for _, entry := range entries {
+		if ip := net.ParseIP(entry); ip != nil {
+			targets = append(targets, ip.String())
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid static_ips entry %q: not an IP or CIDR range", entry)
+		}
+		ones, bits := network.Mask.Size()
+		if bits != 32 {
+			return nil, fmt.Errorf("Invalid static_ips entry %q: only IPv4 ranges are supported", entry)
+		}
+		if ones < MIN_PROBE_PREFIX {
+			return nil, fmt.Errorf("Invalid static_ips entry %q: ranges may be at most /%d", entry, MIN_PROBE_PREFIX)
+		}
+		first := ipToInt(network.IP.To4())
+		last := first | (1<<uint(bits-ones) - 1)
+		// Skip the network and broadcast addresses, which ranges up to /30 have
+		if ones < 31 {
+			first++
+			last--
+		}
+		for addr := first; ; addr++ {
+			targets = append(targets, intToIP(addr).String())
+			if addr == last {
+				break
+			}
+		}
+	}
+	return targets, nil
+}
+
+func ipToInt(ip net.IP) uint32 {
+	return uint32(ip[0])<<24 | uint32(ip[1])<<16 | uint32(ip[2])<<8 | uint32(ip[3])
+}
+
+func intToIP(addr uint32) net.IP {
+	return net.IPv4(byte(addr>>24), byte(addr>>16), byte(addr>>8), byte(addr))
+}
+
+// Discovers thermostats at the given addresses by asking each for /query/info,
+// for networks where SSDP multicast does not reach the driver
+func Probe(targets []string, discovery chan DiscoveryRecord) {
+	for {
+		var wg sync.WaitGroup
+		slots := make(chan bool, PROBE_PARALLELISM)
+		for _, ip := range targets {
+			wg.Add(1)
+			slots <- true
+			go func(ip string) {
+				defer wg.Done()
+				defer func() { <-slots }()
+				if r, ok := probe(ip); ok {
+					discovery <- r
+				}
+			}(ip)
+		}
+		wg.Wait()
+		time.Sleep(PROBE_INTERVAL)
+	}
+}
+
+// Returns false unless there is a ColorTouch at ip
+func probe(ip string) (DiscoveryRecord, bool) {
+	resp, err := probeClient.Get("http://" + ip + "/query/info")
+	if err != nil {
+		return DiscoveryRecord{}, false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return DiscoveryRecord{}, false
+	}
+	var inf InfoResponse
+	if err := json.NewDecoder(resp.Body).Decode(&inf); err != nil || inf.Name == "" {
+		return DiscoveryRecord{}, false
+	}
+	return DiscoveryRecord{IP: ip, Name: inf.Name}, true
+}
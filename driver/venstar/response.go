@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	bw2 "gopkg.in/immesys/bw2bind.v5"
+)
+
+// Why a command was not applied
+const (
+	// No scrape has succeeded yet, so the thermostat's limits are unknown
+	ERR_NO_STATE = "no_state"
+	// The thermostat doesn't offer the requested mode
+	ERR_MODE_UNAVAILABLE = "mode_unavailable"
+	// A setpoint is outside of the range the thermostat reports
+	ERR_SETPOINT_RANGE = "setpoint_range"
+	// The setpoints are closer than the thermostat's setpoint delta
+	ERR_SETPOINT_DELTA = "setpoint_delta"
+	// The thermostat could not be reached or rejected the command
+	ERR_REQUEST_FAILED = "request_failed"
+	// The command has an unknown fan mode or an invalid number of stages
+	ERR_INVALID_COMMAND = "invalid_command"
+)
+
+// Modes as numbered by the local API and on i.xbos.thermostat
+const (
+	MODE_OFF  = 0
+	MODE_HEAT = 1
+	MODE_COOL = 2
+	MODE_AUTO = 3
+)
+
+// Fan modes as numbered by the local API. Circulate needs firmware that
+// supports it.
+const (
+	FAN_AUTO      = 0
+	FAN_ON        = 1
+	FAN_CIRCULATE = 2
+)
+
+// Names of the fan modes in fan_mode on i.xbos.thermostat
+var fanModes = map[string]int{
+	"auto":      FAN_AUTO,
+	"on":        FAN_ON,
+	"circulate": FAN_CIRCULATE,
+}
+
+func fanModeName(fan int) string {
+	for name, value := range fanModes {
+		if value == fan {
+			return name
+		}
+	}
+	return fmt.Sprintf("%d", fan)
+}
+
+// Most heating or cooling stages a ColorTouch drives
+const MAX_STAGES = 2
+
+// Values of InfoResponse.AvailableModes
+const (
+	AVAILABLE_ALL       = 0
+	AVAILABLE_HEAT_COOL = 1
+	AVAILABLE_HEAT      = 2
+	AVAILABLE_COOL      = 3
+)
+
+// Returned by SetSetpoints when a command is not applied
+type ActuationError struct {
+	// One of the ERR_* constants
+	Code    string
+	Message string
+}
+
+func (e *ActuationError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+func actuationErrorf(code, format string, args ...interface{}) *ActuationError {
+	return &ActuationError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// A command received on one of the slots, as sent on the state slot of
+// i.xbos.thermostat. Fields left nil are not changed.
+type command struct {
+	HeatingSetpoint *float64 `msgpack:"heating_setpoint"`
+	CoolingSetpoint *float64 `msgpack:"cooling_setpoint"`
+	Mode            *int     `msgpack:"mode"`
+	Override        *bool    `msgpack:"override"`
+	// Turns the fan on or back to auto; FanMode takes precedence
+	Fan *bool `msgpack:"fan"`
+	// "auto", "on" or "circulate"
+	FanMode       *string `msgpack:"fan_mode"`
+	Away          *bool   `msgpack:"away"`
+	HeatingStages *int    `msgpack:"enabled_heat_stages"`
+	CoolingStages *int    `msgpack:"enabled_cool_stages"`
+}
+
+// Published on the response signal of i.xbos.thermostat for every command
+// received on its slots and the control slot of i.venstar, so that
+// controllers can tell whether the command took effect
+type responseMsg struct {
+	Slot    string `msgpack:"slot"`
+	Success bool   `msgpack:"success"`
+	// One of the ERR_* constants, empty on success
+	Error   string `msgpack:"error"`
+	Message string `msgpack:"message"`
+	// The command as it was received
+	HeatingSetpoint *float64 `msgpack:"heating_setpoint"`
+	CoolingSetpoint *float64 `msgpack:"cooling_setpoint"`
+	Mode            *int     `msgpack:"mode"`
+	Fan             *bool    `msgpack:"fan"`
+	FanMode         *string  `msgpack:"fan_mode"`
+	Override        *bool    `msgpack:"override"`
+	Away            *bool    `msgpack:"away"`
+	HeatingStages   *int     `msgpack:"enabled_heat_stages"`
+	CoolingStages   *int     `msgpack:"enabled_cool_stages"`
+	Time            int64    `msgpack:"time"`
+}
+
+// Applies a command received on slot and publishes the outcome
+func (d *Driver) actuate(slot string, cmd command) {
+	msg := responseMsg{
+		Slot:            slot,
+		Success:         true,
+		HeatingSetpoint: cmd.HeatingSetpoint,
+		CoolingSetpoint: cmd.CoolingSetpoint,
+		Mode:            cmd.Mode,
+		Fan:             cmd.Fan,
+		FanMode:         cmd.FanMode,
+		Override:        cmd.Override,
+		Away:            cmd.Away,
+		HeatingStages:   cmd.HeatingStages,
+		CoolingStages:   cmd.CoolingStages,
+	}
+	fan, err := cmd.fan()
+	setpoints := cmd.Mode != nil || cmd.HeatingSetpoint != nil || cmd.CoolingSetpoint != nil || fan != nil || cmd.Override != nil
+	stages := cmd.HeatingStages != nil || cmd.CoolingStages != nil
+	if err == nil && cmd.Away != nil {
+		err = d.SetAway(*cmd.Away)
+	}
+	if err == nil && stages {
+		err = d.SetStages(cmd.HeatingStages, cmd.CoolingStages)
+	}
+	// Commands that only set away or stages leave the rest alone
+	if err == nil && (setpoints || (cmd.Away == nil && !stages)) {
+		err = d.SetSetpoints(cmd.Mode, cmd.HeatingSetpoint, cmd.CoolingSetpoint, fan, cmd.Override)
+	}
+	if err != nil {
+		fmt.Println("SET FAILURE: ", err)
+		msg.Success = false
+		msg.Error = ERR_REQUEST_FAILED
+		msg.Message = err.Error()
+		if actErr, ok := err.(*ActuationError); ok {
+			msg.Error = actErr.Code
+			msg.Message = actErr.Message
+		}
+	}
+	msg.Time = time.Now().UnixNano()
+
+	po, err := bw2.CreateMsgPackPayloadObject(bw2.FromDotForm(PONUM), msg)
+	if err != nil {
+		fmt.Println("Failed to create response msgpack PO:", err)
+		return
+	}
+	d.xbos_iface.PublishSignal("response", po)
+}
+
+// The fan mode the command asks for, as numbered by the local API, or nil if
+// it leaves the fan alone
+func (cmd command) fan() (*int, error) {
+	if cmd.FanMode != nil {
+		fan, ok := fanModes[*cmd.FanMode]
+		if !ok {
+			return nil, actuationErrorf(ERR_INVALID_COMMAND, "unknown fan mode %q", *cmd.FanMode)
+		}
+		return &fan, nil
+	}
+	if cmd.Fan != nil {
+		fan := FAN_AUTO
+		if *cmd.Fan {
+			fan = FAN_ON
+		}
+		return &fan, nil
+	}
+	return nil, nil
+}
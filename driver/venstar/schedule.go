@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	bw2 "gopkg.in/immesys/bw2bind.v5"
+)
+
+// Published on the info signal of i.xbos.thermostat_schedule. The local API
+// only tells whether the thermostat follows its schedule and which part of the
+// schedule is current; the schedule's times and setpoints can only be read and
+// edited on the thermostat itself, so they are left out.
+type scheduleMsg struct {
+	Enabled bool `msgpack:"schedule_enabled"`
+	// 0 to 3 for morning, day, evening and night (occupied and unoccupied
+	// on commercial models), or 255 if the schedule is not running
+	Part int   `msgpack:"schedule_part"`
+	Time int64 `msgpack:"time"`
+}
+
+// Accepted on the schedule slot of i.venstar
+type scheduleCommand struct {
+	Enabled *bool `msgpack:"schedule_enabled"`
+}
+
+func (d *Driver) publishSchedule(inf *InfoResponse) {
+	msg := scheduleMsg{Enabled: inf.Schedule == 1, Part: inf.SchedulePart, Time: inf.Time}
+	po, err := bw2.CreateMsgPackPayloadObject(bw2.FromDotForm(SCHEDULE_PONUM), msg)
+	if err != nil {
+		fmt.Println("Failed to create schedule msgpack PO:", err)
+		return
+	}
+	d.sched_iface.PublishSignal("info", po)
+}
+
+func (d *Driver) handleSchedule(msg *bw2.SimpleMessage) {
+	fmt.Println("got message from slot schedule:")
+	msg.Dump()
+
+	var cmd scheduleCommand
+	for _, po := range msg.POs {
+		if !po.IsType(bw2.PONumMsgPack, bw2.POMaskMsgPack) {
+			continue
+		}
+		pom, ok := po.(bw2.MsgPackPayloadObject)
+		if !ok {
+			fmt.Println("skipping invalid schedule command")
+			continue
+		}
+		if err := pom.ValueInto(&cmd); err != nil {
+			fmt.Println(err)
+			return
+		}
+		break
+	}
+	if cmd.Enabled == nil {
+		fmt.Println("Received schedule command without schedule_enabled, dropping")
+		return
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	values := url.Values{"schedule": {"0"}}
+	if *cmd.Enabled {
+		values.Set("schedule", "1")
+	}
+	if err := d.post("/settings", values); err != nil {
+		fmt.Println("SET FAILURE: ", err)
+		return
+	}
+	// The driver overrides the thermostat by turning its schedule off
+	d.override = !*cmd.Enabled
+	fmt.Printf("Schedule on %s enabled = %v at %v\n", d.ifaceName, *cmd.Enabled, time.Now())
+}
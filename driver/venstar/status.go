@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	bw2 "gopkg.in/immesys/bw2bind.v5"
+)
+
+// How often run times and alerts are polled. The thermostat only updates
+// its run times every few minutes, so there is no point in asking each scrape.
+const STATUS_INTERVAL = 5 * time.Minute
+
+type temperatureSensorMsg struct {
+	Temperature float64 `msgpack:"temperature"`
+	Time        int64   `msgpack:"time"`
+}
+
+// Minutes each stage ran on one day, published on the runtime signal of
+// i.xbos.thermostat once the day is over
+type runtimeMsg struct {
+	// Bounds of the day, in nanoseconds since the epoch
+	Start       int64 `msgpack:"start"`
+	End         int64 `msgpack:"end"`
+	HeatStage1  int   `msgpack:"heat_stage1_runtime"`
+	HeatStage2  int   `msgpack:"heat_stage2_runtime"`
+	CoolStage1  int   `msgpack:"cool_stage1_runtime"`
+	CoolStage2  int   `msgpack:"cool_stage2_runtime"`
+	AuxStage1   int   `msgpack:"aux_stage1_runtime"`
+	AuxStage2   int   `msgpack:"aux_stage2_runtime"`
+	FreeCooling int   `msgpack:"free_cooling_runtime"`
+	Time        int64 `msgpack:"time"`
+}
+
+// Published on the alert signal of i.xbos.thermostat whenever an alert is
+// raised or cleared
+type alertMsg struct {
+	Name   string `msgpack:"name"`
+	Active bool   `msgpack:"active"`
+	Time   int64  `msgpack:"time"`
+}
+
+// Fetches one of the thermostat's query endpoints and decodes its response
+func (d *Driver) query(endpoint string, result interface{}) error {
+	resp, err := http.Get("http://" + d.record().IP + endpoint)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", endpoint, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("Failed to decode %s: %v", endpoint, err)
+	}
+	return nil
+}
+
+// Reply of /control and /settings
+type postResponse struct {
+	Success bool   `json:"success"`
+	Error   bool   `json:"error"`
+	Reason  string `json:"reason"`
+}
+
+// Posts to /control or /settings, failing if the thermostat rejects the change
+func (d *Driver) post(endpoint string, values url.Values) error {
+	resp, err := http.PostForm("http://"+d.record().IP+endpoint, values)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	contents, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var result postResponse
+	if err := json.Unmarshal(contents, &result); err != nil {
+		return fmt.Errorf("Failed to decode %s response %q: %v", endpoint, contents, err)
+	}
+	if result.Error || !result.Success {
+		return fmt.Errorf("Thermostat rejected %s %v: %s", endpoint, values, result.Reason)
+	}
+	return nil
+}
+
+func (d *Driver) pollStatus() {
+	for {
+		d.ScrapeRuntimes()
+		d.ScrapeAlerts()
+		time.Sleep(STATUS_INTERVAL)
+	}
+}
+
+// Publishes the thermostat's sensors on i.venstar, and every sensor but the
+// thermostat's own on an i.xbos.temperature_sensor interface of its own.
+// The humidity of the thermostat's own sensor goes into the next info.
+func (d *Driver) ScrapeSensors() {
+	var sens SensorsResponse
+	if err := d.query("/query/sensors", &sens); err != nil {
+		fmt.Println(err)
+		return
+	}
+	sens.Time = time.Now().UnixNano()
+	po, err := bw2.CreateMsgPackPayloadObject(bw2.PONumTimeseriesReading, sens)
+	if err != nil {
+		fmt.Println("Failed to create sensors msgpack PO:", err)
+		return
+	}
+	d.iface.PublishSignal("sensors", po)
+
+	d.Lock()
+	units := TEMPUNITS_F
+	if d.lastinfo != nil {
+		units = d.lastinfo.TempUnits
+	}
+	for _, sensor := range sens.Sensors {
+		if isThermostatSensor(sensor) && sensor.Humidity != nil {
+			humidity := *sensor.Humidity
+			d.lasthum = &humidity
+		}
+	}
+	d.Unlock()
+
+	for _, sensor := range sens.Sensors {
+		// The thermostat's own sensor is already reported on i.xbos.thermostat
+		if sensor.Temp == nil || isThermostatSensor(sensor) {
+			continue
+		}
+		msg := temperatureSensorMsg{Temperature: toFahrenheit(*sensor.Temp, units), Time: sens.Time}
+		po, err := bw2.CreateMsgPackPayloadObject(bw2.FromDotForm(SENSOR_PONUM), msg)
+		if err != nil {
+			fmt.Println("Failed to create sensor msgpack PO:", err)
+			continue
+		}
+		d.sensorInterface(sensor.Name).PublishSignal("info", po)
+	}
+}
+
+// Whether the sensor is the thermostat's own
+func isThermostatSensor(sensor Sensor) bool {
+	return sensor.Type == "Thermostat" || (sensor.Type == "" && sensor.Name == "Thermostat")
+}
+
+// The interface of a sensor, registered under the thermostat's name the
+// first time the sensor is seen
+func (d *Driver) sensorInterface(name string) *bw2.Interface {
+	d.Lock()
+	defer d.Unlock()
+	iface, ok := d.sensorIfaces[name]
+	if !ok {
+		ifaceName := strings.Replace(name, " ", "_", -1)
+		iface = d.svc.RegisterInterface(d.ifaceName+"/"+ifaceName, "i.xbos.temperature_sensor")
+		d.sensorIfaces[name] = iface
+	}
+	return iface
+}
+
+// Publishes the thermostat's run times on i.venstar, and each day the
+// driver has not yet reported once it is over on i.xbos.thermostat
+func (d *Driver) ScrapeRuntimes() {
+	var runtimes RuntimesResponse
+	if err := d.query("/query/runtimes", &runtimes); err != nil {
+		fmt.Println(err)
+		return
+	}
+	runtimes.Time = time.Now().UnixNano()
+	po, err := bw2.CreateMsgPackPayloadObject(bw2.PONumTimeseriesReading, runtimes)
+	if err != nil {
+		fmt.Println("Failed to create runtimes msgpack PO:", err)
+		return
+	}
+	d.iface.PublishSignal("runtimes", po)
+
+	// The last record is today's, which is not over yet
+	for i := 0; i < len(runtimes.Runtimes)-1; i++ {
+		day := runtimes.Runtimes[i]
+		if day.Timestamp <= d.lastRuntime {
+			continue
+		}
+		start := time.Unix(day.Timestamp, 0)
+		end := start.AddDate(0, 0, 1)
+		msg := runtimeMsg{
+			Start:       start.UnixNano(),
+			End:         end.UnixNano(),
+			HeatStage1:  day.Heat1,
+			HeatStage2:  day.Heat2,
+			CoolStage1:  day.Cool1,
+			CoolStage2:  day.Cool2,
+			AuxStage1:   day.Aux1,
+			AuxStage2:   day.Aux2,
+			FreeCooling: day.FreeCooling,
+			Time:        end.UnixNano(),
+		}
+		po, err := bw2.CreateMsgPackPayloadObject(bw2.FromDotForm(PONUM), msg)
+		if err != nil {
+			fmt.Println("Failed to create runtime msgpack PO:", err)
+			return
+		}
+		d.xbos_iface.PublishSignal("runtime", po)
+		d.lastRuntime = day.Timestamp
+	}
+}
+
+// Publishes the thermostat's alerts on i.venstar, and each change in an
+// alert, such as the air filter coming due, on i.xbos.thermostat
+func (d *Driver) ScrapeAlerts() {
+	var alerts AlertsResponse
+	if err := d.query("/query/alerts", &alerts); err != nil {
+		fmt.Println(err)
+		return
+	}
+	alerts.Time = time.Now().UnixNano()
+	po, err := bw2.CreateMsgPackPayloadObject(bw2.PONumTimeseriesReading, alerts)
+	if err != nil {
+		fmt.Println("Failed to create alerts msgpack PO:", err)
+		return
+	}
+	d.iface.PublishSignal("alerts", po)
+
+	for _, alert := range alerts.Alerts {
+		active, known := d.activeAlerts[alert.Name]
+		d.activeAlerts[alert.Name] = alert.Active
+		// Alerts that are already clear when first seen are not news
+		if (known && active == alert.Active) || (!known && !alert.Active) {
+			continue
+		}
+		fmt.Printf("%s alert on %s: active = %v\n", alert.Name, d.ifaceName, alert.Active)
+		po, err := bw2.CreateMsgPackPayloadObject(bw2.FromDotForm(PONUM), alertMsg{Name: alert.Name, Active: alert.Active, Time: alerts.Time})
+		if err != nil {
+			fmt.Println("Failed to create alert msgpack PO:", err)
+			continue
+		}
+		d.xbos_iface.PublishSignal("alert", po)
+	}
+}
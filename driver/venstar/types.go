@@ -1,28 +1,81 @@
 package main
 
 type InfoResponse struct {
-	Time           int64   `json:"-" msgpack:"time"`
-	UUID           string  `json:"UUID" msgpack:"UUID"`
-	Name           string  `json:"name" msgpack:"name"`
-	Mode           int     `json:"mode" msgpack:"mode"`
-	State          int     `json:"state" msgpack:"state"`
-	Fan            int     `json:"fan" msgpack:"fan"`
-	FanState       int     `json:"fanstate" msgpack:"fanstate"`
-	TempUnits      int     `json:"tempunits" msgpack:"tempunits"`
-	Schedule       int     `json:"schedule" msgpack:"schedule"`
-	SchedulePart   int     `json:"schedulepart" msgpack:"schedulepart"`
-	Away           int     `json:"away" msgpack:"away"`
-	Holiday        int     `json:"holiday" msgpack:"holiday"`
-	Override       int     `json:"override" msgpack:"override"`
-	OverrideTime   int     `json:"overridetime" msgpack:"overridetime"`
-	ForceUnocc     int     `json:"forceunocc" msgpack:"forceunocc"`
-	SpaceTemp      float64 `json:"spacetemp" msgpack:"spacetemp"`
-	HeatTemp       float64 `json:"heattemp" msgpack:"heattemp"`
-	CoolTemp       float64 `json:"cooltemp" msgpack:"cooltemp"`
-	CoolTempMin    float64 `json:"cooltempmin" msgpack:"cooltempmin"`
-	CooltempMax    float64 `json:"cooltempmax" msgpack:"cooltempmax"`
-	HeatTempMin    float64 `json:"heattempmin" msgpack:"heattempmin"`
-	HeatTempMax    float64 `json:"heattempmax" msgpack:"heattempmax"`
-	SetpointDelta  float64 `json:"setpointdelta" msgpack:"setpointdelta"`
-	AvailableModes int     `json:"availablemodes" msgpack:"availablemodes"`
+	Time         int64   `json:"-" msgpack:"time"`
+	UUID         string  `json:"UUID" msgpack:"UUID"`
+	Name         string  `json:"name" msgpack:"name"`
+	Mode         int     `json:"mode" msgpack:"mode"`
+	State        int     `json:"state" msgpack:"state"`
+	Fan          int     `json:"fan" msgpack:"fan"`
+	FanState     int     `json:"fanstate" msgpack:"fanstate"`
+	TempUnits    int     `json:"tempunits" msgpack:"tempunits"`
+	Schedule     int     `json:"schedule" msgpack:"schedule"`
+	SchedulePart int     `json:"schedulepart" msgpack:"schedulepart"`
+	Away         int     `json:"away" msgpack:"away"`
+	Holiday      int     `json:"holiday" msgpack:"holiday"`
+	Override     int     `json:"override" msgpack:"override"`
+	OverrideTime int     `json:"overridetime" msgpack:"overridetime"`
+	ForceUnocc   int     `json:"forceunocc" msgpack:"forceunocc"`
+	SpaceTemp    float64 `json:"spacetemp" msgpack:"spacetemp"`
+	// Only reported by thermostats with a humidity sensor, on newer firmware
+	Humidity       *float64 `json:"hum" msgpack:"hum"`
+	HeatTemp       float64  `json:"heattemp" msgpack:"heattemp"`
+	CoolTemp       float64  `json:"cooltemp" msgpack:"cooltemp"`
+	CoolTempMin    float64  `json:"cooltempmin" msgpack:"cooltempmin"`
+	CooltempMax    float64  `json:"cooltempmax" msgpack:"cooltempmax"`
+	HeatTempMin    float64  `json:"heattempmin" msgpack:"heattempmin"`
+	HeatTempMax    float64  `json:"heattempmax" msgpack:"heattempmax"`
+	SetpointDelta  float64  `json:"setpointdelta" msgpack:"setpointdelta"`
+	AvailableModes int      `json:"availablemodes" msgpack:"availablemodes"`
+	// Only reported by firmware that lets the enabled stages be changed
+	HeatStages *int `json:"heatstages" msgpack:"heatstages"`
+	CoolStages *int `json:"coolstages" msgpack:"coolstages"`
+}
+
+// Response of /query/sensors
+type SensorsResponse struct {
+	Time    int64    `json:"-" msgpack:"time"`
+	Sensors []Sensor `json:"sensors" msgpack:"sensors"`
+}
+
+// A sensor attached to the thermostat. Type is one of "Thermostat",
+// "Outdoor", "Remote", "Supply" or "Return"; older firmware leaves it out.
+type Sensor struct {
+	Name     string   `json:"name" msgpack:"name"`
+	Type     string   `json:"type" msgpack:"type"`
+	Temp     *float64 `json:"temp" msgpack:"temp"`
+	Humidity *float64 `json:"hum" msgpack:"hum"`
+}
+
+// Response of /query/runtimes. The thermostat keeps one record per day for
+// the last week; the last record is today's and still accumulating.
+type RuntimesResponse struct {
+	Time     int64     `json:"-" msgpack:"time"`
+	Runtimes []Runtime `json:"runtimes" msgpack:"runtimes"`
+}
+
+// Minutes each stage ran on one day
+type Runtime struct {
+	// Start of the day, in seconds since the epoch
+	Timestamp   int64 `json:"ts" msgpack:"ts"`
+	Heat1       int   `json:"heat1" msgpack:"heat1"`
+	Heat2       int   `json:"heat2" msgpack:"heat2"`
+	Cool1       int   `json:"cool1" msgpack:"cool1"`
+	Cool2       int   `json:"cool2" msgpack:"cool2"`
+	Aux1        int   `json:"aux1" msgpack:"aux1"`
+	Aux2        int   `json:"aux2" msgpack:"aux2"`
+	FreeCooling int   `json:"fc" msgpack:"fc"`
+}
+
+// Response of /query/alerts
+type AlertsResponse struct {
+	Time   int64   `json:"-" msgpack:"time"`
+	Alerts []Alert `json:"alerts" msgpack:"alerts"`
+}
+
+// One of the thermostat's maintenance alerts, e.g. "Air Filter", "UV Lamp"
+// or "Service"
+type Alert struct {
+	Name   string `json:"name" msgpack:"name"`
+	Active bool   `json:"active" msgpack:"active"`
 }
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// Values of InfoResponse.TempUnits. Everything on the XBOS interfaces is in
+// Fahrenheit, whatever the thermostat is set to.
+const (
+	TEMPUNITS_F = 0
+	TEMPUNITS_C = 1
+)
+
+// Converts a temperature reported by the thermostat to Fahrenheit
+func toFahrenheit(temp float64, units int) float64 {
+	if units == TEMPUNITS_C {
+		return temp*9/5 + 32
+	}
+	return temp
+}
+
+// Converts a Fahrenheit temperature to the thermostat's units, rounded to
+// what the thermostat accepts: whole degrees Fahrenheit or half degrees Celsius
+func fromFahrenheit(temp float64, units int) float64 {
+	if units == TEMPUNITS_C {
+		return math.Round((temp-32)*5/9*2) / 2
+	}
+	return math.Round(temp)
+}
+
+// Formats a setpoint in the thermostat's units for /control
+func formatSetpoint(temp float64, units int) string {
+	if units == TEMPUNITS_C {
+		return fmt.Sprintf("%.1f", temp)
+	}
+	return fmt.Sprintf("%d", int(temp))
+}
+
+func unitName(units int) string {
+	if units == TEMPUNITS_C {
+		return "C"
+	}
+	return "F"
+}